@@ -1,17 +1,20 @@
 package aof
 
 import (
+	"fmt"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/lib/encrypt"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/utils"
-	"github.com/hdt3213/godis/redis/connection"
-	"github.com/hdt3213/godis/redis/parser"
 	"github.com/hdt3213/godis/redis/protocol"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // CmdLine is alias for [][]byte, represents a command line
@@ -19,85 +22,437 @@ type CmdLine = [][]byte
 
 const (
 	aofQueueSize = 1 << 16
+	// max number of commands written before one fsync in `always` policy
+	fsyncBatchSize = 1 << 10
+)
+
+const (
+	// FsyncAlways do fsync for every command before replying client
+	FsyncAlways = "always"
+	// FsyncEverySec do fsync every second in background
+	FsyncEverySec = "everysec"
+	// FsyncNo lets the operating system decide when to flush data
+	FsyncNo = "no"
 )
 
 type payload struct {
 	cmdLine CmdLine
 	dbIndex int
+	// not nil if the invoker is waiting for fsync
+	wg *sync.WaitGroup
+	// set before wg.Done if the command was not written or synced
+	err error
+	// not nil if it is a mark of rewrite rather than a command
+	mark chan *rewriteMark
+}
+
+// FsyncStats records latency of fsync, all durations are in nanoseconds
+type FsyncStats struct {
+	Count       int64
+	LastLatency int64
+	MaxLatency  int64
+	AvgLatency  int64
+	// time since the last fsync if there is data not synced yet, otherwise 0
+	Lag int64
 }
 
 // Handler receive msgs from channel and write to AOF file
 type Handler struct {
-	db          database.EmbedDB
-	tmpDBMaker  func() database.EmbedDB
-	aofChan     chan *payload
-	aofFile     *os.File
-	aofFilename string
+	db      database.EmbedDB
+	aofChan chan *payload
+	// the last incremental file in manifest, commands are appended to it
+	aofFile *os.File
+	// writes into aofFile, it encrypts data if encryption is enabled, closed after the file finished
+	aofWriter   io.WriteCloser
+	aofDir      string
+	aofBasename string
+	// manifest is replaced while pausingAof is locked
+	manifest *manifest
+	// write checksum for each record
+	checksum bool
+	// whether the last incremental file is in checksum mode, set by LoadAof
+	lastFileFramed bool
+	// keys for encrypting new files and decrypting existing files
+	keyring *encrypt.Keyring
+	// whether the last incremental file is encrypted, set by LoadAof
+	lastFileEncrypted bool
+	// progress of loading files at startup, nil if not needed
+	progress *LoadingProgress
+	// write timestamp annotations
+	timestamp bool
+	// unix time of the last timestamp annotation, accessed by aof goroutine only
+	lastTimestamp int64
 	// aof goroutine will send msg to main goroutine through this channel when aof tasks finished and ready to shutdown
 	aofFinished chan struct{}
 	// pause aof for start/finish aof rewrite progress
 	pausingAof sync.RWMutex
 	currentDB  int
+
+	aofFsync string
+	// stop background goroutine for fsync and auto rewrite
+	stopCron chan struct{}
+	// 1 if a rewrite is running
+	rewriting int32
+	// aof file size after the latest rewrite or startup, and the current size
+	baseSize    int64
+	currentSize int64
+	// number of commands written and synced, accessed atomically
+	written int64
+	synced  int64
+	// fsync statistics, accessed atomically
+	fsyncCount        int64
+	fsyncLatencyTotal int64
+	lastFsyncLatency  int64
+	maxFsyncLatency   int64
+	lastFsync         int64 // unix nano
+	// the first write or fsync error, holds *aofFailure
+	failure atomic.Value
+}
+
+type aofFailure struct {
+	err error
 }
 
-// NewAOFHandler creates a new aof.Handler
-func NewAOFHandler(db database.EmbedDB, tmpDBMaker func() database.EmbedDB) (*Handler, error) {
-	handler := &Handler{}
-	handler.aofFilename = config.Properties.AppendFilename
+// NewAOFHandler creates a new aof.Handler and loads existing aof files into db, progress could be nil
+func NewAOFHandler(db database.EmbedDB, progress *LoadingProgress) (*Handler, error) {
+	handler := &Handler{
+		progress: progress,
+	}
+	handler.aofDir = getAofDirname()
+	handler.aofBasename = filepath.Base(getAofFilename())
 	handler.db = db
-	handler.tmpDBMaker = tmpDBMaker
-	handler.LoadAof(0)
-	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	keyring, err := encrypt.LoadKeyring(config.Properties.EncryptionKeyFile, config.Properties.EncryptionOldKeyFiles)
+	if err != nil {
+		return nil, fmt.Errorf("load encryption key failed: %v", err)
+	}
+	handler.keyring = keyring
+	err = os.MkdirAll(handler.aofDir, 0755)
 	if err != nil {
 		return nil, err
 	}
-	handler.aofFile = aofFile
+	err = handler.loadManifest()
+	if err != nil {
+		return nil, err
+	}
+	err = handler.LoadAof()
+	if err != nil {
+		return nil, err
+	}
+	handler.checksum = config.Properties.AofChecksum
+	handler.timestamp = config.Properties.AofTimestampEnabled
+	err = handler.openIncrFile()
+	if err != nil {
+		return nil, err
+	}
+	handler.baseSize, handler.currentSize = handler.statFiles()
 	handler.aofChan = make(chan *payload, aofQueueSize)
 	handler.aofFinished = make(chan struct{})
+	handler.lastFsync = time.Now().UnixNano()
+	handler.aofFsync = getFsyncPolicy()
 	go func() {
 		handler.handleAof()
 	}()
+	handler.stopCron = make(chan struct{})
+	go handler.cron()
 	return handler, nil
 }
 
+// openIncrFile opens the last incremental file for appending.
+// A new incremental file is started if checksum mode of the last one is different from config.
+// Encrypted files are never appended after restart, so that key could be rotated and nonces are never reused.
+func (handler *Handler) openIncrFile() error {
+	filename := handler.aofPath(handler.manifest.lastIncr())
+	fileInfo, err := os.Stat(filename)
+	encrypted := handler.keyring.Current() != nil || handler.lastFileEncrypted
+	if err == nil && fileInfo.Size() > 0 && (handler.lastFileFramed != handler.checksum || encrypted) {
+		m := handler.manifest.withNewIncr(handler.aofBasename)
+		err = writeManifest(handler.manifestPath(), m)
+		if err != nil {
+			return err
+		}
+		handler.manifest = m
+		filename = handler.aofPath(m.lastIncr())
+		fileInfo = nil
+	}
+	aofFile, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	writer := encrypt.NopCloser(aofFile)
+	if fileInfo == nil || fileInfo.Size() == 0 {
+		writer, err = handler.newFileWriter(aofFile)
+		if err != nil {
+			_ = aofFile.Close()
+			return err
+		}
+	}
+	handler.aofFile = aofFile
+	handler.aofWriter = writer
+	handler.currentDB = -1 // always select db before the first command written
+	handler.lastTimestamp = 0
+	return nil
+}
+
+// newFileWriter returns writer of a new file, which encrypts data if encryption is enabled.
+// It marks the file in checksum mode and writes the time of creating if timestamp is enabled.
+func (handler *Handler) newFileWriter(file io.Writer) (io.WriteCloser, error) {
+	writer, err := encrypt.WrapWriter(file, handler.keyring.Current())
+	if err != nil {
+		return nil, err
+	}
+	var header []byte
+	if handler.checksum {
+		header = appendRecord(header, nil, true)
+	}
+	if handler.timestamp {
+		header = append(header, makeTimestampLine(time.Now().Unix())...)
+	}
+	if len(header) > 0 {
+		_, err = writer.Write(header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return writer, nil
+}
+
+// statFiles returns size of base file and total size of all files in manifest
+func (handler *Handler) statFiles() (base int64, total int64) {
+	for _, info := range handler.manifest.files() {
+		fileInfo, err := os.Stat(handler.aofPath(info))
+		if err != nil {
+			continue
+		}
+		if info.fileType == baseFileType {
+			base = fileInfo.Size()
+		}
+		total += fileInfo.Size()
+	}
+	return base, total
+}
+
+func getFsyncPolicy() string {
+	switch policy := config.Properties.AppendFsync; policy {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+		return policy
+	case "":
+		return FsyncEverySec
+	default:
+		logger.Warn("unknown appendfsync policy " + policy + ", use everysec instead")
+		return FsyncEverySec
+	}
+}
+
 // AddAof send command to aof goroutine through channel
-func (handler *Handler) AddAof(dbIndex int, cmdLine CmdLine) {
+// In `always` policy, it blocks until the command has been synced to disk
+// and returns error if the command could not be written or synced
+func (handler *Handler) AddAof(dbIndex int, cmdLine CmdLine) error {
 	if config.Properties.AppendOnly && handler.aofChan != nil {
-		handler.aofChan <- &payload{
+		p := &payload{
 			cmdLine: cmdLine,
 			dbIndex: dbIndex,
 		}
+		if handler.aofFsync == FsyncAlways {
+			p.wg = &sync.WaitGroup{}
+			p.wg.Add(1)
+		}
+		handler.aofChan <- p
+		if p.wg != nil {
+			p.wg.Wait()
+			return p.err
+		}
+	}
+	return nil
+}
+
+// Failure returns the write or fsync error occurred in aof file.
+// Commands after a failure may not be persisted, so writes should be refused until restart
+func (handler *Handler) Failure() error {
+	if f, ok := handler.failure.Load().(*aofFailure); ok {
+		return f.err
+	}
+	return nil
+}
+
+// recordFailure keeps the first write or fsync error
+func (handler *Handler) recordFailure(err error) {
+	if handler.Failure() == nil {
+		handler.failure.Store(&aofFailure{err: err})
 	}
 }
 
 // handleAof listen aof channel and write into file
 func (handler *Handler) handleAof() {
 	// serialized execution
-	handler.currentDB = 0
 	for p := range handler.aofChan {
 		handler.pausingAof.RLock() // prevent other goroutines from pausing aof
-		if p.dbIndex != handler.currentDB {
-			// select db
-			data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))).ToBytes()
-			_, err := handler.aofFile.Write(data)
+		waiting := handler.writeAof(p, nil)
+		if handler.aofFsync == FsyncAlways {
+			// group commit: write queued commands and then fsync once for all of them
+		batch:
+			for i := 0; i < fsyncBatchSize; i++ {
+				select {
+				case next, ok := <-handler.aofChan:
+					if !ok {
+						break batch
+					}
+					waiting = handler.writeAof(next, waiting)
+				default:
+					break batch
+				}
+			}
+			err := handler.doFsync()
 			if err != nil {
-				logger.Warn(err)
-				continue // skip this command
+				logger.Error("fsync failed: " + err.Error())
+				for _, w := range waiting {
+					if w.err == nil {
+						w.err = err
+					}
+				}
 			}
-			handler.currentDB = p.dbIndex
-		}
-		data := protocol.MakeMultiBulkReply(p.cmdLine).ToBytes()
-		_, err := handler.aofFile.Write(data)
-		if err != nil {
-			logger.Warn(err)
 		}
 		handler.pausingAof.RUnlock()
+		for _, w := range waiting {
+			if w.err != nil {
+				// record failure before releasing waiters, so they always see it
+				handler.recordFailure(w.err)
+			}
+			w.wg.Done()
+		}
 	}
 	handler.aofFinished <- struct{}{}
 }
 
-// LoadAof read aof file
-func (handler *Handler) LoadAof(maxBytes int) {
+// writeAof writes a command into aof file, invoker should hold pausingAof.
+// It returns waiting list appended by p if p is waiting for fsync, p.err is set if write failed
+func (handler *Handler) writeAof(p *payload, waiting []*payload) []*payload {
+	if p.mark != nil {
+		// upgrade to write lock, commands after the mark are still in aofChan
+		handler.pausingAof.RUnlock()
+		handler.pausingAof.Lock()
+		incrSeq, err := handler.rotate()
+		handler.pausingAof.Unlock()
+		handler.pausingAof.RLock()
+		p.mark <- &rewriteMark{
+			incrSeq: incrSeq,
+			err:     err,
+		}
+		return waiting
+	}
+	if p.wg != nil {
+		waiting = append(waiting, p)
+	}
+	var data []byte
+	if handler.timestamp {
+		if now := time.Now().Unix(); now != handler.lastTimestamp {
+			data = append(data, makeTimestampLine(now)...)
+			handler.lastTimestamp = now
+		}
+	}
+	if p.dbIndex != handler.currentDB {
+		// select db
+		selectCmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))).ToBytes()
+		data = appendRecord(data, selectCmd, handler.checksum)
+	}
+	data = appendRecord(data, protocol.MakeMultiBulkReply(p.cmdLine).ToBytes(), handler.checksum)
+	n, err := handler.aofWriter.Write(data)
+	atomic.AddInt64(&handler.currentSize, int64(n))
+	if err != nil {
+		logger.Warn(err)
+		p.err = err
+		if p.wg == nil {
+			// nobody waits for the result in `everysec` and `no` policy
+			handler.recordFailure(err)
+		}
+		handler.currentDB = -1 // select db again in case of partial written
+		handler.lastTimestamp = 0
+	} else {
+		handler.currentDB = p.dbIndex
+	}
+	atomic.AddInt64(&handler.written, 1)
+	return waiting
+}
+
+// doFsync flushes aof file to disk and records statistics, invoker should hold pausingAof
+func (handler *Handler) doFsync() error {
+	written := atomic.LoadInt64(&handler.written)
+	start := time.Now()
+	err := handler.aofFile.Sync()
+	if err != nil {
+		return err
+	}
+	latency := int64(time.Since(start))
+	atomic.StoreInt64(&handler.synced, written)
+	atomic.StoreInt64(&handler.lastFsync, time.Now().UnixNano())
+	atomic.AddInt64(&handler.fsyncCount, 1)
+	atomic.AddInt64(&handler.fsyncLatencyTotal, latency)
+	atomic.StoreInt64(&handler.lastFsyncLatency, latency)
+	if latency > atomic.LoadInt64(&handler.maxFsyncLatency) {
+		atomic.StoreInt64(&handler.maxFsyncLatency, latency)
+	}
+	return nil
+}
+
+// cron does fsync every second in `everysec` policy and checks whether to rewrite automatically
+func (handler *Handler) cron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if handler.aofFsync == FsyncEverySec {
+				handler.fsyncIfNeeded()
+			}
+			handler.checkAutoRewrite()
+		case <-handler.stopCron:
+			return
+		}
+	}
+}
+
+func (handler *Handler) fsyncIfNeeded() {
+	if atomic.LoadInt64(&handler.written) == atomic.LoadInt64(&handler.synced) {
+		return
+	}
+	handler.pausingAof.RLock()
+	err := handler.doFsync()
+	handler.pausingAof.RUnlock()
+	if err != nil {
+		logger.Error("fsync failed: " + err.Error())
+		handler.recordFailure(err)
+	}
+}
+
+// GetSize returns current size of aof file and the size after latest rewrite
+func (handler *Handler) GetSize() (current int64, base int64) {
+	return atomic.LoadInt64(&handler.currentSize), atomic.LoadInt64(&handler.baseSize)
+}
+
+// GetFsyncPolicy returns the appendfsync policy in use
+func (handler *Handler) GetFsyncPolicy() string {
+	return handler.aofFsync
+}
+
+// GetFsyncStats returns latency and lag of fsync
+func (handler *Handler) GetFsyncStats() *FsyncStats {
+	stats := &FsyncStats{
+		Count:       atomic.LoadInt64(&handler.fsyncCount),
+		LastLatency: atomic.LoadInt64(&handler.lastFsyncLatency),
+		MaxLatency:  atomic.LoadInt64(&handler.maxFsyncLatency),
+	}
+	if stats.Count > 0 {
+		stats.AvgLatency = atomic.LoadInt64(&handler.fsyncLatencyTotal) / stats.Count
+	}
+	if atomic.LoadInt64(&handler.written) != atomic.LoadInt64(&handler.synced) {
+		stats.Lag = time.Now().UnixNano() - atomic.LoadInt64(&handler.lastFsync)
+	}
+	return stats
+}
+
+// LoadAof reads all files in manifest.
+// An incomplete command at the end of the last file is truncated if aof-load-truncated is enabled,
+// and the corrupted commands are skipped if aof-load-corrupted is enabled, otherwise it returns error.
+func (handler *Handler) LoadAof() error {
 	// delete aofChan to prevent write again
 	aofChan := handler.aofChan
 	handler.aofChan = nil
@@ -105,56 +460,138 @@ func (handler *Handler) LoadAof(maxBytes int) {
 		handler.aofChan = aofChan
 	}(aofChan)
 
-	file, err := os.Open(handler.aofFilename)
+	files := handler.manifest.files()
+	for _, info := range files {
+		if fileInfo, err := os.Stat(handler.aofPath(info)); err == nil {
+			handler.progress.AddTotal(fileInfo.Size())
+		}
+	}
+	a := handler.newApplier()
+	defer a.close()
+	for i, info := range files {
+		err := handler.loadAofFile(handler.aofPath(info), i == len(files)-1, a)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (handler *Handler) loadAofFile(filename string, isLast bool, a *applier) error {
+	file, err := os.Open(filename)
 	if err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			return
+		if os.IsNotExist(err) {
+			logger.Warn("aof file " + filename + " in manifest not found")
+			return nil
 		}
-		logger.Warn(err)
-		return
+		return err
 	}
 	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
 
-	var reader io.Reader
-	if maxBytes > 0 {
-		reader = io.LimitReader(file, int64(maxBytes))
-	} else {
-		reader = file
-	}
-	ch := parser.ParseStream(reader)
-	fakeConn := &connection.FakeConn{} // only used for save dbIndex
-	for p := range ch {
-		if p.Err != nil {
-			if p.Err == io.EOF {
-				break
-			}
-			logger.Error("parse error: " + p.Err.Error())
-			continue
+	reader, err := newFileReader(handler.progress.Reader(file), handler.keyring)
+	if err != nil {
+		return fmt.Errorf("read aof file %s failed: %v", filename, err)
+	}
+	if isRDBFile(filename) {
+		err = readRDB(reader, handler.db.LoadRDB)
+		if err != nil {
+			return fmt.Errorf("load rdb base file %s failed: %v", filename, err)
 		}
-		if p.Data == nil {
-			logger.Error("empty payload")
-			continue
+		return nil
+	}
+	policy := &loadPolicy{
+		skipCorrupted:        config.Properties.AofLoadCorrupted,
+		skipChecksumMismatch: getChecksumMismatchPolicy() == ChecksumMismatchSkip,
+	}
+	a.conn.SelectDB(0) // each file starts from db 0
+	result := scanCommands(reader, policy, a.apply)
+	if result.err != nil {
+		if !config.Properties.AofLoadCorrupted {
+			return fmt.Errorf("bad file format reading the append only file %s: %v, "+
+				"make a backup of it and then use godis-check-aof --fix to fix it", filename, result.err)
 		}
-		r, ok := p.Data.(*protocol.MultiBulkReply)
-		if !ok {
-			logger.Error("require multi bulk protocol")
-			continue
+		logger.Warn(fmt.Sprintf("corrupted commands in %s are skipped: %v", filename, result.err))
+	}
+	if result.checksumErr != nil {
+		if !policy.skipChecksumMismatch {
+			return fmt.Errorf("bad record in the append only file %s: %v, "+
+				"make a backup of it and then use godis-check-aof --fix to fix it", filename, result.checksumErr)
+		}
+		logger.Warn(fmt.Sprintf("%d damaged records in %s are skipped", result.skipped, filename))
+	}
+	if isLast {
+		handler.lastFileFramed = result.framed
+		handler.lastFileEncrypted = reader.decrypter != nil
+	}
+	validSize, err := reader.validEnd(result.validSize)
+	if err != nil {
+		return fmt.Errorf("bad file format reading the append only file %s: %v", filename, err)
+	}
+	if isLast && validSize == fileInfo.Size() && reader.missingFinal() {
+		// the last file is not closed after crash, it ends like a plain aof.
+		// Append the final chunk, since it will not be the last one after a new incremental file started
+		logger.Info("append the final chunk to encrypted aof file " + filename + " which was not closed")
+		err = TruncateFile(filename, validSize, handler.keyring)
+		if err != nil {
+			return fmt.Errorf("close encrypted aof file %s failed: %v", filename, err)
 		}
-		ret := handler.db.Exec(fakeConn, r.Args)
-		if protocol.IsErrorReply(ret) {
-			logger.Error("exec err", err)
+	} else if validSize < fileInfo.Size() || reader.truncated() {
+		if !isLast || !config.Properties.AofLoadTruncated {
+			return fmt.Errorf("unexpected end of file %s, use godis-check-aof --fix to fix it", filename)
+		}
+		logger.Warn(fmt.Sprintf("!!! Warning: short read while loading the AOF file %s !!! "+
+			"AOF is truncated from %d bytes to %d bytes because aof-load-truncated is enabled",
+			filename, fileInfo.Size(), validSize))
+		err = TruncateFile(filename, validSize, handler.keyring)
+		if err != nil {
+			return fmt.Errorf("truncate aof file %s failed: %v", filename, err)
 		}
 	}
+	return nil
 }
 
-// Close gracefully stops aof persistence procedure
-func (handler *Handler) Close() {
-	if handler.aofFile != nil {
-		close(handler.aofChan)
-		<-handler.aofFinished // wait for aof finished
-		err := handler.aofFile.Close()
-		if err != nil {
-			logger.Warn(err)
+// Fsync flushes aof file to disk immediately
+func (handler *Handler) Fsync() error {
+	if handler.aofFile == nil {
+		return nil
+	}
+	handler.pausingAof.RLock()
+	defer handler.pausingAof.RUnlock()
+	return handler.doFsync()
+}
+
+// Close gracefully stops aof persistence procedure, it returns error if aof file could not be flushed to disk
+func (handler *Handler) Close() error {
+	if handler.aofFile == nil {
+		return nil
+	}
+	close(handler.aofChan)
+	<-handler.aofFinished // wait for aof finished
+	if handler.stopCron != nil {
+		close(handler.stopCron)
+	}
+	handler.pausingAof.Lock()
+	defer handler.pausingAof.Unlock()
+	err := handler.aofWriter.Close()
+	if err != nil {
+		logger.Warn(err)
+	}
+	if fsyncErr := handler.doFsync(); fsyncErr != nil {
+		logger.Warn(fsyncErr)
+		if err == nil {
+			err = fsyncErr
+		}
+	}
+	closeErr := handler.aofFile.Close()
+	if closeErr != nil {
+		logger.Warn(closeErr)
+		if err == nil {
+			err = closeErr
 		}
 	}
+	return err
 }
@@ -0,0 +1,86 @@
+package aof
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/encrypt"
+	"github.com/hdt3213/godis/lib/utils"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAddAofFailure(t *testing.T) {
+	config.Properties = &config.ServerProperties{AppendOnly: true}
+	file, err := ioutil.TempFile("", "*.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	handler := &Handler{
+		aofChan:     make(chan *payload, aofQueueSize),
+		aofFile:     file,
+		aofWriter:   encrypt.NopCloser(file),
+		aofFsync:    FsyncAlways,
+		aofFinished: make(chan struct{}),
+	}
+	go handler.handleAof()
+	defer func() {
+		close(handler.aofChan)
+		<-handler.aofFinished
+	}()
+
+	if err = handler.AddAof(0, utils.ToCmdLine("SET", "a", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if handler.Failure() != nil {
+		t.Fatal("unexpected failure")
+	}
+	// writing to a closed file fails
+	_ = file.Close()
+	if err = handler.AddAof(0, utils.ToCmdLine("SET", "b", "b")); err == nil {
+		t.Error("expect error when write failed")
+	}
+	if handler.Failure() == nil {
+		t.Error("expect failure recorded")
+	}
+}
+
+func TestFsyncEverySecFailure(t *testing.T) {
+	config.Properties = &config.ServerProperties{AppendOnly: true}
+	file, err := ioutil.TempFile("", "*.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	handler := &Handler{
+		aofChan:     make(chan *payload, aofQueueSize),
+		aofFile:     file,
+		aofWriter:   encrypt.NopCloser(file),
+		aofFsync:    FsyncEverySec,
+		aofFinished: make(chan struct{}),
+	}
+	go handler.handleAof()
+	defer func() {
+		close(handler.aofChan)
+		<-handler.aofFinished
+	}()
+
+	if err = handler.AddAof(0, utils.ToCmdLine("SET", "a", "a")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && atomic.LoadInt64(&handler.written) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// fsync of a closed file fails
+	_ = file.Close()
+	handler.fsyncIfNeeded()
+	if handler.Failure() == nil {
+		t.Error("expect fsync failure recorded")
+	}
+}
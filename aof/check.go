@@ -0,0 +1,360 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/lib/encrypt"
+	"github.com/hdt3213/godis/lib/logger"
+	rdbDecoder "github.com/hdt3213/godis/lib/rdb"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/rdb/core"
+	rdb "github.com/hdt3213/rdb/parser"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrTruncated means aof file ends with an incomplete command
+var ErrTruncated = errors.New("unexpected end of file")
+
+// CheckResult is the result of checking an aof file
+type CheckResult struct {
+	Size int64
+	// ValidSize is the end offset of the last valid command, the file could be fixed by truncating to it
+	ValidSize int64
+	// Commands is the number of valid commands, it is 0 for rdb base file
+	Commands int
+	// Err is the first problem found in file, nil if the file is valid
+	Err error
+}
+
+// loadPolicy decides how to deal with damaged aof and where to stop
+type loadPolicy struct {
+	skipCorrupted        bool // skip commands in bad format
+	skipChecksumMismatch bool // skip records not matching their checksums
+	// stop before the first timestamp annotation later than it, 0 means no limit
+	untilTimestamp int64
+	// stop before the first command or record ending after it, 0 means no limit
+	untilOffset int64
+}
+
+// scanResult is the result of reading commands from aof
+type scanResult struct {
+	validSize   int64 // end of the last valid command or record, relative to the beginning of reader
+	commands    int
+	err         error // the first format error
+	checksumErr error // the first checksum mismatch
+	skipped     int   // number of skipped records
+	framed      bool  // the file is in checksum mode at the end
+	stopped     bool  // stopped by untilTimestamp or untilOffset, validSize is the stop point
+}
+
+// scanCommands reads commands from reader until EOF and calls cb for each valid command.
+// In checksum mode, commands are held until their record was verified.
+// It stops at the first damaged command or record unless the policy allows to skip it.
+func scanCommands(reader io.Reader, policy *loadPolicy, cb func(cmdLine CmdLine)) *scanResult {
+	result := &scanResult{}
+	ch := parser.ParseStream(reader)
+	defer func() {
+		// parser stops at EOF only
+		for range ch {
+		}
+	}()
+	var pending []CmdLine // commands of current record
+	var crc uint32
+	for p := range ch {
+		exceeded := policy.untilOffset > 0 && p.Offset > policy.untilOffset
+		if p.Err == io.EOF || p.Err == io.ErrUnexpectedEOF {
+			break
+		}
+		err := p.Err
+		var r *protocol.MultiBulkReply
+		if err == nil {
+			var ok bool
+			r, ok = p.Data.(*protocol.MultiBulkReply)
+			if !ok {
+				err = errors.New("require multi bulk protocol")
+			}
+		}
+		if err != nil {
+			if result.err == nil {
+				result.err = fmt.Errorf("%v (offset %d)", err, result.validSize)
+			}
+			if !policy.skipCorrupted {
+				break
+			}
+			pending = nil
+			crc = 0
+			result.skipped++
+			continue
+		}
+		if annotation, ok := parseAnnotation(r.Args); ok {
+			if len(pending) == 0 {
+				// annotations between records
+				timestamp, ok := parseTimestamp(annotation)
+				if exceeded || (ok && policy.untilTimestamp > 0 && timestamp > policy.untilTimestamp) {
+					result.stopped = true
+					break
+				}
+			}
+			expected, ok := parseChecksum(annotation)
+			if !ok {
+				// unknown annotations are ignored
+				if len(pending) == 0 {
+					result.validSize = p.Offset
+				}
+				continue
+			}
+			if exceeded {
+				result.stopped = true
+				break
+			}
+			if expected != crc {
+				err = fmt.Errorf("checksum mismatch in record at offset %d", result.validSize)
+				if result.checksumErr == nil {
+					result.checksumErr = err
+				}
+				if !policy.skipChecksumMismatch {
+					break
+				}
+				logger.Warn(err.Error() + ", skipped")
+				result.skipped++
+			} else {
+				for _, cmdLine := range pending {
+					if cb != nil {
+						cb(cmdLine)
+					}
+				}
+				result.commands += len(pending)
+			}
+			result.validSize = p.Offset
+			result.framed = true
+			pending = nil
+			crc = 0
+			continue
+		}
+		if result.framed {
+			pending = append(pending, r.Args)
+			crc = crc32.Update(crc, crcTable, r.ToBytes())
+			continue
+		}
+		if exceeded {
+			result.stopped = true
+			break
+		}
+		result.validSize = p.Offset
+		result.commands++
+		if cb != nil {
+			cb(r.Args)
+		}
+	}
+	return result
+}
+
+// countingReader counts bytes read from reader
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// fileReader reads plain data of an aof or rdb file, it decrypts the file if it is encrypted
+type fileReader struct {
+	*bufio.Reader
+	counter *countingReader
+	// nil if file is not encrypted
+	decrypter *encrypt.Reader
+}
+
+func newFileReader(file io.Reader, keyring *encrypt.Keyring) (*fileReader, error) {
+	plain, err := encrypt.WrapReader(bufio.NewReader(file), keyring)
+	if err != nil {
+		return nil, err
+	}
+	reader := &fileReader{}
+	reader.decrypter, _ = plain.(*encrypt.Reader)
+	reader.counter = &countingReader{reader: plain}
+	reader.Reader = bufio.NewReader(reader.counter)
+	return reader, nil
+}
+
+// offset returns the number of plain bytes consumed
+func (r *fileReader) offset() int64 {
+	return r.counter.n - int64(r.Buffered())
+}
+
+// validEnd returns the offset in file which the file could be truncated to,
+// validSize is the end of valid commands in plain data
+func (r *fileReader) validEnd(validSize int64) (int64, error) {
+	if r.decrypter == nil {
+		return validSize, nil
+	}
+	// a record is never split into chunks, so only incomplete chunks could be truncated
+	if validSize < r.counter.n {
+		return 0, fmt.Errorf("incomplete command in encrypted chunk (offset %d)", validSize)
+	}
+	return r.decrypter.ValidOffset(), nil
+}
+
+// truncated tells whether the file ends without the final chunk of encryption
+func (r *fileReader) truncated() bool {
+	return r.decrypter != nil && r.decrypter.Truncated()
+}
+
+// missingFinal tells whether the encrypted file ends at chunk boundary without the final chunk
+func (r *fileReader) missingFinal() bool {
+	return r.decrypter != nil && r.decrypter.MissingFinal()
+}
+
+// isRDBFile tells whether the file is a base file in rdb format, which is written by rewrite with aof-use-rdb-preamble
+func isRDBFile(filename string) bool {
+	return strings.HasSuffix(filename, ".rdb")
+}
+
+// readRDB loads the whole reader as a rdb file, nothing is allowed after its checksum
+func readRDB(reader *fileReader, load func(decoder *core.Decoder) error) error {
+	// rdb decoder reuses bufReader rather than wrapping another one,
+	// so the checksum will not be consumed by rdb decoder
+	err := load(rdbDecoder.NewDecoder(reader.Reader, true))
+	if err != nil {
+		return err
+	}
+	_, err = reader.Discard(8)
+	if err != nil {
+		return fmt.Errorf("read rdb checksum failed: %v", err)
+	}
+	if _, err = reader.Peek(1); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after rdb checksum")
+		}
+		return err
+	}
+	if reader.truncated() {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// CheckFile checks whether an aof file or rdb base file is corrupted, keyring is used to decrypt encrypted file.
+// It returns error if the file cannot be read or the rdb base file is corrupted, which could not be fixed by truncating.
+func CheckFile(filename string, keyring *encrypt.Keyring) (*CheckResult, error) {
+	result, _, err := checkFile(filename, keyring, &loadPolicy{})
+	return result, err
+}
+
+// checkFile scans an aof file with policy, scanned.stopped tells whether it stopped at the point in policy
+func checkFile(filename string, keyring *encrypt.Keyring, policy *loadPolicy) (*CheckResult, *scanResult, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := newFileReader(file, keyring)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isRDBFile(filename) {
+		if policy.untilOffset > 0 || policy.untilTimestamp > 0 {
+			return nil, nil, errors.New("point-in-time restore is not supported for rdb base file")
+		}
+		err = readRDB(reader, func(decoder *core.Decoder) error {
+			return decoder.Parse(func(o rdb.RedisObject) bool {
+				return true
+			})
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("rdb base file is corrupted: %v", err)
+		}
+		return &CheckResult{Size: fileInfo.Size(), ValidSize: fileInfo.Size()}, &scanResult{}, nil
+	}
+	if (policy.untilOffset > 0 || policy.untilTimestamp > 0) && reader.decrypter != nil {
+		return nil, nil, errors.New("point-in-time restore is not supported for encrypted aof")
+	}
+	scanned := scanCommands(reader, policy, nil)
+	result := &CheckResult{
+		Size:     fileInfo.Size(),
+		Commands: scanned.commands,
+		Err:      scanned.err,
+	}
+	if result.Err == nil {
+		result.Err = scanned.checksumErr
+	}
+	result.ValidSize, err = reader.validEnd(scanned.validSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.Err == nil && !scanned.stopped && (result.ValidSize < result.Size || reader.truncated()) {
+		result.Err = ErrTruncated
+	}
+	return result, scanned, nil
+}
+
+// TruncateFile truncates an aof file to size, which should be the ValidSize of CheckResult.
+// An encrypted file gets its final chunk again, so that it could be loaded as a complete file.
+func TruncateFile(filename string, size int64, keyring *encrypt.Keyring) error {
+	err := os.Truncate(filename, size)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	plain, err := encrypt.WrapReader(bufio.NewReader(file), keyring)
+	if err != nil {
+		return err
+	}
+	decrypter, ok := plain.(*encrypt.Reader)
+	if !ok {
+		return nil
+	}
+	_, err = io.Copy(ioutil.Discard, decrypter)
+	if err == nil {
+		// the final chunk is kept
+		return nil
+	}
+	if err != io.ErrUnexpectedEOF || decrypter.ValidOffset() != size {
+		return fmt.Errorf("%s could not be truncated to %d: %v", filename, size, err)
+	}
+	err = decrypter.WriteFinal(file)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// ManifestFiles returns paths of all files listed in manifest in loading order
+func ManifestFiles(manifestFilename string) ([]string, error) {
+	m, err := readManifest(manifestFilename)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, errors.New("manifest not found: " + manifestFilename)
+	}
+	dir := filepath.Dir(manifestFilename)
+	var files []string
+	for _, info := range m.files() {
+		files = append(files, filepath.Join(dir, info.name))
+	}
+	return files, nil
+}
@@ -0,0 +1,198 @@
+package aof
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempAof(t *testing.T, data []byte) string {
+	file, err := ioutil.TempFile("", "*.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+	return file.Name()
+}
+
+func TestCheckFile(t *testing.T) {
+	cmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "a")).ToBytes()
+	valid := append(append([]byte{}, cmd...), cmd...)
+	truncated := append(append([]byte{}, valid...), cmd[:len(cmd)-3]...)
+	corrupted := append(append(append([]byte{}, cmd...), []byte("$3\r\nabc\r\n")...), cmd...)
+
+	testCases := []struct {
+		name      string
+		data      []byte
+		validSize int
+		commands  int
+		valid     bool
+	}{
+		{"valid", valid, len(valid), 2, true},
+		{"truncated", truncated, len(valid), 2, false},
+		{"corrupted", corrupted, len(cmd), 1, false},
+	}
+	for _, tc := range testCases {
+		filename := writeTempAof(t, tc.data)
+		result, err := CheckFile(filename, nil)
+		_ = os.Remove(filename)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if result.ValidSize != int64(tc.validSize) || result.Commands != tc.commands {
+			t.Errorf("%s: expect %d bytes %d commands valid, actually %d bytes %d commands",
+				tc.name, tc.validSize, tc.commands, result.ValidSize, result.Commands)
+		}
+		if (result.Err == nil) != tc.valid {
+			t.Errorf("%s: unexpected result %v", tc.name, result.Err)
+		}
+	}
+}
+
+func TestCheckFramedFile(t *testing.T) {
+	cmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "a")).ToBytes()
+	record := append(append([]byte{}, cmd...), makeChecksumLine(crc32.Checksum(cmd, crcTable))...)
+	header := makeChecksumLine(0)
+	valid := append(append(append([]byte{}, header...), record...), record...)
+	truncated := append(append([]byte{}, valid...), cmd...) // record without checksum
+	mismatched := append(append([]byte{}, valid...), record...)
+	mismatched[len(mismatched)-len(record)+len(cmd)-3] = 'b' // modify value of the last record
+
+	testCases := []struct {
+		name      string
+		data      []byte
+		validSize int
+		commands  int
+		valid     bool
+	}{
+		{"valid", valid, len(valid), 2, true},
+		{"truncated", truncated, len(valid), 2, false},
+		{"mismatched", mismatched, len(valid), 2, false},
+	}
+	for _, tc := range testCases {
+		filename := writeTempAof(t, tc.data)
+		result, err := CheckFile(filename, nil)
+		_ = os.Remove(filename)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if result.ValidSize != int64(tc.validSize) || result.Commands != tc.commands {
+			t.Errorf("%s: expect %d bytes %d commands valid, actually %d bytes %d commands",
+				tc.name, tc.validSize, tc.commands, result.ValidSize, result.Commands)
+		}
+		if (result.Err == nil) != tc.valid {
+			t.Errorf("%s: unexpected result %v", tc.name, result.Err)
+		}
+	}
+}
+
+func TestFindTruncatePoint(t *testing.T) {
+	cmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "a")).ToBytes()
+	var data []byte
+	for i := int64(1); i <= 3; i++ {
+		data = append(data, makeTimestampLine(i*100)...)
+		data = append(data, cmd...)
+	}
+	filename := writeTempAof(t, data)
+	defer func() {
+		_ = os.Remove(filename)
+	}()
+	stop := 2 * (len(makeTimestampLine(100)) + len(cmd))
+	point, err := FindTimestamp(filename, 250, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point.Offset != int64(stop) || point.Commands != 2 {
+		t.Errorf("expect truncating to %d, actually %d with %d commands", stop, point.Offset, point.Commands)
+	}
+	// the timestamp before the dropped command is kept
+	stop2 := stop + len(makeTimestampLine(300))
+	point, err = FindOffset(filename, int64(stop+len(cmd)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point.Offset != int64(stop2) {
+		t.Errorf("expect truncating to %d, actually %d", stop2, point.Offset)
+	}
+	_, err = FindTimestamp(filename, 300, nil)
+	if err != ErrNoTruncatePoint {
+		t.Errorf("expect ErrNoTruncatePoint, actually %v", err)
+	}
+	_, err = FindTimestamp(filename, 50, nil)
+	if err != ErrBeforeRewrite {
+		t.Errorf("expect ErrBeforeRewrite, actually %v", err)
+	}
+	result, err := CheckFile(filename, nil)
+	if err != nil || result.Err != nil || result.Commands != 3 {
+		t.Errorf("timestamps should be ignored, actually %v %v", err, result)
+	}
+}
+
+func TestTruncateManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	cmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "a")).ToBytes()
+	m := (&manifest{}).withNewBase("a.aof", ".aof", 0).withNewIncr("a.aof").withNewIncr("a.aof").withNewIncr("a.aof")
+	for i, info := range m.files() {
+		data := append(makeTimestampLine(int64(i+1)*100), cmd...)
+		data = append(data, append(makeTimestampLine(int64(i+1)*100+50), cmd...)...)
+		err = ioutil.WriteFile(filepath.Join(dir, info.name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifestFile := filepath.Join(dir, "a.aof"+manifestSuffix)
+	err = writeManifest(manifestFile, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = FindTimestamp(manifestFile, 120, nil)
+	if err != ErrBeforeRewrite {
+		t.Errorf("expect ErrBeforeRewrite in base, actually %v", err)
+	}
+	_, err = FindTimestamp(manifestFile, 180, nil)
+	if err != ErrBeforeRewrite {
+		t.Errorf("expect ErrBeforeRewrite in the first incr, actually %v", err)
+	}
+	point, err := FindTimestamp(manifestFile, 320, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point.File != filepath.Join(dir, m.incrs[1].name) || point.Commands != 1 || len(point.Dropped) != 1 {
+		t.Errorf("wrong truncate point: %+v", point)
+	}
+	err = point.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := readManifest(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m2.incrs) != 2 {
+		t.Errorf("wrong manifest: %s", m2.marshal())
+	}
+	if _, err = os.Stat(filepath.Join(dir, m.incrs[2].name)); !os.IsNotExist(err) {
+		t.Error("dropped file is not deleted")
+	}
+	info, err := os.Stat(point.File)
+	if err != nil || info.Size() != point.Offset {
+		t.Errorf("file is not truncated: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package aof
+
+import (
+	"fmt"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/logger"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+ * In checksum mode, each record of aof is followed by an annotation line such as `#CRC:1a2b3c4d`.
+ * A record is one or several commands, the checksum is CRC-32C of their RESP encoding.
+ * A file in checksum mode starts with an annotation of empty record, so that loader knows all the following
+ * commands should be verified before executed. Plain aof files have no annotations.
+ */
+
+const (
+	annotationPrefix = "#"
+	checksumPrefix   = "#CRC:"
+
+	// ChecksumMismatchStop refuses to load aof if a record does not match its checksum
+	ChecksumMismatchStop = "stop"
+	// ChecksumMismatchSkip skips records not matching their checksums
+	ChecksumMismatchSkip = "skip"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func makeChecksumLine(crc uint32) []byte {
+	return []byte(fmt.Sprintf("%s%08x\r\n", checksumPrefix, crc))
+}
+
+// appendRecord appends record followed by its checksum annotation if checksum is enabled
+func appendRecord(buf []byte, record []byte, checksum bool) []byte {
+	buf = append(buf, record...)
+	if checksum {
+		buf = append(buf, makeChecksumLine(crc32.Checksum(record, crcTable))...)
+	}
+	return buf
+}
+
+// writeRecord writes record followed by its checksum annotation if checksum is enabled
+func writeRecord(writer io.Writer, record []byte, checksum bool) (int, error) {
+	return writer.Write(appendRecord(nil, record, checksum))
+}
+
+// parseAnnotation returns the annotation line if cmdLine is an annotation
+func parseAnnotation(cmdLine CmdLine) (string, bool) {
+	if len(cmdLine) != 1 || !strings.HasPrefix(string(cmdLine[0]), annotationPrefix) {
+		return "", false
+	}
+	return string(cmdLine[0]), true
+}
+
+// parseChecksum returns the checksum in annotation
+func parseChecksum(annotation string) (uint32, bool) {
+	if !strings.HasPrefix(annotation, checksumPrefix) {
+		return 0, false
+	}
+	crc, err := strconv.ParseUint(annotation[len(checksumPrefix):], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(crc), true
+}
+
+func getChecksumMismatchPolicy() string {
+	switch policy := config.Properties.AofChecksumMismatch; policy {
+	case ChecksumMismatchStop, ChecksumMismatchSkip:
+		return policy
+	case "":
+		return ChecksumMismatchStop
+	default:
+		logger.Warn("unknown aof-checksum-mismatch policy " + policy + ", use stop instead")
+		return ChecksumMismatchStop
+	}
+}
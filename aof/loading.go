@@ -0,0 +1,111 @@
+package aof
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/sync/partition"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// loadingQueueSize is the number of commands queued for each db while loading
+const loadingQueueSize = 1 << 10
+
+// LoadingProgress records how many bytes of aof or rdb files have been loaded, it is accessed atomically
+type LoadingProgress struct {
+	total  int64
+	loaded int64
+}
+
+// AddTotal adds size of files to be loaded
+func (p *LoadingProgress) AddTotal(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.total, n)
+	}
+}
+
+// Get returns loaded bytes and total bytes
+func (p *LoadingProgress) Get() (loaded int64, total int64) {
+	return atomic.LoadInt64(&p.loaded), atomic.LoadInt64(&p.total)
+}
+
+// Reader returns a reader which records bytes read from reader as loaded
+func (p *LoadingProgress) Reader(reader io.Reader) io.Reader {
+	if p == nil {
+		return reader
+	}
+	return &progressReader{
+		reader:   reader,
+		progress: p,
+	}
+}
+
+type progressReader struct {
+	reader   io.Reader
+	progress *LoadingProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.progress.loaded, int64(n))
+	return n, err
+}
+
+// applier replays commands read from aof, commands of different db are executed in parallel
+type applier struct {
+	handler  *Handler
+	executor *partition.Executor
+	// tracks SELECT in aof
+	conn *connection.FakeConn
+	// conns[i] is used by the worker of db i only
+	conns []*connection.FakeConn
+}
+
+func (handler *Handler) newApplier() *applier {
+	databases := config.Properties.Databases
+	a := &applier{
+		handler:  handler,
+		executor: partition.NewExecutor(databases, loadingQueueSize),
+		conn:     &connection.FakeConn{},
+		conns:    make([]*connection.FakeConn, databases),
+	}
+	for i := range a.conns {
+		a.conns[i] = &connection.FakeConn{}
+		a.conns[i].SelectDB(i)
+	}
+	return a
+}
+
+func (a *applier) exec(conn *connection.FakeConn, cmdLine CmdLine) {
+	ret := a.handler.db.Exec(conn, cmdLine)
+	if protocol.IsErrorReply(ret) {
+		logger.Error("exec err", string(ret.ToBytes()))
+	}
+}
+
+// apply executes cmdLine in the worker of current db
+func (a *applier) apply(cmdLine CmdLine) {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if cmdName == "select" {
+		a.exec(a.conn, cmdLine)
+		return
+	}
+	dbIndex := a.conn.GetDBIndex()
+	if cmdName == "flushall" || dbIndex >= len(a.conns) {
+		// commands which involve multiple db are executed after commands before them finished
+		a.executor.Wait()
+		a.exec(a.conn, cmdLine)
+		return
+	}
+	a.executor.Submit(dbIndex, func() {
+		a.exec(a.conns[dbIndex], cmdLine)
+	})
+}
+
+// close waits for all commands finished
+func (a *applier) close() {
+	a.executor.Close()
+}
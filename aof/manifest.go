@@ -0,0 +1,270 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Aof consists of a base file and several incremental files in appenddirname, which are listed in manifest file.
+ * Base file is the result of latest rewrite, it could be in aof or rdb format.
+ * Incremental files hold commands executed after base file was created, only the last one is written.
+ * Rewrite starts a new incremental file and replaces base and old incremental files by updating manifest atomically.
+ *
+ * Manifest is compatible with redis 7, for example:
+ * file appendonly.aof.1.base.rdb seq 1 type b
+ * file appendonly.aof.1.incr.aof seq 1 type i
+ */
+
+const (
+	defaultAofDirname  = "appendonlydir"
+	defaultAofFilename = "appendonly.aof"
+
+	manifestSuffix = ".manifest"
+	baseFileType   = "b"
+	incrFileType   = "i"
+)
+
+// aofInfo describes a file in manifest
+type aofInfo struct {
+	name     string
+	seq      int64
+	fileType string
+}
+
+// manifest lists files of aof in loading order, it should not be modified after written
+type manifest struct {
+	base  *aofInfo
+	incrs []*aofInfo
+}
+
+func getAofDirname() string {
+	if config.Properties.AppendDirname == "" {
+		return defaultAofDirname
+	}
+	return config.Properties.AppendDirname
+}
+
+func getAofFilename() string {
+	if config.Properties.AppendFilename == "" {
+		return defaultAofFilename
+	}
+	return config.Properties.AppendFilename
+}
+
+// files returns all files in manifest in loading order
+func (m *manifest) files() []*aofInfo {
+	var files []*aofInfo
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *manifest) lastIncr() *aofInfo {
+	if len(m.incrs) == 0 {
+		return nil
+	}
+	return m.incrs[len(m.incrs)-1]
+}
+
+// withNewIncr returns a new manifest with a new incremental file appended
+func (m *manifest) withNewIncr(basename string) *manifest {
+	seq := int64(1)
+	if last := m.lastIncr(); last != nil {
+		seq = last.seq + 1
+	}
+	incrs := make([]*aofInfo, len(m.incrs), len(m.incrs)+1)
+	copy(incrs, m.incrs)
+	incrs = append(incrs, &aofInfo{
+		name:     basename + "." + strconv.FormatInt(seq, 10) + ".incr.aof",
+		seq:      seq,
+		fileType: incrFileType,
+	})
+	return &manifest{
+		base:  m.base,
+		incrs: incrs,
+	}
+}
+
+// withNewBase returns a new manifest with a new base file, incremental files before minIncrSeq are dropped
+func (m *manifest) withNewBase(basename string, ext string, minIncrSeq int64) *manifest {
+	seq := int64(1)
+	if m.base != nil {
+		seq = m.base.seq + 1
+	}
+	result := &manifest{
+		base: &aofInfo{
+			name:     basename + "." + strconv.FormatInt(seq, 10) + ".base" + ext,
+			seq:      seq,
+			fileType: baseFileType,
+		},
+	}
+	for _, info := range m.incrs {
+		if info.seq >= minIncrSeq {
+			result.incrs = append(result.incrs, info)
+		}
+	}
+	return result
+}
+
+func (m *manifest) marshal() []byte {
+	buf := &bytes.Buffer{}
+	for _, info := range m.files() {
+		buf.WriteString(fmt.Sprintf("file %s seq %d type %s\n", info.name, info.seq, info.fileType))
+	}
+	return buf.Bytes()
+}
+
+func parseManifest(data []byte) (*manifest, error) {
+	m := &manifest{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, errors.New("invalid manifest line: " + line)
+		}
+		info := &aofInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, errors.New("invalid seq in manifest line: " + line)
+				}
+				info.seq = seq
+			case "type":
+				info.fileType = fields[i+1]
+			}
+		}
+		if info.name == "" || filepath.Base(info.name) != info.name {
+			return nil, errors.New("invalid file name in manifest line: " + line)
+		}
+		switch info.fileType {
+		case baseFileType:
+			if m.base != nil {
+				return nil, errors.New("duplicated base file in manifest")
+			}
+			m.base = info
+		case incrFileType:
+			if last := m.lastIncr(); last != nil && last.seq >= info.seq {
+				return nil, errors.New("incremental files in manifest are out of order")
+			}
+			m.incrs = append(m.incrs, info)
+		default:
+			// history files are not used by godis
+		}
+	}
+	return m, scanner.Err()
+}
+
+// readManifest returns nil if manifest does not exist
+func readManifest(filename string) (*manifest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+// writeManifest replaces manifest file atomically
+func writeManifest(filename string, m *manifest) error {
+	dir := filepath.Dir(filename)
+	tmpFile, err := ioutil.TempFile(dir, "temp-*"+manifestSuffix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name()) // no-op if renamed
+	}()
+	_, err = tmpFile.Write(m.marshal())
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile.Name(), filename)
+	if err != nil {
+		return err
+	}
+	return fsyncDir(dir)
+}
+
+// fsyncDir persists renaming and creating of files in dir
+func fsyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
+
+// loadManifest reads manifest in aof dir, or creates it at first startup.
+// An aof file written by older version is moved into aof dir as base file.
+func (handler *Handler) loadManifest() error {
+	m, err := readManifest(handler.manifestPath())
+	if err != nil {
+		return fmt.Errorf("read aof manifest failed: %v", err)
+	}
+	if m == nil {
+		m = &manifest{}
+		upgraded := m.withNewBase(handler.aofBasename, ".aof", 0)
+		legacyFilename := getAofFilename()
+		if _, err := os.Stat(legacyFilename); err == nil {
+			err = os.Rename(legacyFilename, handler.aofPath(upgraded.base))
+			if err != nil {
+				return fmt.Errorf("move aof file into %s failed: %v", handler.aofDir, err)
+			}
+			logger.Info("aof file " + legacyFilename + " is moved into " + handler.aofDir + " as base file")
+		}
+		// the base file may be moved before a crash happened and manifest was not written
+		if _, err := os.Stat(handler.aofPath(upgraded.base)); err == nil {
+			m = upgraded
+		}
+	}
+	if m.lastIncr() == nil {
+		m = m.withNewIncr(handler.aofBasename)
+		err = writeManifest(handler.manifestPath(), m)
+		if err != nil {
+			return fmt.Errorf("write aof manifest failed: %v", err)
+		}
+	}
+	handler.manifest = m
+	return nil
+}
+
+func (handler *Handler) manifestPath() string {
+	return filepath.Join(handler.aofDir, handler.aofBasename+manifestSuffix)
+}
+
+func (handler *Handler) aofPath(info *aofInfo) string {
+	return filepath.Join(handler.aofDir, info.name)
+}
@@ -0,0 +1,33 @@
+package aof
+
+import "testing"
+
+func TestManifest(t *testing.T) {
+	m := (&manifest{}).withNewIncr("appendonly.aof")
+	m = m.withNewIncr("appendonly.aof")
+	m = m.withNewBase("appendonly.aof", ".rdb", 2)
+	expected := "file appendonly.aof.1.base.rdb seq 1 type b\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i\n"
+	if string(m.marshal()) != expected {
+		t.Errorf("wrong manifest: %s", m.marshal())
+	}
+	parsed, err := parseManifest(m.marshal())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(parsed.marshal()) != expected {
+		t.Errorf("wrong parsed manifest: %s", parsed.marshal())
+	}
+
+	invalid := []string{
+		"file appendonly.aof.1.base.rdb seq 1 type\n",
+		"file ../appendonly.aof.1.base.rdb seq 1 type b\n",
+		"file appendonly.aof.2.incr.aof seq 2 type i\nfile appendonly.aof.1.incr.aof seq 1 type i\n",
+	}
+	for _, data := range invalid {
+		if _, err := parseManifest([]byte(data)); err == nil {
+			t.Errorf("expect error for manifest: %s", data)
+		}
+	}
+}
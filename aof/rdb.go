@@ -0,0 +1,95 @@
+package aof
+
+import (
+	"github.com/hdt3213/godis/datastruct/dict"
+	List "github.com/hdt3213/godis/datastruct/list"
+	"github.com/hdt3213/godis/datastruct/set"
+	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/interface/database"
+	rdbEncoder "github.com/hdt3213/godis/lib/rdb"
+	"io"
+	"strconv"
+	"time"
+)
+
+// EntityToRDB serializes data entity in rdb format
+func EntityToRDB(encoder *rdbEncoder.Encoder, key string, entity *database.DataEntity, expiration *time.Time) error {
+	switch val := entity.Data.(type) {
+	case []byte:
+		return encoder.WriteStringObject(key, val, expiration)
+	case *List.LinkedList:
+		values := make([][]byte, 0, val.Len())
+		val.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			values = append(values, bytes)
+			return true
+		})
+		return encoder.WriteListObject(key, values, expiration)
+	case *set.Set:
+		members := make([][]byte, 0, val.Len())
+		val.ForEach(func(member string) bool {
+			members = append(members, []byte(member))
+			return true
+		})
+		return encoder.WriteSetObject(key, members, expiration)
+	case dict.Dict:
+		hash := make(map[string][]byte, val.Len())
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			hash[field] = bytes
+			return true
+		})
+		return encoder.WriteHashObject(key, hash, expiration)
+	case *SortedSet.SortedSet:
+		entries := make([]*rdbEncoder.ZSetEntry, 0, val.Len())
+		val.ForEach(int64(0), val.Len(), false, func(element *SortedSet.Element) bool {
+			entries = append(entries, &rdbEncoder.ZSetEntry{
+				Member: element.Member,
+				Score:  element.Score,
+			})
+			return true
+		})
+		return encoder.WriteZSetObject(key, entries, expiration)
+	}
+	return nil
+}
+
+// DumpRDB writes the first dbNum databases of snapshot into writer in rdb format, expired keys are skipped.
+func DumpRDB(writer io.Writer, snapshot database.Snapshot, dbNum int) error {
+	encoder := rdbEncoder.NewEncoder(writer)
+	err := encoder.WriteHeader()
+	if err != nil {
+		return err
+	}
+	err = encoder.WriteAux("redis-bits", "64")
+	if err != nil {
+		return err
+	}
+	err = encoder.WriteAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := 0; i < dbNum; i++ {
+		// select db lazily to skip empty db
+		selected := false
+		snapshot.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+			if expiration != nil && expiration.Before(now) {
+				return true
+			}
+			if !selected {
+				err = encoder.WriteSelectDB(i)
+				if err != nil {
+					return false
+				}
+				selected = true
+			}
+			err = EntityToRDB(encoder, key, entity, expiration)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return encoder.WriteEnd()
+}
@@ -0,0 +1,146 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/lib/encrypt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * Point-in-time restore truncates aof offline, the server must be stopped before it.
+ * A file is truncated at the stop point, incremental files after it are removed from manifest and deleted.
+ * The state in base file cannot be rolled back, so the point must be later than the last rewrite.
+ */
+
+// ErrNoTruncatePoint means there is no command after the given point, nothing to truncate
+var ErrNoTruncatePoint = errors.New("no command after the given point")
+
+// ErrBeforeRewrite means the given point is earlier than the last rewrite
+var ErrBeforeRewrite = errors.New("the given point is earlier than the last rewrite")
+
+// TruncatePoint is where aof should be truncated to restore the dataset to a point in time
+type TruncatePoint struct {
+	// File will be truncated to Offset
+	File   string
+	Size   int64
+	Offset int64
+	// Commands is the number of commands left in File
+	Commands int
+	// Dropped are the files after File, they will be removed from manifest and deleted
+	Dropped []string
+
+	manifestFile string
+	manifest     *manifest // manifest without dropped files, nil for a single aof file
+}
+
+// FindTimestamp finds where aof should be truncated to drop commands after timestamp (in unix seconds).
+// It requires timestamp annotations written by aof-timestamp-enabled.
+// filename is a manifest or a single aof file.
+func FindTimestamp(filename string, timestamp int64, keyring *encrypt.Keyring) (*TruncatePoint, error) {
+	if timestamp <= 0 {
+		return nil, errors.New("invalid timestamp")
+	}
+	return findTruncatePoint(filename, &loadPolicy{untilTimestamp: timestamp}, keyring)
+}
+
+// FindOffset finds where aof should be truncated to drop commands ending after offset of the last file.
+// filename is a manifest or a single aof file.
+func FindOffset(filename string, offset int64, keyring *encrypt.Keyring) (*TruncatePoint, error) {
+	if offset <= 0 {
+		return nil, errors.New("invalid offset")
+	}
+	return findTruncatePoint(filename, &loadPolicy{untilOffset: offset}, keyring)
+}
+
+func findTruncatePoint(filename string, policy *loadPolicy, keyring *encrypt.Keyring) (*TruncatePoint, error) {
+	var m *manifest
+	var files []*aofInfo
+	dir := filepath.Dir(filename)
+	if strings.HasSuffix(filename, manifestSuffix) {
+		var err error
+		m, err = readManifest(filename)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			return nil, errors.New("manifest not found: " + filename)
+		}
+		files = m.files()
+	} else {
+		files = []*aofInfo{{name: filepath.Base(filename), fileType: incrFileType}}
+	}
+	if len(files) == 0 {
+		return nil, ErrNoTruncatePoint
+	}
+	start := 0
+	if policy.untilOffset > 0 {
+		// offset is in the last file
+		start = len(files) - 1
+	}
+	for i := start; i < len(files); i++ {
+		info := files[i]
+		file := filepath.Join(dir, info.name)
+		result, scanned, err := checkFile(file, keyring, policy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if result.Err != nil {
+			return nil, fmt.Errorf("%s: %v, fix it before restore", file, result.Err)
+		}
+		if !scanned.stopped {
+			continue
+		}
+		if info.fileType == baseFileType {
+			return nil, ErrBeforeRewrite
+		}
+		// a new incremental file starts with the timestamp when rewrite started,
+		// stopping before its first command means the base is later than the point
+		if policy.untilTimestamp > 0 && scanned.commands == 0 && (i == 0 || files[i-1].fileType == baseFileType) {
+			return nil, ErrBeforeRewrite
+		}
+		point := &TruncatePoint{
+			File:         file,
+			Size:         result.Size,
+			Offset:       result.ValidSize,
+			Commands:     result.Commands,
+			manifestFile: filename,
+		}
+		for _, dropped := range files[i+1:] {
+			point.Dropped = append(point.Dropped, filepath.Join(dir, dropped.name))
+		}
+		if m != nil {
+			point.manifest = &manifest{
+				base:  m.base,
+				incrs: m.incrs[:len(m.incrs)-len(point.Dropped)],
+			}
+		}
+		return point, nil
+	}
+	return nil, ErrNoTruncatePoint
+}
+
+// Apply truncates aof to the point
+func (point *TruncatePoint) Apply() error {
+	if point.manifest != nil && len(point.Dropped) > 0 {
+		// update manifest first, so that dropped files would never be loaded after truncated file
+		err := writeManifest(point.manifestFile, point.manifest)
+		if err != nil {
+			return fmt.Errorf("write manifest failed: %v", err)
+		}
+	}
+	err := os.Truncate(point.File, point.Offset)
+	if err != nil {
+		return err
+	}
+	for _, file := range point.Dropped {
+		// remove dropped files to avoid collision with incremental files created later
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
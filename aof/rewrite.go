@@ -1,161 +1,273 @@
 package aof
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/lib/encrypt"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
-	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-func (handler *Handler) newRewriteHandler() *Handler {
-	h := &Handler{}
-	h.aofFilename = handler.aofFilename
-	h.db = handler.tmpDBMaker()
-	return h
-}
-
 // RewriteCtx holds context of an AOF rewriting procedure
 type RewriteCtx struct {
 	tmpFile  *os.File
-	fileSize int64
-	dbIdx    int // selected db index when startRewrite
+	incrSeq  int64 // commands after snapshot are written into incremental files from incrSeq
+	snapshot database.Snapshot
+}
+
+// rewriteMark is sent back by aof goroutine after it started a new incremental file at the snapshot
+type rewriteMark struct {
+	incrSeq int64
+	err     error
+}
+
+// ErrRewriteInProgress is returned when trying to start a rewrite while another one is running
+var ErrRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// Rewrite carries out AOF rewrite and blocks until it finished
+func (handler *Handler) Rewrite() error {
+	if !atomic.CompareAndSwapInt32(&handler.rewriting, 0, 1) {
+		return ErrRewriteInProgress
+	}
+	defer atomic.StoreInt32(&handler.rewriting, 0)
+	return handler.rewrite()
 }
 
-// Rewrite carries out AOF rewrite
-func (handler *Handler) Rewrite() {
+// BGRewrite starts AOF rewrite in background
+func (handler *Handler) BGRewrite() error {
+	if !atomic.CompareAndSwapInt32(&handler.rewriting, 0, 1) {
+		return ErrRewriteInProgress
+	}
+	go func() {
+		defer atomic.StoreInt32(&handler.rewriting, 0)
+		_ = handler.rewrite()
+	}()
+	return nil
+}
+
+// IsRewriting tells whether an AOF rewrite is running
+func (handler *Handler) IsRewriting() bool {
+	return atomic.LoadInt32(&handler.rewriting) == 1
+}
+
+func (handler *Handler) rewrite() error {
 	ctx, err := handler.StartRewrite()
 	if err != nil {
 		logger.Warn(err)
-		return
+		return err
 	}
 	err = handler.DoRewrite(ctx)
 	if err != nil {
 		logger.Error(err)
-		return
+		_ = ctx.tmpFile.Close()
+		_ = os.Remove(ctx.tmpFile.Name())
+		return err
 	}
+	return handler.FinishRewrite(ctx)
+}
 
-	handler.FinishRewrite(ctx)
+// checkAutoRewrite starts rewrite if aof file grows over auto-aof-rewrite-percentage of base size
+func (handler *Handler) checkAutoRewrite() {
+	percentage := int64(config.Properties.AutoAofRewritePercentage)
+	minSize := int64(config.Properties.AutoAofRewriteMinSize)
+	if percentage <= 0 || handler.IsRewriting() {
+		return
+	}
+	size := atomic.LoadInt64(&handler.currentSize)
+	if size < minSize {
+		return
+	}
+	base := atomic.LoadInt64(&handler.baseSize)
+	if base <= 0 {
+		base = 1
+	}
+	growth := (size*100)/base - 100
+	if growth >= percentage {
+		err := handler.BGRewrite()
+		if err == nil {
+			logger.Info(fmt.Sprintf("starting automatic rewriting of AOF on %d%% growth", growth))
+		}
+	}
 }
 
 // DoRewrite actually rewrite aof file
 // makes DoRewrite public for testing only, please use Rewrite instead
 func (handler *Handler) DoRewrite(ctx *RewriteCtx) error {
 	tmpFile := ctx.tmpFile
+	defer ctx.snapshot.Release()
 
-	// load aof tmpFile
-	tmpAof := handler.newRewriteHandler()
-	tmpAof.LoadAof(int(ctx.fileSize))
+	if config.Properties.AofUseRdbPreamble {
+		fileWriter, err := encrypt.WrapWriter(tmpFile, handler.keyring.Current())
+		if err != nil {
+			return err
+		}
+		writer := bufio.NewWriter(fileWriter)
+		err = DumpRDB(writer, ctx.snapshot, config.Properties.Databases)
+		if err != nil {
+			return err
+		}
+		err = writer.Flush()
+		if err != nil {
+			return err
+		}
+		return fileWriter.Close()
+	}
 
 	// rewrite aof tmpFile
+	writer, err := handler.newFileWriter(tmpFile)
+	if err != nil {
+		return err
+	}
 	for i := 0; i < config.Properties.Databases; i++ {
 		// select db
 		data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes()
-		_, err := tmpFile.Write(data)
+		_, err = writeRecord(writer, data, handler.checksum)
 		if err != nil {
 			return err
 		}
-		// dump db
-		tmpAof.db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+		// dump db, each key is a record
+		ctx.snapshot.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
 			cmd := EntityToCmd(key, entity)
-			if cmd != nil {
-				_, _ = tmpFile.Write(cmd.ToBytes())
+			if cmd == nil {
+				return true
 			}
+			data := cmd.ToBytes()
 			if expiration != nil {
-				cmd := MakeExpireCmd(key, *expiration)
-				if cmd != nil {
-					_, _ = tmpFile.Write(cmd.ToBytes())
+				if cmd := MakeExpireCmd(key, *expiration); cmd != nil {
+					data = append(data, cmd.ToBytes()...)
 				}
 			}
-			return true
+			_, err = writeRecord(writer, data, handler.checksum)
+			return err == nil
 		})
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	return writer.Close()
 }
 
 // StartRewrite prepares rewrite procedure
 func (handler *Handler) StartRewrite() (*RewriteCtx, error) {
-	handler.pausingAof.Lock() // pausing aof
-	defer handler.pausingAof.Unlock()
-
-	err := handler.aofFile.Sync()
-	if err != nil {
-		logger.Warn("fsync failed")
-		return nil, err
+	// take a snapshot of live db and start a new incremental file at the same time:
+	// commands before the mark have been applied to snapshot, the others will be written into new incremental file
+	markChan := make(chan *rewriteMark, 1)
+	snapshot := handler.db.Snapshot(func() {
+		handler.aofChan <- &payload{mark: markChan}
+	})
+	mark := <-markChan
+	if mark.err != nil {
+		snapshot.Release()
+		return nil, mark.err
 	}
 
-	// get current aof file size
-	fileInfo, _ := os.Stat(handler.aofFilename)
-	filesize := fileInfo.Size()
-
-	// create tmp file
-	file, err := ioutil.TempFile("", "*.aof")
+	file, err := ioutil.TempFile(handler.aofDir, "temp-rewrite-*.aof")
 	if err != nil {
+		snapshot.Release()
 		logger.Warn("tmp file create failed")
 		return nil, err
 	}
 	return &RewriteCtx{
 		tmpFile:  file,
-		fileSize: filesize,
-		dbIdx:    handler.currentDB,
+		incrSeq:  mark.incrSeq,
+		snapshot: snapshot,
 	}, nil
 }
 
+// rotate starts a new incremental file, invoker should hold pausingAof.Lock
+func (handler *Handler) rotate() (int64, error) {
+	m := handler.manifest.withNewIncr(handler.aofBasename)
+	info := m.lastIncr()
+	file, err := os.OpenFile(handler.aofPath(info), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return 0, err
+	}
+	writer, err := handler.newFileWriter(file)
+	if err == nil {
+		err = writeManifest(handler.manifestPath(), m)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return 0, err
+	}
+	// the previous file is finished
+	err = handler.aofWriter.Close()
+	if err != nil {
+		logger.Warn(err)
+	}
+	err = handler.doFsync()
+	if err != nil {
+		logger.Warn(err)
+	}
+	_ = handler.aofFile.Close()
+	handler.aofFile = file
+	handler.aofWriter = writer
+	handler.manifest = m
+	handler.currentDB = -1 // new file should select db before the first command
+	handler.lastTimestamp = 0
+	return info.seq, nil
+}
+
 // FinishRewrite finish rewrite procedure
-func (handler *Handler) FinishRewrite(ctx *RewriteCtx) {
+func (handler *Handler) FinishRewrite(ctx *RewriteCtx) error {
 	handler.pausingAof.Lock() // pausing aof
 	defer handler.pausingAof.Unlock()
 
 	tmpFile := ctx.tmpFile
-	// write commands executed during rewriting to tmp file
-	src, err := os.Open(handler.aofFilename)
+	err := tmpFile.Sync()
 	if err != nil {
-		logger.Error("open aofFilename failed: " + err.Error())
-		return
+		logger.Error("fsync tmp file failed: " + err.Error())
+		return err
 	}
-	defer func() {
-		_ = src.Close()
-	}()
-	_, err = src.Seek(ctx.fileSize, 0)
+	err = tmpFile.Close()
 	if err != nil {
-		logger.Error("seek failed: " + err.Error())
-		return
+		logger.Error("close tmp file failed: " + err.Error())
+		return err
 	}
 
-	// sync tmpFile's db index with online aofFile
-	data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(ctx.dbIdx))).ToBytes()
-	_, err = tmpFile.Write(data)
-	if err != nil {
-		logger.Error("tmp file rewrite failed: " + err.Error())
-		return
+	ext := ".aof"
+	if config.Properties.AofUseRdbPreamble {
+		ext = ".rdb"
 	}
-	// copy data
-	_, err = io.Copy(tmpFile, src)
+	oldManifest := handler.manifest
+	m := oldManifest.withNewBase(handler.aofBasename, ext, ctx.incrSeq)
+	err = os.Rename(tmpFile.Name(), handler.aofPath(m.base))
 	if err != nil {
-		logger.Error("copy aof filed failed: " + err.Error())
-		return
+		logger.Error("rename tmp file failed: " + err.Error())
+		return err
 	}
-
-	// replace current aof file by tmp file
-	_ = handler.aofFile.Close()
-	_ = os.Rename(tmpFile.Name(), handler.aofFilename)
-
-	// reopen aof file for further write
-	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	// the new base file takes effect after manifest was replaced, no data is lost if crashed before it
+	err = writeManifest(handler.manifestPath(), m)
 	if err != nil {
-		panic(err)
+		logger.Error("write aof manifest failed: " + err.Error())
+		_ = os.Remove(handler.aofPath(m.base))
+		return err
 	}
-	handler.aofFile = aofFile
+	handler.manifest = m
 
-	// reset selected db 重新写入一次 select 指令保证 aof 中的数据库与 handler.currentDB 一致
-	data = protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(handler.currentDB))).ToBytes()
-	_, err = handler.aofFile.Write(data)
-	if err != nil {
-		panic(err)
+	// remove files which are not in manifest
+	inUse := make(map[string]struct{})
+	for _, info := range m.files() {
+		inUse[info.name] = struct{}{}
 	}
+	for _, info := range oldManifest.files() {
+		if _, ok := inUse[info.name]; !ok {
+			_ = os.Remove(handler.aofPath(info))
+		}
+	}
+
+	base, total := handler.statFiles()
+	atomic.StoreInt64(&handler.baseSize, base)
+	atomic.StoreInt64(&handler.currentSize, total)
+	return nil
 }
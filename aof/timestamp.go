@@ -0,0 +1,30 @@
+package aof
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+ * If aof-timestamp-enabled, an annotation line such as `#TS:1628217470` is written before the commands
+ * executed in a new second, and at the beginning of each new file. They are compatible with redis 7.
+ * Loader ignores them, godis-check-aof uses them to truncate aof to a point in time.
+ */
+
+const timestampPrefix = "#TS:"
+
+func makeTimestampLine(timestamp int64) []byte {
+	return []byte(timestampPrefix + strconv.FormatInt(timestamp, 10) + "\r\n")
+}
+
+// parseTimestamp returns the unix timestamp in annotation
+func parseTimestamp(annotation string) (int64, bool) {
+	if !strings.HasPrefix(annotation, timestampPrefix) {
+		return 0, false
+	}
+	timestamp, err := strconv.ParseInt(annotation[len(timestampPrefix):], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return timestamp, true
+}
@@ -1,3 +1,4 @@
 #!/usr/bin/env bash
 
 go build -o target/godis-darwin ./
+go build -o target/godis-check-aof-darwin ./cmd/godis-check-aof
@@ -2,6 +2,7 @@ package cluster
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/lib/utils"
@@ -11,10 +12,18 @@ import (
 
 type connectionFactory struct {
 	Peer string
+	// connect to peer with tls if not nil
+	TLSConfig *tls.Config
 }
 
 func (f *connectionFactory) MakeObject(ctx context.Context) (*pool.PooledObject, error) {
-	c, err := client.MakeClient(f.Peer)
+	var c *client.Client
+	var err error
+	if f.TLSConfig != nil {
+		c, err = client.MakeTLSClient(f.Peer, f.TLSConfig)
+	} else {
+		c, err = client.MakeClient(f.Peer)
+	}
 	if err != nil {
 		return nil, err
 	}
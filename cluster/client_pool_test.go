@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/redis/client"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert creates a certificate for dnsName signed by ca, or a self-signed ca if ca is nil
+func writeTestCert(t *testing.T, dir string, dnsName string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (
+	*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{dnsName}, // no ip address
+	}
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		ca, caKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, dnsName+".crt")
+	keyFile := filepath.Join(dir, dnsName+".key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+func TestPeerConnectionWithTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey, caFile, _ := writeTestCert(t, dir, "ca", nil, nil)
+	_, _, certFile, keyFile := writeTestCert(t, dir, "godis-cluster", ca, caKey)
+
+	// peer requires certificate of client, and replies PONG to every command
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					_, _ = conn.Write([]byte("+PONG\r\n"))
+				}
+			}()
+		}
+	}()
+
+	properties := config.Properties
+	defer func() {
+		config.Properties = properties
+	}()
+	config.Properties = &config.ServerProperties{
+		TLSCluster:    true,
+		TLSCertFile:   certFile,
+		TLSKeyFile:    keyFile,
+		TLSCACertFile: caFile,
+	}
+	// certificate of peer has no ip address
+	tlsConfig, err := makePeerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := &connectionFactory{Peer: listener.Addr().String(), TLSConfig: tlsConfig}
+	if _, err = factory.MakeObject(context.Background()); err == nil {
+		t.Error("expect failure of verifying peer by ip address")
+	}
+
+	config.Properties.TLSClusterServerName = "godis-cluster"
+	tlsConfig, err = makePeerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory = &connectionFactory{Peer: listener.Addr().String(), TLSConfig: tlsConfig}
+	object, err := factory.MakeObject(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := object.Object.(*client.Client)
+	defer c.Close()
+	asserts.AssertStatusReply(t, c.Send(toArgs("PING")), "PONG")
+}
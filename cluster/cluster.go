@@ -3,6 +3,7 @@ package cluster
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/hdt3213/godis/config"
 	database2 "github.com/hdt3213/godis/database"
@@ -12,6 +13,7 @@ import (
 	"github.com/hdt3213/godis/lib/consistenthash"
 	"github.com/hdt3213/godis/lib/idgenerator"
 	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/tlsutil"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/jolestar/go-commons-pool/v2"
 	"runtime/debug"
@@ -72,15 +74,36 @@ func MakeCluster() *Cluster {
 	nodes = append(nodes, config.Properties.Self)
 	cluster.peerPicker.AddNode(nodes...)
 	ctx := context.Background()
+	tlsConfig, err := makePeerTLSConfig()
+	if err != nil {
+		panic(err)
+	}
 	for _, peer := range config.Properties.Peers {
 		cluster.peerConnection[peer] = pool.NewObjectPoolWithDefaultConfig(ctx, &connectionFactory{
-			Peer: peer,
+			Peer:      peer,
+			TLSConfig: tlsConfig,
 		})
 	}
 	cluster.nodes = nodes
 	return cluster
 }
 
+// makePeerTLSConfig creates tls config to connect to peers, it returns nil if tls-cluster is disabled
+func makePeerTLSConfig() (*tls.Config, error) {
+	if !config.Properties.TLSCluster {
+		return nil, nil
+	}
+	// peers use the same certificate as server for mutual auth
+	tlsConfig, err := tlsutil.ClientConfig(config.Properties.TLSCertFile, config.Properties.TLSKeyFile,
+		config.Properties.TLSCACertFile)
+	if err != nil {
+		return nil, err
+	}
+	// peers are usually addressed by ip, which may not be in their certificates
+	tlsConfig.ServerName = config.Properties.TLSClusterServerName
+	return tlsConfig, nil
+}
+
 // CmdFunc represents the handler of a redis command
 type CmdFunc func(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply
 
@@ -110,6 +133,9 @@ func (cluster *Cluster) Exec(c redis.Connection, cmdLine [][]byte) (result redis
 	if cmdName == "auth" {
 		return database2.Auth(c, cmdLine[1:])
 	}
+	if cmdName == "hello" {
+		return database2.Hello(c, cmdLine[1:])
+	}
 	if !isAuthenticated(c) {
 		return protocol.MakeErrReply("NOAUTH Authentication required")
 	}
@@ -81,7 +81,7 @@ func execMultiOnOtherNode(cluster *Cluster, conn redis.Connection, peer string,
 	if protocol.IsErrorReply(rawRelayResult) {
 		return rawRelayResult
 	}
-	_, ok := rawRelayResult.(*protocol.EmptyMultiBulkReply)
+	_, ok := rawRelayResult.(*protocol.NullMultiBulkReply) // aborted by watching keys
 	if ok {
 		return rawRelayResult
 	}
@@ -127,7 +127,7 @@ func execRelayedMulti(cluster *Cluster, conn redis.Connection, cmdLine CmdLine)
 		watching[key] = uint32(ver)
 	}
 	rawResult := cluster.db.ExecMulti(conn, watching, txCmdLines[1:])
-	_, ok := rawResult.(*protocol.EmptyMultiBulkReply)
+	_, ok := rawResult.(*protocol.NullMultiBulkReply)
 	if ok {
 		return rawResult
 	}
@@ -0,0 +1,131 @@
+// Command godis-check-aof checks aof files of godis and fixes truncated or corrupted files by truncating them
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/lib/encrypt"
+	"os"
+	"strings"
+)
+
+const usage = `Usage: godis-check-aof [--fix] [--key-file <file>[,<file>...]] <file.manifest|file.aof>
+       godis-check-aof --truncate-to-timestamp <unix seconds> <file.manifest|file.aof>
+       godis-check-aof --truncate-to-offset <offset> <file.manifest|file.aof>
+
+Checks the aof files listed in manifest, or a single aof file.
+With --fix, the damaged file is truncated to the end of its last valid command.
+Only the last file in manifest could be fixed.
+Encrypted files are decrypted by the keys in --key-file.
+
+With --truncate-to-timestamp, commands after the timestamp are dropped, which requires aof-timestamp-enabled.
+With --truncate-to-offset, commands ending after the offset of the last file are dropped.
+Incremental files after the truncated one are removed from manifest and deleted.
+Stop the server before truncating.
+`
+
+func main() {
+	fix := flag.Bool("fix", false, "truncate the damaged file to the end of its last valid command")
+	keyFiles := flag.String("key-file", "", "comma separated key files for decrypting encrypted files")
+	timestamp := flag.Int64("truncate-to-timestamp", 0, "drop commands after the unix timestamp")
+	offset := flag.Int64("truncate-to-offset", 0, "drop commands ending after the offset of the last file")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	keyring, err := encrypt.LoadKeyring("", strings.Split(*keyFiles, ","))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	filename := flag.Arg(0)
+	if *timestamp > 0 || *offset > 0 {
+		truncateTo(filename, *timestamp, *offset, keyring)
+		return
+	}
+	files := []string{filename}
+	if strings.HasSuffix(filename, ".manifest") {
+		files, err = aof.ManifestFiles(filename)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	for i, file := range files {
+		result, err := aof.CheckFile(file, keyring)
+		if err != nil {
+			fmt.Printf("%s: %v\n", file, err)
+			os.Exit(1)
+		}
+		if result.Err == nil {
+			fmt.Printf("%s: %d commands, AOF is valid\n", file, result.Commands)
+			continue
+		}
+		fmt.Printf("%s: %v\n", file, result.Err)
+		fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n",
+			result.Size, result.ValidSize, result.Size-result.ValidSize)
+		if !*fix {
+			fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+			os.Exit(1)
+		}
+		if i != len(files)-1 {
+			fmt.Println("Only the last file in manifest could be fixed, fixing this file would lose the following commands.")
+			os.Exit(1)
+		}
+		fmt.Printf("This will shrink the AOF %s from %d bytes, with %d bytes, to %d bytes\n",
+			file, result.Size, result.Size-result.ValidSize, result.ValidSize)
+		confirm()
+		err = aof.TruncateFile(file, result.ValidSize, keyring)
+		if err != nil {
+			fmt.Printf("Failed to truncate AOF: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Successfully truncated AOF")
+	}
+}
+
+func confirm() {
+	fmt.Print("Continue? [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		fmt.Println("Aborting...")
+		os.Exit(1)
+	}
+}
+
+// truncateTo restores aof to a point in time or an offset
+func truncateTo(filename string, timestamp int64, offset int64, keyring *encrypt.Keyring) {
+	var point *aof.TruncatePoint
+	var err error
+	if timestamp > 0 {
+		point, err = aof.FindTimestamp(filename, timestamp, keyring)
+	} else {
+		point, err = aof.FindOffset(filename, offset, keyring)
+	}
+	if err == aof.ErrNoTruncatePoint {
+		fmt.Println("Nothing to truncate, " + err.Error())
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("This will shrink the AOF %s from %d bytes, with %d bytes, to %d bytes (%d commands left)\n",
+		point.File, point.Size, point.Size-point.Offset, point.Offset, point.Commands)
+	for _, file := range point.Dropped {
+		fmt.Printf("This will remove %s from manifest and delete it\n", file)
+	}
+	confirm()
+	err = point.Apply()
+	if err != nil {
+		fmt.Printf("Failed to truncate AOF: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Successfully truncated AOF")
+}
@@ -16,10 +16,65 @@ type ServerProperties struct {
 	Port           int    `cfg:"port"`
 	AppendOnly     bool   `cfg:"appendOnly"`
 	AppendFilename string `cfg:"appendFilename"`
-	MaxClients     int    `cfg:"maxclients"`
-	RequirePass    string `cfg:"requirepass"`
-	Databases      int    `cfg:"databases"`
-	RDBFilename    string `cfg:"dbfilename"`
+	// directory of base, incremental and manifest files of aof
+	AppendDirname string `cfg:"appenddirname"`
+	AppendFsync   string `cfg:"appendfsync"`
+	// rewrite aof if it grows over the percentage of size after last rewrite, 0 means disabled
+	AutoAofRewritePercentage int `cfg:"auto-aof-rewrite-percentage"`
+	// aof is not rewritten automatically if it is smaller than min size
+	AutoAofRewriteMinSize int `cfg:"auto-aof-rewrite-min-size"`
+	// truncate the incomplete command at the end of aof, otherwise refuse to start
+	AofLoadTruncated bool `cfg:"aof-load-truncated"`
+	// skip corrupted commands in the middle of aof, otherwise refuse to start
+	AofLoadCorrupted bool `cfg:"aof-load-corrupted"`
+	// write a checksum after each record of aof
+	AofChecksum bool `cfg:"aof-checksum"`
+	// stop or skip if a record of aof does not match its checksum
+	AofChecksumMismatch string `cfg:"aof-checksum-mismatch"`
+	// write timestamp annotations into aof for point-in-time restore
+	AofTimestampEnabled bool `cfg:"aof-timestamp-enabled"`
+	// rewritten aof starts with a rdb snapshot which is faster to load
+	AofUseRdbPreamble bool `cfg:"aof-use-rdb-preamble"`
+	// key file for encrypting aof and rdb files, encryption is disabled if empty
+	EncryptionKeyFile string `cfg:"encryption-key-file"`
+	// key files replaced by encryption-key-file, files encrypted by them are still readable until rewritten
+	EncryptionOldKeyFiles []string `cfg:"encryption-old-key-files"`
+	// max number of connected clients, default 10000
+	MaxClients int `cfg:"maxclients"`
+	// close the connection after a client is idle for N seconds, 0 means never
+	Timeout int `cfg:"timeout"`
+	// max seconds to wait for clients to close on shutdown, default 10
+	ShutdownTimeout int `cfg:"shutdown-timeout"`
+	// max length of a bulk string in request, default 512mb
+	ProtoMaxBulkLen int `cfg:"proto-max-bulk-len"`
+	// max number of arguments in request, default 1024*1024
+	ProtoMaxMultiBulkLen int `cfg:"proto-max-multibulk-len"`
+	// max size of a request being read from a client, default 1gb
+	ClientQueryBufferLimit int    `cfg:"client-query-buffer-limit"`
+	RequirePass            string `cfg:"requirepass"`
+	Databases              int    `cfg:"databases"`
+	RDBFilename            string `cfg:"dbfilename"`
+	// refuse to start if rdb file cannot be loaded completely
+	RDBLoadStrict bool `cfg:"rdb-load-strict"`
+	// save points, e.g. "900 1 300 10", multiple `save` lines are joined
+	Save string `cfg:"save"`
+
+	// listen on unix socket at the path, plain tcp is disabled by `port 0` if unixsocket is set
+	UnixSocket string `cfg:"unixsocket"`
+	// permission of unix socket file in octal, e.g. 700
+	UnixSocketPerm string `cfg:"unixsocketperm"`
+
+	// serve tls on tls-port, plain tcp is disabled by `port 0` if tls-port is set
+	TLSPort       int    `cfg:"tls-port"`
+	TLSCertFile   string `cfg:"tls-cert-file"`
+	TLSKeyFile    string `cfg:"tls-key-file"`
+	TLSCACertFile string `cfg:"tls-ca-cert-file"`
+	// verify client certificates by tls-ca-cert-file: yes (default), no or optional
+	TLSAuthClients string `cfg:"tls-auth-clients"`
+	// connect to peers of cluster with tls
+	TLSCluster bool `cfg:"tls-cluster"`
+	// name to verify certificates of peers, instead of the host in peer address
+	TLSClusterServerName string `cfg:"tls-cluster-server-name"`
 
 	Peers []string `cfg:"peers"`
 	Self  string   `cfg:"self"`
@@ -28,17 +83,50 @@ type ServerProperties struct {
 // Properties holds global config properties
 var Properties *ServerProperties
 
+// repeatable keys could be written in multiple lines, their values are joined by space
+var repeatableKeys = map[string]bool{
+	"save": true,
+}
+
+// SavePoint means an rdb snapshot will be saved if at least Changes writes happened in Seconds
+type SavePoint struct {
+	Seconds int64
+	Changes int64
+}
+
+// SavePoints parses `save` property into save points, returns nil if rdb auto-saving is disabled
+func (p *ServerProperties) SavePoints() []SavePoint {
+	fields := strings.Fields(strings.Trim(p.Save, "\""))
+	var points []SavePoint
+	for i := 0; i+1 < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds <= 0 || changes <= 0 {
+			logger.Warn("invalid save point: " + fields[i] + " " + fields[i+1])
+			continue
+		}
+		points = append(points, SavePoint{
+			Seconds: seconds,
+			Changes: changes,
+		})
+	}
+	return points
+}
+
 func init() {
 	// default config
 	Properties = &ServerProperties{
-		Bind:       "127.0.0.1",
-		Port:       6379,
-		AppendOnly: false,
+		Bind:             "127.0.0.1",
+		Port:             6379,
+		AppendOnly:       false,
+		AofLoadTruncated: true,
 	}
 }
 
 func parse(src io.Reader) *ServerProperties {
-	config := &ServerProperties{}
+	config := &ServerProperties{
+		AofLoadTruncated: true,
+	}
 
 	// read config file
 	rawMap := make(map[string]string)
@@ -50,9 +138,12 @@ func parse(src io.Reader) *ServerProperties {
 		}
 		pivot := strings.IndexAny(line, " ")
 		if pivot > 0 && pivot < len(line)-1 { // separator found
-			key := line[0:pivot]
+			key := strings.ToLower(line[0:pivot])
 			value := strings.Trim(line[pivot+1:], " ")
-			rawMap[strings.ToLower(key)] = value
+			if prev, ok := rawMap[key]; ok && repeatableKeys[key] {
+				value = prev + " " + value
+			}
+			rawMap[key] = value
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -77,7 +168,7 @@ func parse(src io.Reader) *ServerProperties {
 			case reflect.String:
 				fieldVal.SetString(value)
 			case reflect.Int:
-				intValue, err := strconv.ParseInt(value, 10, 64)
+				intValue, err := parseInt(value)
 				if err == nil {
 					fieldVal.SetInt(intValue)
 				}
@@ -95,6 +186,29 @@ func parse(src io.Reader) *ServerProperties {
 	return config
 }
 
+var memoryUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+	{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+}
+
+// parseInt parses integer with optional memory unit like redis, e.g. 64mb
+func parseInt(value string) (int64, error) {
+	lower := strings.ToLower(value)
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(lower, unit.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSuffix(lower, unit.suffix), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return n * unit.factor, nil
+		}
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
 // SetupConfig read config file and store properties into Properties
 func SetupConfig(configFilename string) {
 	file, err := os.Open(configFilename)
@@ -28,3 +28,37 @@ func TestParse(t *testing.T) {
 		t.Error("list parse failed")
 	}
 }
+
+func TestSavePoints(t *testing.T) {
+	src := "save 900 1\n" +
+		"save 300 10 60 10000\n"
+	p := parse(strings.NewReader(src))
+	points := p.SavePoints()
+	expected := []SavePoint{{900, 1}, {300, 10}, {60, 10000}}
+	if len(points) != len(expected) {
+		t.Errorf("expect %d save points, actually %d", len(expected), len(points))
+		return
+	}
+	for i, point := range points {
+		if point != expected[i] {
+			t.Errorf("expect %v, actually %v", expected[i], point)
+		}
+	}
+
+	p = parse(strings.NewReader("save \"\""))
+	if len(p.SavePoints()) != 0 {
+		t.Error("save points should be disabled")
+	}
+}
+
+func TestParseMemorySize(t *testing.T) {
+	src := "auto-aof-rewrite-min-size 64mb\n" +
+		"auto-aof-rewrite-percentage 100"
+	p := parse(strings.NewReader(src))
+	if p.AutoAofRewriteMinSize != 64*1024*1024 {
+		t.Errorf("wrong memory size: %d", p.AutoAofRewriteMinSize)
+	}
+	if p.AutoAofRewritePercentage != 100 {
+		t.Error("int parse failed")
+	}
+}
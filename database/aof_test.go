@@ -1,9 +1,13 @@
 package database
 
 import (
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/aof"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/encrypt"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/connection"
 	"github.com/hdt3213/godis/redis/protocol"
@@ -12,6 +16,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -95,18 +100,18 @@ func validateTestData(t *testing.T, db database.DB, dbIndex int, prefix string,
 }
 
 func TestAof(t *testing.T) {
-	tmpDir, err := ioutil.TempDir("", "godis")
+	aofDir, err := ioutil.TempDir("", "godis")
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	aofFilename := path.Join(tmpDir, "a.aof")
 	defer func() {
-		_ = os.Remove(aofFilename)
+		_ = os.RemoveAll(aofDir)
 	}()
 	config.Properties = &config.ServerProperties{
 		AppendOnly:     true,
-		AppendFilename: aofFilename,
+		AppendDirname:  aofDir,
+		AppendFilename: "a.aof",
 	}
 	dbNum := 4
 	size := 10
@@ -127,18 +132,17 @@ func TestAof(t *testing.T) {
 }
 
 func TestRewriteAOF(t *testing.T) {
-	tmpFile, err := ioutil.TempFile("", "*.aof")
+	aofDir, err := ioutil.TempDir("", "godis")
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	aofFilename := tmpFile.Name()
 	defer func() {
-		_ = os.Remove(aofFilename)
+		_ = os.RemoveAll(aofDir)
 	}()
 	config.Properties = &config.ServerProperties{
-		AppendOnly:     true,
-		AppendFilename: aofFilename,
+		AppendOnly:    true,
+		AppendDirname: aofDir,
 	}
 	aofWriteDB := NewStandaloneServer()
 	size := 1
@@ -163,18 +167,17 @@ func TestRewriteAOF(t *testing.T) {
 
 // TestRewriteAOF2 tests execute commands during rewrite procedure
 func TestRewriteAOF2(t *testing.T) {
-	tmpFile, err := ioutil.TempFile("", "*.aof")
+	aofDir, err := ioutil.TempDir("", "godis")
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	aofFilename := tmpFile.Name()
 	defer func() {
-		_ = os.Remove(aofFilename)
+		_ = os.RemoveAll(aofDir)
 	}()
 	config.Properties = &config.ServerProperties{
-		AppendOnly:     true,
-		AppendFilename: aofFilename,
+		AppendOnly:    true,
+		AppendDirname: aofDir,
 	}
 	aofWriteDB := NewStandaloneServer()
 	dbNum := 4
@@ -213,3 +216,705 @@ func TestRewriteAOF2(t *testing.T) {
 	}
 	aofReadDB.Close()
 }
+
+func TestAofFsync(t *testing.T) {
+	for _, policy := range []string{aof.FsyncAlways, aof.FsyncEverySec, aof.FsyncNo} {
+		aofDir, err := ioutil.TempDir("", "godis")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		config.Properties = &config.ServerProperties{
+			AppendOnly:    true,
+			AppendDirname: aofDir,
+			AppendFsync:   policy,
+		}
+		aofWriteDB := NewStandaloneServer()
+		conn := &connection.FakeConn{}
+		ret := aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "a"))
+		asserts.AssertStatusReply(t, ret, "OK")
+		if policy == aof.FsyncAlways {
+			// command must be written before replying
+			data, _ := ioutil.ReadFile(path.Join(aofDir, "appendonly.aof.1.incr.aof"))
+			if !strings.Contains(strings.ToLower(string(data)), "set") {
+				t.Error("command is not written before reply in always policy")
+			}
+		} else if policy == aof.FsyncEverySec {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		stats := aofWriteDB.aofHandler.GetFsyncStats()
+		if policy == aof.FsyncNo && stats.Count != 0 {
+			t.Errorf("expect no fsync in %s policy", policy)
+		} else if policy != aof.FsyncNo && (stats.Count == 0 || stats.Lag != 0) {
+			t.Errorf("expect data synced in %s policy", policy)
+		}
+		info := string(aofWriteDB.Exec(conn, utils.ToCmdLine("INFO", "persistence")).ToBytes())
+		if !strings.Contains(info, "aof_fsync:"+policy) {
+			t.Error("wrong info: " + info)
+		}
+		aofWriteDB.Close()
+		_ = os.RemoveAll(aofDir)
+	}
+}
+
+func TestAutoRewriteAOF(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:               true,
+		AppendDirname:            aofDir,
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    1024,
+	}
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	for i := 0; i < 1000; i++ {
+		aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", strconv.Itoa(i)))
+	}
+	rewritten := false
+	for i := 0; i < 30 && !rewritten; i++ {
+		time.Sleep(100 * time.Millisecond)
+		current, base := aofWriteDB.aofHandler.GetSize()
+		rewritten = current < 1024 && base == current
+	}
+	if !rewritten {
+		t.Error("aof is not rewritten automatically")
+	}
+	aofWriteDB.Close()
+	aofReadDB := NewStandaloneServer()
+	ret := aofReadDB.Exec(conn, utils.ToCmdLine("GET", "a"))
+	asserts.AssertBulkReply(t, ret, "999")
+	aofReadDB.Close()
+}
+
+func TestRewriteAOFInProgress(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:    true,
+		AppendDirname: aofDir,
+	}
+	aofWriteDB := NewStandaloneServer()
+	makeTestData(aofWriteDB, 0, "", 10000)
+	ret := aofWriteDB.Exec(nil, utils.ToCmdLine("BGRewriteAOF"))
+	asserts.AssertStatusReply(t, ret, "Background append only file rewriting started")
+	ret = aofWriteDB.Exec(nil, utils.ToCmdLine("BGRewriteAOF"))
+	asserts.AssertErrReply(t, ret, "ERR Background append only file rewriting already in progress")
+	for aofWriteDB.aofHandler.IsRewriting() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	aofWriteDB.Close()
+}
+
+func TestRewriteAOFWithSnapshot(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:    true,
+		AppendDirname: aofDir,
+	}
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "1"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "b", "1"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("RPUSH", "list", "1"))
+
+	ctx, err := aofWriteDB.aofHandler.StartRewrite()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// modify data during rewrite
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "2"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("DEL", "b"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("RPUSH", "list", "2"))
+	conn.SelectDB(1)
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "c", "1"))
+	err = aofWriteDB.aofHandler.DoRewrite(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = aofWriteDB.aofHandler.FinishRewrite(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofWriteDB.Close()
+
+	aofReadDB := NewStandaloneServer()
+	defer aofReadDB.Close()
+	conn = &connection.FakeConn{}
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "a")), "2")
+	asserts.AssertIntReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("EXISTS", "b")), 0)
+	asserts.AssertMultiBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("LRANGE", "list", "0", "-1")), []string{"1", "2"})
+	conn.SelectDB(1)
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "c")), "1")
+}
+
+func TestRewriteAOFWithRDBPreamble(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:        true,
+		AppendDirname:     aofDir,
+		AofUseRdbPreamble: true,
+	}
+	aofWriteDB := NewStandaloneServer()
+	size := 10
+	dbNum := 4
+	for i := 0; i < dbNum; i++ {
+		makeTestData(aofWriteDB, i, "", size)
+	}
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "ttl", "1", "EX", "1000"))
+
+	ctx, err := aofWriteDB.aofHandler.StartRewrite()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// commands during rewrite are appended to the incremental file following the rdb base file
+	conn.SelectDB(1)
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "a"))
+	err = aofWriteDB.aofHandler.DoRewrite(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = aofWriteDB.aofHandler.FinishRewrite(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.SelectDB(2)
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "b", "b"))
+	aofWriteDB.Close()
+
+	content, err := ioutil.ReadFile(path.Join(aofDir, "appendonly.aof.1.base.rdb"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasPrefix(string(content), "REDIS") {
+		t.Error("rewritten aof should start with rdb preamble")
+	}
+	result, err := aof.CheckFile(path.Join(aofDir, "appendonly.aof.1.base.rdb"), nil)
+	if err != nil || result.Err != nil || result.ValidSize != int64(len(content)) {
+		t.Errorf("expect valid rdb base file, actually %v %+v", err, result)
+	}
+
+	aofReadDB := NewStandaloneServer()
+	defer aofReadDB.Close()
+	for i := 0; i < dbNum; i++ {
+		validateTestData(t, aofReadDB, i, "", size)
+	}
+	conn = &connection.FakeConn{}
+	ret := aofReadDB.Exec(conn, utils.ToCmdLine("TTL", "ttl"))
+	if intResult, ok := ret.(*protocol.IntReply); !ok || intResult.Code <= 0 {
+		t.Errorf("expect ttl of key, actually %s", ret.ToBytes())
+	}
+	conn.SelectDB(1)
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "a")), "a")
+	conn.SelectDB(2)
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "b")), "b")
+
+	// rdb base file contains nothing but rdb
+	baseFile, _ := os.OpenFile(path.Join(aofDir, "appendonly.aof.1.base.rdb"), os.O_APPEND|os.O_WRONLY, 0600)
+	_, _ = baseFile.WriteString("*1\r\n$4\r\nPING\r\n")
+	_ = baseFile.Close()
+	if _, err = aof.CheckFile(path.Join(aofDir, "appendonly.aof.1.base.rdb"), nil); err == nil {
+		t.Error("expect error of data after rdb")
+	}
+}
+
+func TestMultiPartAof(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	// aof written by older version
+	legacyFilename := path.Join(aofDir, "legacy.aof")
+	legacy := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "legacy", "1")).ToBytes()
+	err = ioutil.WriteFile(legacyFilename, legacy, 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendDirname:  path.Join(aofDir, "appendonlydir"),
+		AppendFilename: legacyFilename,
+	}
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	asserts.AssertBulkReply(t, aofWriteDB.Exec(conn, utils.ToCmdLine("GET", "legacy")), "1")
+	if _, err := os.Stat(legacyFilename); !os.IsNotExist(err) {
+		t.Error("legacy aof file should be moved into aof dir")
+	}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "1"))
+	ret := aofWriteDB.Exec(conn, utils.ToCmdLine("RewriteAOF"))
+	asserts.AssertNotError(t, ret)
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "b", "1"))
+	aofWriteDB.Close()
+
+	manifest, err := ioutil.ReadFile(path.Join(aofDir, "appendonlydir", "legacy.aof.manifest"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := "file legacy.aof.2.base.aof seq 2 type b\n" +
+		"file legacy.aof.2.incr.aof seq 2 type i\n"
+	if string(manifest) != expected {
+		t.Errorf("wrong manifest: %s", manifest)
+	}
+	files, _ := ioutil.ReadDir(path.Join(aofDir, "appendonlydir"))
+	if len(files) != 3 {
+		t.Errorf("expect old files removed after rewrite, actually %d files", len(files))
+	}
+
+	aofReadDB := NewStandaloneServer()
+	defer aofReadDB.Close()
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "legacy")), "1")
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "a")), "1")
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "b")), "1")
+}
+
+func TestLoadTruncatedAof(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:    true,
+		AppendDirname: aofDir,
+	}
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "1"))
+	aofWriteDB.Close()
+
+	// crashed while writing a command
+	incrFilename := path.Join(aofDir, "appendonly.aof.1.incr.aof")
+	info, _ := os.Stat(incrFilename)
+	validSize := info.Size()
+	file, _ := os.OpenFile(incrFilename, os.O_APPEND|os.O_WRONLY, 0600)
+	cmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "b", "1")).ToBytes()
+	_, _ = file.Write(cmd[:len(cmd)-2])
+	_ = file.Close()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expect refusing to start if aof-load-truncated is disabled")
+			}
+		}()
+		NewStandaloneServer()
+	}()
+
+	config.Properties.AofLoadTruncated = true
+	aofReadDB := NewStandaloneServer()
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "a")), "1")
+	asserts.AssertIntReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("EXISTS", "b")), 0)
+	aofReadDB.Close()
+	info, _ = os.Stat(incrFilename)
+	if info.Size() < validSize || info.Size() >= validSize+int64(len(cmd)-2) {
+		t.Errorf("incomplete command should be truncated, size: %d", info.Size())
+	}
+}
+
+func TestLoadCorruptedAof(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:    true,
+		AppendDirname: aofDir,
+	}
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "1"))
+	aofWriteDB.Close()
+
+	incrFilename := path.Join(aofDir, "appendonly.aof.1.incr.aof")
+	file, _ := os.OpenFile(incrFilename, os.O_APPEND|os.O_WRONLY, 0600)
+	_, _ = file.Write([]byte("$3\r\nabc\r\n"))
+	_, _ = file.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "b", "1")).ToBytes())
+	_ = file.Close()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expect refusing to start if aof is corrupted")
+			}
+		}()
+		NewStandaloneServer()
+	}()
+
+	config.Properties.AofLoadCorrupted = true
+	aofReadDB := NewStandaloneServer()
+	defer aofReadDB.Close()
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "a")), "1")
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "b")), "1")
+}
+
+func TestAofChecksum(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:    true,
+		AppendDirname: aofDir,
+		AofChecksum:   true,
+	}
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "aaa"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "b", "bbb"))
+	aofWriteDB.Close()
+
+	// plain commands are written into a new file after checksum disabled
+	config.Properties.AofChecksum = false
+	aofWriteDB = NewStandaloneServer()
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "c", "ccc"))
+	aofWriteDB.Close()
+	asserts.AssertBulkReply(t, aofWriteDB.Exec(conn, utils.ToCmdLine("GET", "a")), "aaa")
+
+	// bit rot
+	incrFilename := path.Join(aofDir, "appendonly.aof.1.incr.aof")
+	data, _ := ioutil.ReadFile(incrFilename)
+	if !strings.Contains(string(data), "#CRC:") {
+		t.Error("checksum is not written")
+	}
+	data = []byte(strings.Replace(string(data), "aaa", "aab", 1))
+	_ = ioutil.WriteFile(incrFilename, data, 0600)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expect refusing to start if checksum mismatched")
+			}
+		}()
+		NewStandaloneServer()
+	}()
+
+	config.Properties.AofChecksumMismatch = aof.ChecksumMismatchSkip
+	aofReadDB := NewStandaloneServer()
+	defer aofReadDB.Close()
+	asserts.AssertIntReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("EXISTS", "a")), 0)
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "b")), "bbb")
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "c")), "ccc")
+}
+
+func writeTestKey(t *testing.T, dir string, name string, b byte) string {
+	filename := path.Join(dir, name)
+	err := ioutil.WriteFile(filename, []byte(strings.Repeat(fmt.Sprintf("%02x", b), 32)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestAofEncryption(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	oldKey := writeTestKey(t, aofDir, "old.key", 1)
+	newKey := writeTestKey(t, aofDir, "new.key", 2)
+	config.Properties = &config.ServerProperties{
+		AppendOnly:        true,
+		AppendDirname:     aofDir,
+		AofLoadTruncated:  true,
+		EncryptionKeyFile: oldKey,
+	}
+	prefix := utils.RandString(8)
+	aofWriteDB := NewStandaloneServer()
+	makeTestData(aofWriteDB, 0, prefix, 10)
+	aofWriteDB.Close()
+	data, _ := ioutil.ReadFile(path.Join(aofDir, "appendonly.aof.1.incr.aof"))
+	if !strings.HasPrefix(string(data), encrypt.Magic) || strings.Contains(string(data), prefix) {
+		t.Error("aof is not encrypted")
+	}
+
+	// refuse to start without the right key
+	for _, keyFile := range []string{"", newKey} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expect refusing to start without the right key")
+				}
+			}()
+			config.Properties.EncryptionKeyFile = keyFile
+			NewStandaloneServer()
+		}()
+	}
+
+	// rotate key: old files are readable by old key until rewrite
+	config.Properties.EncryptionKeyFile = newKey
+	config.Properties.EncryptionOldKeyFiles = []string{oldKey}
+	config.Properties.AofUseRdbPreamble = true
+	aofRotateDB := NewStandaloneServer()
+	validateTestData(t, aofRotateDB, 0, prefix, 10)
+	conn := &connection.FakeConn{}
+	aofRotateDB.Exec(conn, utils.ToCmdLine("SET", "a", "a"))
+	aofRotateDB.Exec(conn, utils.ToCmdLine("RewriteAOF"))
+	aofRotateDB.Exec(conn, utils.ToCmdLine("SET", "b", "b"))
+	aofRotateDB.Close()
+
+	// crashed without the final chunk and with a partial chunk at the end, the file is truncated and finished
+	incrFilename := path.Join(aofDir, "appendonly.aof.3.incr.aof")
+	info, err := os.Stat(incrFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	finalChunkSize := int64(4 + 16)
+	_ = os.Truncate(incrFilename, info.Size()-finalChunkSize)
+	file, _ := os.OpenFile(incrFilename, os.O_APPEND|os.O_WRONLY, 0600)
+	_, _ = file.Write([]byte{0, 0, 1, 0, 1, 2})
+	_ = file.Close()
+
+	config.Properties.EncryptionOldKeyFiles = nil
+	aofReadDB := NewStandaloneServer()
+	defer aofReadDB.Close()
+	validateTestData(t, aofReadDB, 0, prefix, 10)
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "a")), "a")
+	asserts.AssertBulkReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("GET", "b")), "b")
+	if truncated, _ := os.Stat(incrFilename); truncated.Size() != info.Size() {
+		t.Errorf("expect truncated to %d bytes, actually %d", info.Size(), truncated.Size())
+	}
+}
+
+func TestAofEncryptionWithoutFinalChunk(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:        true,
+		AppendDirname:     aofDir,
+		EncryptionKeyFile: writeTestKey(t, aofDir, "test.key", 1),
+	}
+	prefix := utils.RandString(8)
+	aofWriteDB := NewStandaloneServer()
+	makeTestData(aofWriteDB, 0, prefix, 10)
+	aofWriteDB.Close()
+
+	// crashed before the final chunk written, it should be loaded even if aof-load-truncated is off
+	incrFilename := path.Join(aofDir, "appendonly.aof.1.incr.aof")
+	info, err := os.Stat(incrFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	finalChunkSize := int64(4 + 16)
+	// a partial chunk is still truncation
+	_ = os.Truncate(incrFilename, info.Size()-finalChunkSize)
+	file, _ := os.OpenFile(incrFilename, os.O_APPEND|os.O_WRONLY, 0600)
+	_, _ = file.Write([]byte{0, 0, 1, 0, 1, 2})
+	_ = file.Close()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expect refusing to start with partial chunk")
+			}
+		}()
+		NewStandaloneServer()
+	}()
+
+	_ = os.Truncate(incrFilename, info.Size()-finalChunkSize)
+	aofReadDB := NewStandaloneServer()
+	validateTestData(t, aofReadDB, 0, prefix, 10)
+	aofReadDB.Exec(&connection.FakeConn{}, utils.ToCmdLine("SET", "a", "a"))
+	aofReadDB.Close()
+	if finished, _ := os.Stat(incrFilename); finished.Size() != info.Size() {
+		t.Errorf("expect final chunk appended, actually %d bytes", finished.Size())
+	}
+
+	// the file is not the last one any more
+	aofReadDB2 := NewStandaloneServer()
+	defer aofReadDB2.Close()
+	validateTestData(t, aofReadDB2, 0, prefix, 10)
+	asserts.AssertBulkReply(t, aofReadDB2.Exec(&connection.FakeConn{}, utils.ToCmdLine("GET", "a")), "a")
+}
+
+func TestLoadAofInBackground(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:    true,
+		AppendDirname: aofDir,
+	}
+	aofWriteDB := NewStandaloneServer()
+	conn0 := &connection.FakeConn{}
+	conn1 := &connection.FakeConn{}
+	conn1.SelectDB(1)
+	aofWriteDB.Exec(conn0, utils.ToCmdLine("SET", "a", "a"))
+	aofWriteDB.Exec(conn1, utils.ToCmdLine("SET", "b", "b"))
+	aofWriteDB.Exec(conn0, utils.ToCmdLine("FLUSHALL"))
+	aofWriteDB.Exec(conn1, utils.ToCmdLine("SET", "c", "c"))
+	aofWriteDB.Exec(conn0, utils.ToCmdLine("SET", "d", "d"))
+	aofWriteDB.Close()
+
+	aofReadDB := MakeStandaloneServer()
+	info := string(aofReadDB.Exec(conn0, utils.ToCmdLine("INFO", "persistence")).(*protocol.BulkReply).Arg)
+	if !strings.Contains(info, "loading:1") || !strings.Contains(info, "loading_total_bytes:") {
+		t.Errorf("expect loading progress in info, actually %s", info)
+	}
+	err = aofReadDB.Load()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer aofReadDB.Close()
+	info = string(aofReadDB.Exec(conn0, utils.ToCmdLine("INFO", "persistence")).(*protocol.BulkReply).Arg)
+	if !strings.Contains(info, "loading:0") {
+		t.Errorf("expect loading finished, actually %s", info)
+	}
+	// commands after FLUSHALL are applied in order
+	asserts.AssertIntReply(t, aofReadDB.Exec(conn0, utils.ToCmdLine("EXISTS", "a", "d")), 1)
+	asserts.AssertIntReply(t, aofReadDB.Exec(conn1, utils.ToCmdLine("EXISTS", "b", "c")), 1)
+}
+
+func TestAofTimestamp(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:          true,
+		AppendDirname:       aofDir,
+		AofChecksum:         true,
+		AofTimestampEnabled: true,
+	}
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "a"))
+	point := time.Now().Unix()
+	// wait for next second
+	time.Sleep(time.Until(time.Unix(point+1, 0)))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "b", "b"))
+	aofWriteDB.Close()
+
+	// annotations are ignored while loading
+	aofReadDB := NewStandaloneServer()
+	asserts.AssertIntReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("EXISTS", "a", "b")), 2)
+	aofReadDB.Close()
+
+	truncatePoint, err := aof.FindTimestamp(path.Join(aofDir, "appendonly.aof.manifest"), point, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = truncatePoint.Apply()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofReadDB = NewStandaloneServer()
+	defer aofReadDB.Close()
+	asserts.AssertIntReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("EXISTS", "a")), 1)
+	asserts.AssertIntReply(t, aofReadDB.Exec(conn, utils.ToCmdLine("EXISTS", "b")), 0)
+}
+
+func TestAofFailure(t *testing.T) {
+	aofDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(aofDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:    true,
+		AppendDirname: aofDir,
+		AppendFsync:   aof.FsyncAlways,
+	}
+	aofWriteDB := NewStandaloneServer()
+	defer aofWriteDB.Close()
+	conn := &connection.FakeConn{}
+	ret := aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "a"))
+	asserts.AssertStatusReply(t, ret, "OK")
+
+	// aof fails while executing the command
+	var failure error
+	for _, db := range aofWriteDB.dbSet {
+		db.aofFailure = func() error { return failure }
+		db.addAof = func(line CmdLine) { failure = errors.New("no space left on device") }
+	}
+	ret = aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "b", "b"))
+	asserts.AssertErrReply(t, ret, "MISCONF Errors writing to the AOF file: no space left on device")
+	// writes are refused after failure
+	ret = aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "c", "c"))
+	asserts.AssertErrReply(t, ret, "MISCONF Errors writing to the AOF file: no space left on device")
+	ret = aofWriteDB.Exec(conn, utils.ToCmdLine("GET", "c"))
+	asserts.AssertNullBulk(t, ret)
+	aofWriteDB.Exec(conn, utils.ToCmdLine("MULTI"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "c", "c"))
+	ret = aofWriteDB.Exec(conn, utils.ToCmdLine("EXEC"))
+	asserts.AssertErrReply(t, ret, "MISCONF Errors writing to the AOF file: no space left on device")
+	// reads are still served
+	ret = aofWriteDB.Exec(conn, utils.ToCmdLine("GET", "a"))
+	asserts.AssertBulkReply(t, ret, "a")
+}
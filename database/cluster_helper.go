@@ -89,9 +89,9 @@ func execRenameNxTo(db *DB, args [][]byte) redis.Reply {
 }
 
 func init() {
-	RegisterCommand("DumpKey", execDumpKey, writeAllKeys, undoDel, 2)
-	RegisterCommand("ExistIn", execExistIn, readAllKeys, nil, -1)
-	RegisterCommand("RenameFrom", execRenameFrom, readFirstKey, nil, 2)
+	registerReadOnlyCommand("DumpKey", execDumpKey, readAllKeys, nil, 2)
+	registerReadOnlyCommand("ExistIn", execExistIn, readAllKeys, nil, -1)
+	RegisterCommand("RenameFrom", execRenameFrom, writeFirstKey, nil, 2)
 	RegisterCommand("RenameTo", execRenameTo, writeFirstKey, rollbackFirstKey, 4)
 	RegisterCommand("RenameNxTo", execRenameTo, writeFirstKey, rollbackFirstKey, 4)
 
@@ -6,6 +6,7 @@ import (
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/encrypt"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/pubsub"
@@ -13,6 +14,8 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,46 +25,115 @@ type MultiDB struct {
 
 	// handle publish/subscribe
 	hub *pubsub.Hub
+	// handle client side caching
+	tracker *tracker
 	// handle aof persistence
 	aofHandler *aof.Handler
+	// keys for encrypting rdb files, nil if not loaded
+	keyring *encrypt.Keyring
+
+	// 1 until Load finished successfully
+	loading int32
+	// closed after Load returned
+	loaded           chan struct{}
+	loadingStartTime int64
+	loadingProgress  *aof.LoadingProgress
+
+	// unix time of the last successful rdb saving
+	lastSave int64
+	// 1 if an rdb saving is in progress
+	rdbSaving int32
+	// 1 if the last rdb saving failed
+	lastSaveFailed int32
+	// unix time of the last background saving attempt
+	lastBGSaveTry int64
+	// total dirty count of all db when the last successful saving started
+	dirtyAtLastSave int64
+	// save snapshot automatically if any save point is met
+	savePoints   []config.SavePoint
+	stopSaveCron chan struct{}
+
+	shutdownOnce sync.Once
+	// error of the final persistence
+	shutdownErr error
 }
 
-// NewStandaloneServer creates a standalone redis server, with multi database and all other funtions
+// NewStandaloneServer creates a standalone redis server, with multi database and all other funtions.
+// It blocks until the dataset was loaded and panics if loading failed
 func NewStandaloneServer() *MultiDB {
-	mdb := &MultiDB{}
+	mdb := MakeStandaloneServer()
+	err := mdb.Load()
+	if err != nil {
+		panic(err)
+	}
+	return mdb
+}
+
+// MakeStandaloneServer creates a standalone redis server in loading state, Load should be called later
+func MakeStandaloneServer() *MultiDB {
+	mdb := &MultiDB{
+		lastSave:        time.Now().Unix(),
+		loading:         1,
+		loaded:          make(chan struct{}),
+		loadingProgress: &aof.LoadingProgress{},
+	}
 	if config.Properties.Databases == 0 {
 		config.Properties.Databases = 16
 	}
+	mdb.hub = pubsub.MakeHub()
+	mdb.tracker = makeTracker(mdb.hub)
 	mdb.dbSet = make([]*DB, config.Properties.Databases)
 	for i := range mdb.dbSet {
 		singleDB := makeDB()
 		singleDB.index = i
+		singleDB.tracker = mdb.tracker
 		mdb.dbSet[i] = singleDB
 	}
-	mdb.hub = pubsub.MakeHub()
+	return mdb
+}
+
+// Load reads dataset from aof or rdb file and then starts persistence, INFO shows its progress.
+// It returns error if the dataset cannot be loaded, in which case the server should not start
+func (mdb *MultiDB) Load() error {
+	defer close(mdb.loaded)
+	atomic.StoreInt64(&mdb.loadingStartTime, time.Now().Unix())
+	keyring, err := encrypt.LoadKeyring(config.Properties.EncryptionKeyFile, config.Properties.EncryptionOldKeyFiles)
+	if err != nil {
+		return fmt.Errorf("load encryption key failed: %v", err)
+	}
+	mdb.keyring = keyring
 	validAof := false
 	if config.Properties.AppendOnly {
-		aofHandler, err := aof.NewAOFHandler(mdb, func() database.EmbedDB {
-			return MakeBasicMultiDB()
-		})
+		aofHandler, err := aof.NewAOFHandler(mdb, mdb.loadingProgress)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		mdb.aofHandler = aofHandler
 		for _, db := range mdb.dbSet {
 			// avoid closure
 			singleDB := db
 			singleDB.addAof = func(line CmdLine) {
-				mdb.aofHandler.AddAof(singleDB.index, line)
+				// error is also recorded as failure of aofHandler, see aofErrReply
+				_ = mdb.aofHandler.AddAof(singleDB.index, line)
 			}
+			singleDB.aofFailure = aofHandler.Failure
 		}
 		validAof = true
 	}
-	if config.Properties.RDBFilename != "" && !validAof {
+	if !validAof {
 		// load rdb
-		loadRdb(mdb)
+		err := loadRdb(mdb)
+		if err != nil && config.Properties.RDBLoadStrict {
+			return err
+		}
 	}
-	return mdb
+	atomic.StoreInt64(&mdb.dirtyAtLastSave, mdb.getDirty()) // loading is not a change
+	mdb.savePoints = config.Properties.SavePoints()
+	if len(mdb.savePoints) > 0 {
+		mdb.startSaveCron()
+	}
+	atomic.StoreInt32(&mdb.loading, 0)
+	return nil
 }
 
 // MakeBasicMultiDB create a MultiDB only with basic abilities for aof rewrite and other usages
@@ -89,6 +161,9 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 	if cmdName == "auth" {
 		return Auth(c, cmdLine[1:])
 	}
+	if cmdName == "hello" {
+		return Hello(c, cmdLine[1:])
+	}
 	if !isAuthenticated(c) {
 		return protocol.MakeErrReply("NOAUTH Authentication required")
 	}
@@ -108,6 +183,14 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 		return BGRewriteAOF(mdb, cmdLine[1:])
 	} else if cmdName == "rewriteaof" {
 		return RewriteAOF(mdb, cmdLine[1:])
+	} else if cmdName == "save" {
+		return Save(mdb, cmdLine[1:])
+	} else if cmdName == "bgsave" {
+		return BGSave(mdb, cmdLine[1:])
+	} else if cmdName == "lastsave" {
+		return LastSave(mdb, cmdLine[1:])
+	} else if cmdName == "info" {
+		return Info(mdb, cmdLine[1:])
 	} else if cmdName == "flushall" {
 		return mdb.flushAll()
 	} else if cmdName == "select" {
@@ -133,13 +216,12 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 // AfterClientClose does some clean after client close connection
 func (mdb *MultiDB) AfterClientClose(c redis.Connection) {
 	pubsub.UnsubscribeAll(mdb.hub, c)
+	mdb.tracker.removeClient(c)
 }
 
-// Close graceful shutdown database
+// Close graceful shutdown database, rdb is saved if save points are configured
 func (mdb *MultiDB) Close() {
-	if mdb.aofHandler != nil {
-		mdb.aofHandler.Close()
-	}
+	_ = mdb.Shutdown(ShutdownSaveDefault)
 }
 
 func execSelect(c redis.Connection, mdb *MultiDB, args [][]byte) redis.Reply {
@@ -155,11 +237,19 @@ func execSelect(c redis.Connection, mdb *MultiDB, args [][]byte) redis.Reply {
 }
 
 func (mdb *MultiDB) flushAll() redis.Reply {
+	if mdb.aofHandler != nil {
+		if err := mdb.aofHandler.Failure(); err != nil {
+			return protocol.MakeErrReply("MISCONF Errors writing to the AOF file: " + err.Error())
+		}
+	}
 	for _, db := range mdb.dbSet {
 		db.Flush()
 	}
+	mdb.tracker.invalidateAll()
 	if mdb.aofHandler != nil {
-		mdb.aofHandler.AddAof(0, utils.ToCmdLine("FlushAll"))
+		if err := mdb.aofHandler.AddAof(0, utils.ToCmdLine("FlushAll")); err != nil {
+			return protocol.MakeErrReply("MISCONF Errors writing to the AOF file: " + err.Error())
+		}
 	}
 	return &protocol.OkReply{}
 }
@@ -211,12 +301,26 @@ func (mdb *MultiDB) ExecWithLock(conn redis.Connection, cmdLine [][]byte) redis.
 
 // BGRewriteAOF asynchronously rewrites Append-Only-File
 func BGRewriteAOF(db *MultiDB, args [][]byte) redis.Reply {
-	go db.aofHandler.Rewrite()
+	if db.aofHandler == nil {
+		return protocol.MakeErrReply("ERR append only file is disabled")
+	}
+	err := db.aofHandler.BGRewrite()
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
 	return protocol.MakeStatusReply("Background append only file rewriting started")
 }
 
 // RewriteAOF start Append-Only-File rewriting and blocked until it finished
 func RewriteAOF(db *MultiDB, args [][]byte) redis.Reply {
-	db.aofHandler.Rewrite()
+	if db.aofHandler == nil {
+		return protocol.MakeErrReply("ERR append only file is disabled")
+	}
+	err := db.aofHandler.Rewrite()
+	if err == aof.ErrRewriteInProgress {
+		return protocol.MakeErrReply(err.Error())
+	} else if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
 	return protocol.MakeStatusReply("Background append only file rewriting started")
 }
@@ -161,7 +161,7 @@ func execGeoHash(db *DB, args [][]byte) redis.Reply {
 		member := string(args[i+1])
 		elem, exists := sortedSet.Get(member)
 		if !exists {
-			strs[i] = (&protocol.EmptyMultiBulkReply{}).ToBytes()
+			strs[i] = nil
 			continue
 		}
 		str := geohash.ToString(geohash.FromInt(uint64(elem.Score)))
@@ -263,9 +263,9 @@ func geoRadius0(sortedSet *sortedset.SortedSet, lat float64, lng float64, radius
 
 func init() {
 	RegisterCommand("GeoAdd", execGeoAdd, writeFirstKey, undoGeoAdd, -5)
-	RegisterCommand("GeoPos", execGeoPos, readFirstKey, nil, -2)
-	RegisterCommand("GeoDist", execGeoDist, readFirstKey, nil, -4)
-	RegisterCommand("GeoHash", execGeoHash, readFirstKey, nil, -2)
-	RegisterCommand("GeoRadius", execGeoRadius, readFirstKey, nil, -6)
-	RegisterCommand("GeoRadiusByMember", execGeoRadiusByMember, readFirstKey, nil, -5)
+	registerReadOnlyCommand("GeoPos", execGeoPos, readFirstKey, nil, -2)
+	registerReadOnlyCommand("GeoDist", execGeoDist, readFirstKey, nil, -4)
+	registerReadOnlyCommand("GeoHash", execGeoHash, readFirstKey, nil, -2)
+	registerReadOnlyCommand("GeoRadius", execGeoRadius, readFirstKey, nil, -6)
+	registerReadOnlyCommand("GeoRadiusByMember", execGeoRadiusByMember, readFirstKey, nil, -5)
 }
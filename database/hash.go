@@ -312,20 +312,17 @@ func execHGetAll(db *DB, args [][]byte) redis.Reply {
 		return errReply
 	}
 	if dict == nil {
-		return &protocol.EmptyMultiBulkReply{}
+		return protocol.MakeMapReply(nil)
 	}
 
 	size := dict.Len()
-	result := make([][]byte, size*2)
-	i := 0
+	result := make([]redis.Reply, 0, size*2)
 	dict.ForEach(func(key string, val interface{}) bool {
-		result[i] = []byte(key)
-		i++
-		result[i], _ = val.([]byte)
-		i++
+		value, _ := val.([]byte)
+		result = append(result, protocol.MakeBulkReply([]byte(key)), protocol.MakeBulkReply(value))
 		return true
 	})
-	return protocol.MakeMultiBulkReply(result[:i])
+	return protocol.MakeMapReply(result)
 }
 
 // execHIncrBy increments the integer value of a hash field by the given number
@@ -401,16 +398,16 @@ func execHIncrByFloat(db *DB, args [][]byte) redis.Reply {
 func init() {
 	RegisterCommand("HSet", execHSet, writeFirstKey, undoHSet, 4)
 	RegisterCommand("HSetNX", execHSetNX, writeFirstKey, undoHSet, 4)
-	RegisterCommand("HGet", execHGet, readFirstKey, nil, 3)
-	RegisterCommand("HExists", execHExists, readFirstKey, nil, 3)
+	registerReadOnlyCommand("HGet", execHGet, readFirstKey, nil, 3)
+	registerReadOnlyCommand("HExists", execHExists, readFirstKey, nil, 3)
 	RegisterCommand("HDel", execHDel, writeFirstKey, undoHDel, -3)
-	RegisterCommand("HLen", execHLen, readFirstKey, nil, 2)
+	registerReadOnlyCommand("HLen", execHLen, readFirstKey, nil, 2)
 	RegisterCommand("HMSet", execHMSet, writeFirstKey, undoHMSet, -4)
-	RegisterCommand("HMGet", execHMGet, readFirstKey, nil, -3)
-	RegisterCommand("HGet", execHGet, readFirstKey, nil, -3)
-	RegisterCommand("HKeys", execHKeys, readFirstKey, nil, 2)
-	RegisterCommand("HVals", execHVals, readFirstKey, nil, 2)
-	RegisterCommand("HGetAll", execHGetAll, readFirstKey, nil, 2)
+	registerReadOnlyCommand("HMGet", execHMGet, readFirstKey, nil, -3)
+	registerReadOnlyCommand("HGet", execHGet, readFirstKey, nil, -3)
+	registerReadOnlyCommand("HKeys", execHKeys, readFirstKey, nil, 2)
+	registerReadOnlyCommand("HVals", execHVals, readFirstKey, nil, 2)
+	registerReadOnlyCommand("HGetAll", execHGetAll, readFirstKey, nil, 2)
 	RegisterCommand("HIncrBy", execHIncrBy, writeFirstKey, undoHIncr, 4)
 	RegisterCommand("HIncrByFloat", execHIncrByFloat, writeFirstKey, undoHIncr, 4)
 }
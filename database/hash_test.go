@@ -122,16 +122,16 @@ func TestHGetAll(t *testing.T) {
 
 	// test HGetAll
 	result := testDB.Exec(nil, utils.ToCmdLine("hgetall", key))
-	multiBulk, ok := result.(*protocol.MultiBulkReply)
+	mapReply, ok := result.(*protocol.MapReply)
 	if !ok {
-		t.Error(fmt.Sprintf("expected MultiBulkReply, actually %s", string(result.ToBytes())))
+		t.Error(fmt.Sprintf("expected MapReply, actually %s", string(result.ToBytes())))
 	}
-	if 2*len(fields) != len(multiBulk.Args) {
-		t.Error(fmt.Sprintf("expected %d items , actually %d ", 2*len(fields), len(multiBulk.Args)))
+	if 2*len(fields) != len(mapReply.Args) {
+		t.Error(fmt.Sprintf("expected %d items , actually %d ", 2*len(fields), len(mapReply.Args)))
 	}
 	for i := range fields {
-		field := string(multiBulk.Args[2*i])
-		actual := string(multiBulk.Args[2*i+1])
+		field := string(mapReply.Args[2*i].(*protocol.BulkReply).Arg)
+		actual := string(mapReply.Args[2*i+1].(*protocol.BulkReply).Arg)
 		expected, ok := valueMap[field]
 		if !ok {
 			t.Error(fmt.Sprintf("unexpected field %s", field))
@@ -144,7 +144,7 @@ func TestHGetAll(t *testing.T) {
 
 	// test HKeys
 	result = testDB.Exec(nil, utils.ToCmdLine("hkeys", key))
-	multiBulk, ok = result.(*protocol.MultiBulkReply)
+	multiBulk, ok := result.(*protocol.MultiBulkReply)
 	if !ok {
 		t.Error(fmt.Sprintf("expected MultiBulkReply, actually %s", string(result.ToBytes())))
 	}
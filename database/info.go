@@ -0,0 +1,118 @@
+package database
+
+import (
+	"fmt"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// infoSection generates content of an INFO section
+type infoSection struct {
+	name string
+	gen  func(mdb *MultiDB) []string
+}
+
+var infoSections = []*infoSection{
+	{name: "persistence", gen: persistenceInfo},
+}
+
+// Info returns information and statistics about the server
+func Info(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) > 1 {
+		return protocol.MakeArgNumErrReply("info")
+	}
+	section := "default"
+	if len(args) == 1 {
+		section = strings.ToLower(string(args[0]))
+	}
+	var builder strings.Builder
+	for _, s := range infoSections {
+		if section != "default" && section != "all" && section != s.name {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString(protocol.CRLF)
+		}
+		builder.WriteString("# " + strings.Title(s.name) + protocol.CRLF)
+		for _, line := range s.gen(mdb) {
+			builder.WriteString(line + protocol.CRLF)
+		}
+	}
+	return protocol.MakeBulkReply([]byte(builder.String()))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func persistenceInfo(mdb *MultiDB) []string {
+	lastSaveStatus := "ok"
+	if atomic.LoadInt32(&mdb.lastSaveFailed) == 1 {
+		lastSaveStatus = "err"
+	}
+	loading := atomic.LoadInt32(&mdb.loading) == 1
+	lines := []string{
+		fmt.Sprintf("loading:%d", boolToInt(loading)),
+	}
+	if loading {
+		lines = append(lines, loadingInfo(mdb)...)
+	}
+	lines = append(lines,
+		fmt.Sprintf("rdb_changes_since_last_save:%d", mdb.getDirty()-atomic.LoadInt64(&mdb.dirtyAtLastSave)),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", atomic.LoadInt32(&mdb.rdbSaving)),
+		fmt.Sprintf("rdb_last_save_time:%d", atomic.LoadInt64(&mdb.lastSave)),
+		"rdb_last_bgsave_status:"+lastSaveStatus,
+		fmt.Sprintf("aof_enabled:%d", boolToInt(config.Properties.AppendOnly)),
+	)
+	// aof handler is created during loading
+	if !loading && mdb.aofHandler != nil {
+		stats := mdb.aofHandler.GetFsyncStats()
+		currentSize, baseSize := mdb.aofHandler.GetSize()
+		aofWriteStatus := "ok"
+		if mdb.aofHandler.Failure() != nil {
+			aofWriteStatus = "err"
+		}
+		lines = append(lines,
+			fmt.Sprintf("aof_rewrite_in_progress:%d", boolToInt(mdb.aofHandler.IsRewriting())),
+			fmt.Sprintf("aof_current_size:%d", currentSize),
+			fmt.Sprintf("aof_base_size:%d", baseSize),
+			"aof_last_write_status:"+aofWriteStatus,
+			"aof_fsync:"+mdb.aofHandler.GetFsyncPolicy(),
+			fmt.Sprintf("aof_fsync_count:%d", stats.Count),
+			fmt.Sprintf("aof_last_fsync_latency_us:%d", stats.LastLatency/int64(time.Microsecond)),
+			fmt.Sprintf("aof_max_fsync_latency_us:%d", stats.MaxLatency/int64(time.Microsecond)),
+			fmt.Sprintf("aof_avg_fsync_latency_us:%d", stats.AvgLatency/int64(time.Microsecond)),
+			fmt.Sprintf("aof_fsync_lag_ms:%d", stats.Lag/int64(time.Millisecond)),
+		)
+	}
+	return lines
+}
+
+func loadingInfo(mdb *MultiDB) []string {
+	startTime := atomic.LoadInt64(&mdb.loadingStartTime)
+	loaded, total := mdb.loadingProgress.Get()
+	perc := 0.0
+	if total > 0 {
+		perc = float64(loaded) * 100 / float64(total)
+	}
+	// estimate remaining time by average speed
+	var eta int64
+	elapsed := time.Now().Unix() - startTime
+	if loaded > 0 && total > loaded {
+		eta = elapsed * (total - loaded) / loaded
+	}
+	return []string{
+		fmt.Sprintf("loading_start_time:%d", startTime),
+		fmt.Sprintf("loading_total_bytes:%d", total),
+		fmt.Sprintf("loading_loaded_bytes:%d", loaded),
+		fmt.Sprintf("loading_loaded_perc:%.2f", perc),
+		fmt.Sprintf("loading_eta_seconds:%d", eta),
+	}
+}
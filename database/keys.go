@@ -52,6 +52,7 @@ func execExists(db *DB, args [][]byte) redis.Reply {
 // execFlushDB removes all data in current db
 func execFlushDB(db *DB, args [][]byte) redis.Reply {
 	db.Flush()
+	db.tracker.invalidateAll()
 	db.addAof(utils.ToCmdLine3("flushdb", args...))
 	return &protocol.OkReply{}
 }
@@ -78,10 +79,11 @@ func execType(db *DB, args [][]byte) redis.Reply {
 	return &protocol.UnknownErrReply{}
 }
 
+// prepareRename declares src as write key too, since rename removes it
 func prepareRename(args [][]byte) ([]string, []string) {
 	src := string(args[0])
 	dest := string(args[1])
-	return []string{dest}, []string{src}
+	return []string{src, dest}, nil
 }
 
 // execRename a key
@@ -314,12 +316,12 @@ func init() {
 	RegisterCommand("ExpireAt", execExpireAt, writeFirstKey, undoExpire, 3)
 	RegisterCommand("PExpire", execPExpire, writeFirstKey, undoExpire, 3)
 	RegisterCommand("PExpireAt", execPExpireAt, writeFirstKey, undoExpire, 3)
-	RegisterCommand("TTL", execTTL, readFirstKey, nil, 2)
-	RegisterCommand("PTTL", execPTTL, readFirstKey, nil, 2)
+	registerReadOnlyCommand("TTL", execTTL, readFirstKey, nil, 2)
+	registerReadOnlyCommand("PTTL", execPTTL, readFirstKey, nil, 2)
 	RegisterCommand("Persist", execPersist, writeFirstKey, undoExpire, 2)
-	RegisterCommand("Exists", execExists, readAllKeys, nil, -2)
-	RegisterCommand("Type", execType, readFirstKey, nil, 2)
+	registerReadOnlyCommand("Exists", execExists, readAllKeys, nil, -2)
+	registerReadOnlyCommand("Type", execType, readFirstKey, nil, 2)
 	RegisterCommand("Rename", execRename, prepareRename, undoRename, 3)
 	RegisterCommand("RenameNx", execRenameNx, prepareRename, undoRename, 3)
-	RegisterCommand("Keys", execKeys, noPrepare, nil, 2)
+	registerReadOnlyCommand("Keys", execKeys, noPrepare, nil, 2)
 }
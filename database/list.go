@@ -513,8 +513,8 @@ func init() {
 	RegisterCommand("RPop", execRPop, writeFirstKey, undoRPop, 2)
 	RegisterCommand("RPopLPush", execRPopLPush, prepareRPopLPush, undoRPopLPush, 3)
 	RegisterCommand("LRem", execLRem, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("LLen", execLLen, readFirstKey, nil, 2)
-	RegisterCommand("LIndex", execLIndex, readFirstKey, nil, 3)
+	registerReadOnlyCommand("LLen", execLLen, readFirstKey, nil, 2)
+	registerReadOnlyCommand("LIndex", execLIndex, readFirstKey, nil, 3)
 	RegisterCommand("LSet", execLSet, writeFirstKey, undoLSet, 4)
-	RegisterCommand("LRange", execLRange, readFirstKey, nil, 4)
+	registerReadOnlyCommand("LRange", execLRange, readFirstKey, nil, 4)
 }
@@ -0,0 +1,35 @@
+package database
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Expiration is paused by CLIENT PAUSE, so that dataset would not change during failover.
+
+// PauseExpiration keeps expired keys of all dbs until the given time, they are invisible to commands but not removed
+func (mdb *MultiDB) PauseExpiration(until time.Time) {
+	for _, db := range mdb.dbSet {
+		atomic.StoreInt64(&db.expirationPausedUntil, until.UnixNano())
+	}
+}
+
+// ResumeExpiration removes expired keys again
+func (mdb *MultiDB) ResumeExpiration() {
+	for _, db := range mdb.dbSet {
+		atomic.StoreInt64(&db.expirationPausedUntil, 0)
+	}
+}
+
+// getExpirationPause returns the end of pause if expiration is paused now
+func (db *DB) getExpirationPause() (time.Time, bool) {
+	until := atomic.LoadInt64(&db.expirationPausedUntil)
+	if until == 0 {
+		return time.Time{}, false
+	}
+	end := time.Unix(0, until)
+	if !time.Now().Before(end) {
+		return time.Time{}, false
+	}
+	return end, true
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+	"time"
+)
+
+func TestIsReadOnlyCommand(t *testing.T) {
+	if !IsReadOnlyCommand("GET") || !IsReadOnlyCommand("zrangebyscore") {
+		t.Error("get and zrangebyscore should be read only")
+	}
+	if IsReadOnlyCommand("set") || IsReadOnlyCommand("expire") {
+		t.Error("set and expire should not be read only")
+	}
+	if IsReadOnlyCommand("no-such-command") {
+		t.Error("unknown command should not be read only")
+	}
+}
+
+func TestPauseExpiration(t *testing.T) {
+	testServer.Exec(nil, utils.ToCmdLine("flushall"))
+	testDB.Flush()
+	conn := &connection.FakeConn{}
+	db := testServer.selectDB(0)
+	key := utils.RandString(10)
+	testServer.Exec(conn, utils.ToCmdLine("set", key, "1", "px", "100"))
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "1", "px", "100"))
+	testServer.PauseExpiration(time.Now().Add(time.Minute))
+	time.Sleep(200 * time.Millisecond)
+	result := testServer.Exec(conn, utils.ToCmdLine("get", key))
+	asserts.AssertNullBulk(t, result)
+	// expired key is invisible but kept during pause
+	if _, ok := db.data.Get(key); !ok {
+		t.Error("expired key should not be removed during pause")
+	}
+	// other databases are not paused
+	testDB.Exec(nil, utils.ToCmdLine("get", key))
+	if _, ok := testDB.data.Get(key); ok {
+		t.Error("expired key of other database should be removed")
+	}
+
+	testServer.ResumeExpiration()
+	result = testServer.Exec(conn, utils.ToCmdLine("get", key))
+	asserts.AssertNullBulk(t, result)
+	if _, ok := db.data.Get(key); ok {
+		t.Error("expired key should be removed after pause")
+	}
+}
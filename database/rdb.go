@@ -1,65 +1,376 @@
 package database
 
 import (
+	"bufio"
+	"fmt"
+	"github.com/hdt3213/godis/aof"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/datastruct/dict"
 	List "github.com/hdt3213/godis/datastruct/list"
+	"github.com/hdt3213/godis/datastruct/set"
 	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
 	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/encrypt"
 	"github.com/hdt3213/godis/lib/logger"
+	rdbDecoder "github.com/hdt3213/godis/lib/rdb"
+	"github.com/hdt3213/godis/lib/sync/partition"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/rdb/core"
 	rdb "github.com/hdt3213/rdb/parser"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-func loadRdb(mdb *MultiDB) {
-	rdbFile, err := os.Open(config.Properties.RDBFilename)
+const (
+	defaultRDBFilename = "dump.rdb"
+	// number of objects queued for each db while loading
+	rdbLoadingQueueSize = 1 << 10
+)
+
+// rdbLoadStats summarizes the result of loading rdb file
+type rdbLoadStats struct {
+	loaded  map[string]int // object type -> count
+	expired int
+	skipped int
+}
+
+func (stats *rdbLoadStats) String() string {
+	types := make([]string, 0, len(stats.loaded))
+	total := 0
+	for typ, count := range stats.loaded {
+		types = append(types, typ+": "+strconv.Itoa(count))
+		total += count
+	}
+	sort.Strings(types)
+	return fmt.Sprintf("%d keys loaded (%s), %d expired keys dropped, %d keys skipped",
+		total, strings.Join(types, ", "), stats.expired, stats.skipped)
+}
+
+// loadRdb loads rdb file into mdb, objects before a corruption are kept.
+// Objects of unsupported types are skipped unless rdb-load-strict is set.
+// It returns error if the file cannot be parsed completely
+func loadRdb(mdb *MultiDB) error {
+	rdbFile, err := os.Open(getRDBFilename())
 	if err != nil {
-		logger.Error("open rdb file failed")
-		return
+		if os.IsNotExist(err) {
+			logger.Info("rdb file not found, start with empty dataset")
+			return nil
+		}
+		return fmt.Errorf("open rdb file failed: %v", err)
 	}
 	defer func() {
 		_ = rdbFile.Close()
 	}()
-	decoder := rdb.NewDecoder(rdbFile)
-	err = decoder.Parse(func(o rdb.RedisObject) bool {
-		db := mdb.selectDB(o.GetDBIndex())
-		switch o.GetType() {
-		case rdb.StringType:
-			str := o.(*rdb.StringObject)
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: str.Value,
-			})
-		case rdb.ListType:
-			listObj := o.(*rdb.ListObject)
-			list := &List.LinkedList{}
-			for _, v := range listObj.Values {
-				list.Add(v)
+	if fileInfo, err := rdbFile.Stat(); err == nil {
+		mdb.loadingProgress.AddTotal(fileInfo.Size())
+	}
+	reader, err := encrypt.WrapReader(bufio.NewReader(mdb.loadingProgress.Reader(rdbFile)), mdb.keyring)
+	if err != nil {
+		return fmt.Errorf("read rdb file failed: %v", err)
+	}
+	err = mdb.LoadRDB(rdbDecoder.NewDecoder(reader, config.Properties.RDBLoadStrict))
+	if err != nil {
+		return err
+	}
+	if _, ok := reader.(*encrypt.Reader); ok {
+		// encrypted file without the final chunk is truncated
+		_, err = io.Copy(ioutil.Discard, reader)
+		if err != nil {
+			return fmt.Errorf("read rdb file failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// LoadRDB loads objects from rdb decoder into mdb, it is also used to load the rdb base file of aof.
+// Objects are decoded in one goroutine and put into different db in parallel.
+func (mdb *MultiDB) LoadRDB(decoder *core.Decoder) error {
+	stats := &rdbLoadStats{
+		loaded: make(map[string]int),
+	}
+	// dbStats[i] is used by the worker of db i only
+	dbStats := make([]*rdbLoadStats, len(mdb.dbSet))
+	for i := range dbStats {
+		dbStats[i] = &rdbLoadStats{
+			loaded: make(map[string]int),
+		}
+	}
+	executor := partition.NewExecutor(len(mdb.dbSet), rdbLoadingQueueSize)
+	now := time.Now()
+	err := decoder.Parse(func(o rdb.RedisObject) bool {
+		if o.GetDBIndex() >= len(mdb.dbSet) {
+			logger.Warn(fmt.Sprintf("skip key %s: db index %d is out of range", o.GetKey(), o.GetDBIndex()))
+			stats.skipped++
+			return true
+		}
+		if o.GetExpiration() != nil && o.GetExpiration().Before(now) {
+			stats.expired++
+			return true
+		}
+		executor.Submit(o.GetDBIndex(), func() {
+			dbStat := dbStats[o.GetDBIndex()]
+			entity := rdbObjectToEntity(o)
+			if entity == nil {
+				logger.Warn(fmt.Sprintf("skip key %s: unsupported type %s", o.GetKey(), o.GetType()))
+				dbStat.skipped++
+				return
 			}
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: list,
-			})
-		case rdb.HashType:
-			hashObj := o.(*rdb.HashObject)
-			hash := dict.MakeSimple()
-			for k, v := range hashObj.Hash {
-				hash.Put(k, v)
+			db := mdb.selectDB(o.GetDBIndex())
+			db.PutEntity(o.GetKey(), entity)
+			if o.GetExpiration() != nil {
+				db.Expire(o.GetKey(), *o.GetExpiration())
 			}
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: hash,
-			})
-		case rdb.ZSetType:
-			zsetObj := o.(*rdb.ZSetObject)
-			zSet := SortedSet.Make()
-			for _, e := range zsetObj.Entries {
-				zSet.Add(e.Member, e.Score)
+			dbStat.loaded[o.GetType()]++
+		})
+		return true
+	})
+	executor.Close()
+	for _, dbStat := range dbStats {
+		stats.skipped += dbStat.skipped
+		for typ, count := range dbStat.loaded {
+			stats.loaded[typ] += count
+		}
+	}
+	if err != nil {
+		// the decoder cannot skip unknown objects such as streams and modules, so the rest of file is lost
+		logger.Error("rdb file is corrupted or contains unsupported types: " + err.Error())
+		logger.Error("rdb loading stopped, " + stats.String())
+		return fmt.Errorf("load rdb failed: %v", err)
+	}
+	logger.Info("rdb loaded, " + stats.String())
+	return nil
+}
+
+func rdbObjectToEntity(o rdb.RedisObject) *database.DataEntity {
+	switch o.GetType() {
+	case rdb.StringType:
+		str := o.(*rdb.StringObject)
+		return &database.DataEntity{
+			Data: str.Value,
+		}
+	case rdb.ListType:
+		listObj := o.(*rdb.ListObject)
+		list := &List.LinkedList{}
+		for _, v := range listObj.Values {
+			list.Add(v)
+		}
+		return &database.DataEntity{
+			Data: list,
+		}
+	case rdb.HashType:
+		hashObj := o.(*rdb.HashObject)
+		hash := dict.MakeSimple()
+		for k, v := range hashObj.Hash {
+			hash.Put(k, v)
+		}
+		return &database.DataEntity{
+			Data: hash,
+		}
+	case rdb.SetType:
+		setObj := o.(*rdb.SetObject)
+		s := set.Make()
+		for _, m := range setObj.Members {
+			s.Add(string(m))
+		}
+		return &database.DataEntity{
+			Data: s,
+		}
+	case rdb.ZSetType:
+		zsetObj := o.(*rdb.ZSetObject)
+		zSet := SortedSet.Make()
+		for _, e := range zsetObj.Entries {
+			zSet.Add(e.Member, e.Score)
+		}
+		return &database.DataEntity{
+			Data: zSet,
+		}
+	}
+	return nil
+}
+
+func getRDBFilename() string {
+	if config.Properties.RDBFilename == "" {
+		return defaultRDBFilename
+	}
+	return config.Properties.RDBFilename
+}
+
+// saveRdb writes a point-in-time snapshot of all databases into filename without stopping writes
+func (mdb *MultiDB) saveRdb(filename string) error {
+	dir := filepath.Dir(filename)
+	tmpFile, err := ioutil.TempFile(dir, "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name()) // no-op if renamed
+	}()
+
+	fileWriter, err := encrypt.WrapWriter(tmpFile, mdb.keyring.Current())
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(fileWriter)
+	snap := mdb.Snapshot(nil)
+	defer snap.Release()
+	err = aof.DumpRDB(writer, snap, len(mdb.dbSet))
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	err = fileWriter.Close()
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+// save dumps rdb file and updates lastSave, invoker should set rdbSaving flag
+func (mdb *MultiDB) save() error {
+	filename := getRDBFilename()
+	dirty := mdb.getDirty()
+	err := mdb.saveRdb(filename)
+	if err != nil {
+		atomic.StoreInt32(&mdb.lastSaveFailed, 1)
+		logger.Error("save rdb failed: " + err.Error())
+		return err
+	}
+	atomic.StoreInt32(&mdb.lastSaveFailed, 0)
+	atomic.StoreInt64(&mdb.dirtyAtLastSave, dirty)
+	atomic.StoreInt64(&mdb.lastSave, time.Now().Unix())
+	logger.Info("DB saved on disk: " + filename)
+	return nil
+}
+
+// bgSave starts saving in background, returns false if another saving is in progress
+func (mdb *MultiDB) bgSave() bool {
+	if !atomic.CompareAndSwapInt32(&mdb.rdbSaving, 0, 1) {
+		return false
+	}
+	atomic.StoreInt64(&mdb.lastBGSaveTry, time.Now().Unix())
+	go func() {
+		defer atomic.StoreInt32(&mdb.rdbSaving, 0)
+		_ = mdb.save()
+	}()
+	return true
+}
+
+// getDirty returns number of write commands executed in all db
+func (mdb *MultiDB) getDirty() int64 {
+	var dirty int64
+	for _, db := range mdb.dbSet {
+		dirty += atomic.LoadInt64(&db.dirty)
+	}
+	return dirty
+}
+
+const (
+	saveCronInterval = time.Second
+	// if the last saving failed, wait a while before retrying
+	saveRetryDelay = 5
+)
+
+func (mdb *MultiDB) startSaveCron() {
+	mdb.stopSaveCron = make(chan struct{})
+	ticker := time.NewTicker(saveCronInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mdb.checkSavePoints()
+			case <-mdb.stopSaveCron:
+				return
 			}
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: zSet,
-			})
 		}
-		if o.GetExpiration() != nil {
-			db.Expire(o.GetKey(), *o.GetExpiration())
+	}()
+}
+
+// checkSavePoints starts background saving if any save point is met
+func (mdb *MultiDB) checkSavePoints() {
+	now := time.Now().Unix()
+	changes := mdb.getDirty() - atomic.LoadInt64(&mdb.dirtyAtLastSave)
+	elapsed := now - atomic.LoadInt64(&mdb.lastSave)
+	if atomic.LoadInt32(&mdb.lastSaveFailed) == 1 &&
+		now-atomic.LoadInt64(&mdb.lastBGSaveTry) <= saveRetryDelay {
+		return
+	}
+	for _, point := range mdb.savePoints {
+		if changes >= point.Changes && elapsed >= point.Seconds {
+			if mdb.bgSave() {
+				logger.Info(fmt.Sprintf("%d changes in %d seconds. Saving...", point.Changes, point.Seconds))
+			}
+			return
 		}
-		return true
-	})
+	}
+}
+
+// waitSaving waits for running saving and then sets rdbSaving flag
+func (mdb *MultiDB) waitSaving() {
+	for !atomic.CompareAndSwapInt32(&mdb.rdbSaving, 0, 1) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// saveBeforeShutdown waits for running saving and then saves the final snapshot
+func (mdb *MultiDB) saveBeforeShutdown() error {
+	mdb.waitSaving()
+	// keep rdbSaving flag to refuse further saving
+	logger.Info("saving the final RDB snapshot before exiting")
+	return mdb.save()
+}
+
+// Save synchronously saves the dataset to rdb file
+func Save(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("save")
+	}
+	if !atomic.CompareAndSwapInt32(&mdb.rdbSaving, 0, 1) {
+		return protocol.MakeErrReply("ERR Background save already in progress")
+	}
+	defer atomic.StoreInt32(&mdb.rdbSaving, 0)
+	err := mdb.save()
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+// BGSave asynchronously saves the dataset to rdb file
+func BGSave(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("bgsave")
+	}
+	if !mdb.bgSave() {
+		return protocol.MakeErrReply("ERR Background save already in progress")
+	}
+	return protocol.MakeStatusReply("Background saving started")
+}
+
+// LastSave returns unix time of the last successful save
+func LastSave(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("lastsave")
+	}
+	return protocol.MakeIntReply(atomic.LoadInt64(&mdb.lastSave))
 }
@@ -1,13 +1,23 @@
 package database
 
 import (
+	"bytes"
 	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/encrypt"
+	rdbEncoder "github.com/hdt3213/godis/lib/rdb"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
+	rdb "github.com/hdt3213/rdb/parser"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestLoadRDB(t *testing.T) {
@@ -29,6 +39,8 @@ func TestLoadRDB(t *testing.T) {
 	asserts.AssertMultiBulkReply(t, result, []string{"1", "1"})
 	result = rdbDB.Exec(conn, utils.ToCmdLine("ZRange", "zset", "0", "1", "WITHSCORES"))
 	asserts.AssertMultiBulkReply(t, result, []string{"1", "1"})
+	result = rdbDB.Exec(conn, utils.ToCmdLine("SCard", "set"))
+	asserts.AssertIntReplyGreaterThan(t, result, 0)
 
 	config.Properties = &config.ServerProperties{
 		AppendOnly:  false,
@@ -38,3 +50,312 @@ func TestLoadRDB(t *testing.T) {
 	result = rdbDB.Exec(conn, utils.ToCmdLine("Get", "str"))
 	asserts.AssertNullBulk(t, result)
 }
+
+func TestLoadRDBExpiration(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := rdbEncoder.NewEncoder(&buf)
+	expiration := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+	write := func(f func() error) {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(encoder.WriteHeader)
+	write(func() error { return encoder.WriteSelectDB(0) })
+	write(func() error { return encoder.WriteStringObject("ttl", []byte("1"), &expiration) })
+	// expiration of the previous key should not be inherited
+	write(func() error { return encoder.WriteStringObject("persist", []byte("2"), nil) })
+	write(func() error { return encoder.WriteStringObject("expired", []byte("3"), &past) })
+	write(func() error { return encoder.WriteStringObject("persist2", []byte("4"), nil) })
+	// lfu frequency is followed by type of object
+	write(func() error {
+		_, err := encoder.Write([]byte{0xF9, 5})
+		return err
+	})
+	write(func() error { return encoder.WriteStringObject("lfu", []byte("5"), nil) })
+	write(encoder.WriteEnd)
+
+	config.Properties = &config.ServerProperties{}
+	mdb := MakeStandaloneServer()
+	if err := mdb.LoadRDB(rdbEncoder.NewDecoder(&buf, true)); err != nil {
+		t.Fatal(err)
+	}
+	conn := &connection.FakeConn{}
+	asserts.AssertIntReplyGreaterThan(t, mdb.Exec(conn, utils.ToCmdLine("TTL", "ttl")), 0)
+	for key, value := range map[string]string{"persist": "2", "persist2": "4", "lfu": "5"} {
+		asserts.AssertBulkReply(t, mdb.Exec(conn, utils.ToCmdLine("Get", key)), value)
+		asserts.AssertIntReply(t, mdb.Exec(conn, utils.ToCmdLine("TTL", key)), -1)
+	}
+	asserts.AssertNullBulk(t, mdb.Exec(conn, utils.ToCmdLine("Get", "expired")))
+}
+
+func TestSaveRDB(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	rdbFilename := filepath.Join(tmpDir, "dump.rdb")
+	config.Properties = &config.ServerProperties{
+		RDBFilename: rdbFilename,
+	}
+	conn := &connection.FakeConn{}
+	writeDB := NewStandaloneServer()
+	prefix := utils.RandString(8)
+	makeTestData(writeDB, 0, prefix, 10)
+	makeTestData(writeDB, 1, prefix, 10)
+	before := writeDB.Exec(conn, utils.ToCmdLine("LastSave")).(*protocol.IntReply).Code
+	time.Sleep(time.Second) // LastSave is in seconds
+	result := writeDB.Exec(conn, utils.ToCmdLine("Save"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = writeDB.Exec(conn, utils.ToCmdLine("LastSave"))
+	asserts.AssertIntReplyGreaterThan(t, result, int(before)+1)
+
+	// every key should be dumped, including sets
+	file, err := os.Open(rdbFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	counts := make(map[string]int)
+	err = rdbEncoder.NewDecoder(file, true).Parse(func(o rdb.RedisObject) bool {
+		counts[o.GetType()]++
+		if o.GetType() == rdb.StringType && o.GetExpiration() == nil {
+			t.Errorf("expiration of %s is missing", o.GetKey())
+		}
+		if o.GetType() != rdb.StringType && o.GetExpiration() != nil {
+			t.Errorf("unexpected expiration of %s", o.GetKey())
+		}
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, typ := range []string{rdb.StringType, rdb.ListType, rdb.HashType, rdb.SetType, rdb.ZSetType} {
+		if counts[typ] != 20 {
+			t.Errorf("expect 20 %s objects, actually %d", typ, counts[typ])
+		}
+	}
+
+	readDB := NewStandaloneServer()
+	validateTestData(t, readDB, 0, prefix, 10)
+	validateTestData(t, readDB, 1, prefix, 10)
+}
+
+func TestLoadCorruptedRDB(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	rdbFilename := filepath.Join(tmpDir, "dump.rdb")
+	config.Properties = &config.ServerProperties{
+		RDBFilename: rdbFilename,
+	}
+	conn := &connection.FakeConn{}
+	writeDB := NewStandaloneServer()
+	writeDB.Exec(conn, utils.ToCmdLine("Set", "a", utils.RandString(100)))
+	writeDB.Exec(conn, utils.ToCmdLine("RPush", "list", utils.RandString(100)))
+	writeDB.Exec(conn, utils.ToCmdLine("Save"))
+
+	// truncate in the middle of the last object
+	data, err := ioutil.ReadFile(rdbFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = ioutil.WriteFile(rdbFilename, data[:len(data)-20], 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	readDB := NewStandaloneServer()
+	result := readDB.Exec(conn, utils.ToCmdLine("Exists", "a", "list"))
+	asserts.AssertIntReply(t, result, 1)
+
+	config.Properties.RDBLoadStrict = true
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("expect panic in strict mode")
+		}
+	}()
+	NewStandaloneServer()
+}
+
+func TestEncryptedRDB(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	rdbFilename := filepath.Join(tmpDir, "dump.rdb")
+	config.Properties = &config.ServerProperties{
+		RDBFilename:       rdbFilename,
+		RDBLoadStrict:     true,
+		EncryptionKeyFile: writeTestKey(t, tmpDir, "test.key", 1),
+	}
+	writeDB := NewStandaloneServer()
+	prefix := utils.RandString(8)
+	makeTestData(writeDB, 0, prefix, 10)
+	writeDB.Exec(&connection.FakeConn{}, utils.ToCmdLine("Save"))
+	data, _ := ioutil.ReadFile(rdbFilename)
+	if !strings.HasPrefix(string(data), encrypt.Magic) || strings.Contains(string(data), prefix) {
+		t.Error("rdb is not encrypted")
+	}
+
+	readDB := NewStandaloneServer()
+	validateTestData(t, readDB, 0, prefix, 10)
+
+	config.Properties.EncryptionKeyFile = writeTestKey(t, tmpDir, "wrong.key", 2)
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("expect panic with wrong key")
+		}
+	}()
+	NewStandaloneServer()
+}
+
+func TestBGSave(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	rdbFilename := filepath.Join(tmpDir, "dump.rdb")
+	config.Properties = &config.ServerProperties{
+		RDBFilename: rdbFilename,
+	}
+	conn := &connection.FakeConn{}
+	writeDB := NewStandaloneServer()
+	writeDB.Exec(conn, utils.ToCmdLine("Set", "a", "a"))
+	result := writeDB.Exec(conn, utils.ToCmdLine("BGSave"))
+	asserts.AssertStatusReply(t, result, "Background saving started")
+	// writes are not blocked
+	result = writeDB.Exec(conn, utils.ToCmdLine("Set", "b", "b"))
+	asserts.AssertStatusReply(t, result, "OK")
+	for i := 0; i < 100 && atomic.LoadInt32(&writeDB.rdbSaving) == 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	readDB := NewStandaloneServer()
+	result = readDB.Exec(conn, utils.ToCmdLine("Get", "a"))
+	asserts.AssertBulkReply(t, result, "a")
+}
+
+func TestSavePoints(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	rdbFilename := filepath.Join(tmpDir, "dump.rdb")
+	config.Properties = &config.ServerProperties{
+		RDBFilename: rdbFilename,
+		Save:        "1 1",
+	}
+	conn := &connection.FakeConn{}
+	writeDB := NewStandaloneServer()
+	time.Sleep(time.Second) // let the save point be met
+	writeDB.Exec(conn, utils.ToCmdLine("Set", "a", "a"))
+	saved := false
+	for i := 0; i < 30 && !saved; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, err = os.Stat(rdbFilename)
+		saved = err == nil && atomic.LoadInt32(&writeDB.rdbSaving) == 0
+	}
+	if !saved {
+		t.Error("rdb is not saved automatically")
+		return
+	}
+
+	// final save on shutdown
+	writeDB.Exec(conn, utils.ToCmdLine("Set", "b", "b"))
+	writeDB.Close()
+	config.Properties.Save = ""
+	readDB := NewStandaloneServer()
+	result := readDB.Exec(conn, utils.ToCmdLine("Get", "a"))
+	asserts.AssertBulkReply(t, result, "a")
+	result = readDB.Exec(conn, utils.ToCmdLine("Get", "b"))
+	asserts.AssertBulkReply(t, result, "b")
+}
+
+func TestDirtyCount(t *testing.T) {
+	testServer.Exec(nil, utils.ToCmdLine("flushall"))
+	conn := &connection.FakeConn{}
+	dirty := testServer.getDirty()
+	testServer.Exec(conn, utils.ToCmdLine("Set", "dirty", "a"))
+	if changes := testServer.getDirty() - dirty; changes != 1 {
+		t.Errorf("expect 1 change, actually %d", changes)
+	}
+	// failed writes are not changes
+	dirty = testServer.getDirty()
+	result := testServer.Exec(conn, utils.ToCmdLine("LPush", "dirty", "a"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	result = testServer.Exec(conn, utils.ToCmdLine("Set", "dirty", "a", "XX", "NX"))
+	if !protocol.IsErrorReply(result) {
+		t.Errorf("expect error, actually %s", result.ToBytes())
+	}
+	if changes := testServer.getDirty() - dirty; changes != 0 {
+		t.Errorf("expect no change, actually %d", changes)
+	}
+}
+
+func TestSaveRestartWithDefaultConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// default dump.rdb is relative to working directory
+	if err = os.Chdir(tmpDir); err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+	config.Properties = &config.ServerProperties{}
+	conn := &connection.FakeConn{}
+	writeDB := NewStandaloneServer()
+	prefix := utils.RandString(8)
+	makeTestData(writeDB, 0, prefix, 10)
+	makeTestData(writeDB, 1, prefix, 10)
+	asserts.AssertStatusReply(t, writeDB.Exec(conn, utils.ToCmdLine("Save")), "OK")
+	writeDB.Close()
+	if _, err = os.Stat(filepath.Join(tmpDir, defaultRDBFilename)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	readDB := NewStandaloneServer()
+	defer readDB.Close()
+	validateTestData(t, readDB, 0, prefix, 10)
+	validateTestData(t, readDB, 1, prefix, 10)
+}
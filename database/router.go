@@ -14,6 +14,11 @@ type command struct {
 	flags    int
 }
 
+// flags of command
+const (
+	flagReadOnly = 1 // command never modifies dataset
+)
+
 // RegisterCommand registers a new command
 // arity means allowed number of cmdArgs, arity < 0 means len(args) >= -arity.
 // for example: the arity of `get` is 2, `mget` is -2
@@ -26,3 +31,18 @@ func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, rollback U
 		arity:    arity,
 	}
 }
+
+// registerReadOnlyCommand registers a command which never modifies dataset
+func registerReadOnlyCommand(name string, executor ExecFunc, prepare PreFunc, rollback UndoFunc, arity int) {
+	RegisterCommand(name, executor, prepare, rollback, arity)
+	cmdTable[strings.ToLower(name)].flags |= flagReadOnly
+}
+
+// IsReadOnlyCommand returns true if the command never modifies dataset, unknown commands are not read only
+func IsReadOnlyCommand(name string) bool {
+	cmd, ok := cmdTable[strings.ToLower(name)]
+	if !ok {
+		return false
+	}
+	return cmd.flags&flagReadOnly > 0
+}
@@ -480,16 +480,16 @@ func execSRandMember(db *DB, args [][]byte) redis.Reply {
 
 func init() {
 	RegisterCommand("SAdd", execSAdd, writeFirstKey, undoSetChange, -3)
-	RegisterCommand("SIsMember", execSIsMember, readFirstKey, nil, 3)
+	registerReadOnlyCommand("SIsMember", execSIsMember, readFirstKey, nil, 3)
 	RegisterCommand("SRem", execSRem, writeFirstKey, undoSetChange, -3)
 	RegisterCommand("SPop", execSPop, writeFirstKey, undoSetChange, -2)
-	RegisterCommand("SCard", execSCard, readFirstKey, nil, 2)
-	RegisterCommand("SMembers", execSMembers, readFirstKey, nil, 2)
-	RegisterCommand("SInter", execSInter, prepareSetCalculate, nil, -2)
+	registerReadOnlyCommand("SCard", execSCard, readFirstKey, nil, 2)
+	registerReadOnlyCommand("SMembers", execSMembers, readFirstKey, nil, 2)
+	registerReadOnlyCommand("SInter", execSInter, prepareSetCalculate, nil, -2)
 	RegisterCommand("SInterStore", execSInterStore, prepareSetCalculateStore, rollbackFirstKey, -3)
-	RegisterCommand("SUnion", execSUnion, prepareSetCalculate, nil, -2)
+	registerReadOnlyCommand("SUnion", execSUnion, prepareSetCalculate, nil, -2)
 	RegisterCommand("SUnionStore", execSUnionStore, prepareSetCalculateStore, rollbackFirstKey, -3)
-	RegisterCommand("SDiff", execSDiff, prepareSetCalculate, nil, -2)
+	registerReadOnlyCommand("SDiff", execSDiff, prepareSetCalculate, nil, -2)
 	RegisterCommand("SDiffStore", execSDiffStore, prepareSetCalculateStore, rollbackFirstKey, -3)
-	RegisterCommand("SRandMember", execSRandMember, readFirstKey, nil, -2)
+	registerReadOnlyCommand("SRandMember", execSRandMember, readFirstKey, nil, -2)
 }
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"sync/atomic"
+)
+
+// modes of saving rdb on shutdown, see SHUTDOWN [NOSAVE|SAVE]
+const (
+	// ShutdownSaveDefault saves rdb only if save points are configured
+	ShutdownSaveDefault = iota
+	// ShutdownSave saves rdb even if no save point is configured
+	ShutdownSave
+	// ShutdownNoSave never saves rdb, aof is still flushed
+	ShutdownNoSave
+)
+
+func (mdb *MultiDB) needSaveOnShutdown(saveMode int) bool {
+	switch saveMode {
+	case ShutdownSave:
+		return true
+	case ShutdownNoSave:
+		return false
+	}
+	return len(mdb.savePoints) > 0
+}
+
+// PrepareShutdown persists dataset while the server is still running, so that shutdown could be aborted on failure.
+// It saves rdb according to saveMode and fsyncs aof.
+func (mdb *MultiDB) PrepareShutdown(saveMode int) error {
+	if mdb.loaded != nil {
+		// saving a partially loaded dataset would lose data
+		<-mdb.loaded
+	}
+	if mdb.needSaveOnShutdown(saveMode) {
+		mdb.waitSaving()
+		err := mdb.save()
+		atomic.StoreInt32(&mdb.rdbSaving, 0)
+		if err != nil {
+			return err
+		}
+	}
+	if mdb.aofHandler != nil {
+		return mdb.aofHandler.Fsync()
+	}
+	return nil
+}
+
+// Shutdown stops persistence, saves the final rdb according to saveMode and closes aof.
+// It returns the first error of persistence, later calls return the same error without doing anything.
+func (mdb *MultiDB) Shutdown(saveMode int) error {
+	mdb.shutdownOnce.Do(func() {
+		mdb.shutdownErr = mdb.shutdown(saveMode)
+	})
+	return mdb.shutdownErr
+}
+
+func (mdb *MultiDB) shutdown(saveMode int) error {
+	if mdb.loaded != nil {
+		// saving a partially loaded dataset would lose data
+		<-mdb.loaded
+	}
+	var err error
+	if mdb.stopSaveCron != nil {
+		close(mdb.stopSaveCron)
+	}
+	if mdb.needSaveOnShutdown(saveMode) {
+		err = mdb.saveBeforeShutdown()
+	}
+	if mdb.aofHandler != nil {
+		if aofErr := mdb.aofHandler.Close(); err == nil {
+			err = aofErr
+		}
+	}
+	return err
+}
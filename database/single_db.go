@@ -11,6 +11,7 @@ import (
 	"github.com/hdt3213/godis/redis/protocol"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,6 +37,23 @@ type DB struct {
 	// stop all data access for execFlushDB
 	stopWorld sync.WaitGroup
 	addAof    func(CmdLine)
+	// returns error if aof failed and writes cannot be persisted any more
+	aofFailure func() error
+	// notifies clients of CLIENT TRACKING, nil if tracking is not supported
+	tracker *tracker
+
+	// number of write commands executed, used by rdb save points
+	dirty int64
+	// unix nano time until which expired keys are kept in dataset, 0 means not paused
+	expirationPausedUntil int64
+	// keys expired while locks held, tracking clients are notified after locks released
+	expiredMu   sync.Mutex
+	expiredKeys []string
+
+	// active snapshots which need copy-on-write
+	snapshotMu    sync.RWMutex
+	snapshots     []*dbSnapshot
+	snapshotCount int32
 }
 
 // ExecFunc is interface for command executor
@@ -61,6 +79,7 @@ func makeDB() *DB {
 		versionMap: dict.MakeConcurrent(dataDictSize),
 		locker:     lock.Make(lockerSize),
 		addAof:     func(line CmdLine) {},
+		aofFailure: func() error { return nil },
 	}
 	return db
 }
@@ -74,6 +93,7 @@ func makeBasicDB() *DB {
 		versionMap: dict.MakeSimple(),
 		locker:     lock.Make(1),
 		addAof:     func(line CmdLine) {},
+		aofFailure: func() error { return nil },
 	}
 	return db
 }
@@ -109,17 +129,24 @@ func (db *DB) Exec(c redis.Connection, cmdLine [][]byte) redis.Reply {
 		if c.InMultiState() {
 			return protocol.MakeErrReply("ERR command 'FlushDB' cannot be used in MULTI")
 		}
-		return execFlushDB(db, cmdLine[1:])
+		if reply := db.aofErrReply(); reply != nil {
+			return reply
+		}
+		result := execFlushDB(db, cmdLine[1:])
+		if reply := db.aofErrReply(); reply != nil {
+			return reply
+		}
+		return result
 	}
 	if c != nil && c.InMultiState() {
 		EnqueueCmd(c, cmdLine)
 		return protocol.MakeQueuedReply()
 	}
 
-	return db.execNormalCommand(cmdLine)
+	return db.execNormalCommand(c, cmdLine)
 }
 
-func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
+func (db *DB) execNormalCommand(c redis.Connection, cmdLine [][]byte) redis.Reply {
 	cmdName := strings.ToLower(string(cmdLine[0]))
 	cmd, ok := cmdTable[cmdName]
 	if !ok {
@@ -131,11 +158,42 @@ func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
 
 	prepare := cmd.prepare
 	write, read := prepare(cmdLine[1:])
+	if len(write) > 0 {
+		if reply := db.aofErrReply(); reply != nil {
+			return reply
+		}
+	}
 	db.addVersion(write...)
+	readOnly := cmd.flags&flagReadOnly > 0
+	if !readOnly {
+		// notify tracking clients after keys unlocked
+		defer db.tracker.invalidate(c, write)
+	}
 	db.RWLocks(write, read)
 	defer db.RWUnLocks(write, read)
 	fun := cmd.executor
-	return fun(db, cmdLine[1:])
+	result := fun(db, cmdLine[1:])
+	if readOnly {
+		// remember keys before unlocked, so that any following write will invalidate them
+		db.tracker.trackRead(c, read)
+	}
+	// failed writes, e.g. WRONGTYPE, do not count as changes
+	if len(write) > 0 && !protocol.IsErrorReply(result) {
+		atomic.AddInt64(&db.dirty, 1)
+		// never acknowledge writes which may not be persisted
+		if reply := db.aofErrReply(); reply != nil {
+			return reply
+		}
+	}
+	return result
+}
+
+// aofErrReply returns an error reply if aof failed, otherwise nil
+func (db *DB) aofErrReply() redis.Reply {
+	if err := db.aofFailure(); err != nil {
+		return protocol.MakeErrReply("MISCONF Errors writing to the AOF file: " + err.Error())
+	}
+	return nil
 }
 
 // execWithLock executes normal commands, invoker should provide locks
@@ -223,6 +281,8 @@ func (db *DB) Flush() {
 	db.stopWorld.Add(1)
 	defer db.stopWorld.Done()
 
+	atomic.AddInt64(&db.dirty, 1)
+	db.beforeFlush()
 	db.data.Clear()
 	db.ttlMap.Clear()
 	db.locker = lock.Make(lockerSize)
@@ -234,11 +294,13 @@ func (db *DB) Flush() {
 // RWLocks lock keys for writing and reading
 func (db *DB) RWLocks(writeKeys []string, readKeys []string) {
 	db.locker.RWLocks(writeKeys, readKeys)
+	db.beforeWrite(writeKeys)
 }
 
 // RWUnLocks unlock keys for writing and reading
 func (db *DB) RWUnLocks(writeKeys []string, readKeys []string) {
 	db.locker.RWUnLocks(writeKeys, readKeys)
+	db.sendExpiredInvalidation()
 }
 
 /* ---- TTL Functions ---- */
@@ -251,8 +313,17 @@ func genExpireTask(key string) string {
 func (db *DB) Expire(key string, expireTime time.Time) {
 	db.stopWorld.Wait()
 	db.ttlMap.Put(key, expireTime)
+	db.scheduleExpire(key, expireTime)
+}
+
+// scheduleExpire removes key at expireTime, or after pause if expiration is paused then
+func (db *DB) scheduleExpire(key string, expireTime time.Time) {
 	taskKey := genExpireTask(key)
 	timewheel.At(expireTime, taskKey, func() {
+		if pausedUntil, paused := db.getExpirationPause(); paused {
+			db.scheduleExpire(key, pausedUntil)
+			return
+		}
 		keys := []string{key}
 		db.RWLocks(keys, nil)
 		defer db.RWUnLocks(keys, nil)
@@ -266,6 +337,7 @@ func (db *DB) Expire(key string, expireTime time.Time) {
 		expired := time.Now().After(expireTime)
 		if expired {
 			db.Remove(key)
+			db.queueExpiredInvalidation(key)
 		}
 	})
 }
@@ -286,12 +358,36 @@ func (db *DB) IsExpired(key string) bool {
 	}
 	expireTime, _ := rawExpireTime.(time.Time)
 	expired := time.Now().After(expireTime)
-	if expired {
+	if _, paused := db.getExpirationPause(); expired && !paused {
 		db.Remove(key)
+		db.queueExpiredInvalidation(key)
 	}
 	return expired
 }
 
+// queueExpiredInvalidation queues invalidation of expired key, because the invoker may hold locks of the key,
+// and a slow tracking client should not block commands on the key
+func (db *DB) queueExpiredInvalidation(key string) {
+	if db.tracker.isEmpty() {
+		return
+	}
+	db.expiredMu.Lock()
+	db.expiredKeys = append(db.expiredKeys, key)
+	db.expiredMu.Unlock()
+}
+
+// sendExpiredInvalidation notifies tracking clients of queued expired keys, invoker should not hold any lock
+func (db *DB) sendExpiredInvalidation() {
+	if db.tracker.isEmpty() {
+		return
+	}
+	db.expiredMu.Lock()
+	keys := db.expiredKeys
+	db.expiredKeys = nil
+	db.expiredMu.Unlock()
+	db.tracker.invalidate(nil, keys)
+}
+
 /* --- add version --- */
 
 func (db *DB) addVersion(keys ...string) {
@@ -314,12 +410,16 @@ func (db *DB) GetVersion(key string) uint32 {
 func (db *DB) ForEach(cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
 	db.data.ForEach(func(key string, raw interface{}) bool {
 		entity, _ := raw.(*database.DataEntity)
-		var expiration *time.Time
-		rawExpireTime, ok := db.ttlMap.Get(key)
-		if ok {
-			expireTime, _ := rawExpireTime.(time.Time)
-			expiration = &expireTime
-		}
-		return cb(key, entity, expiration)
+		return cb(key, entity, db.getExpiration(key))
 	})
 }
+
+// getExpiration returns expire time of key, returns nil if it is persistent
+func (db *DB) getExpiration(key string) *time.Time {
+	rawExpireTime, ok := db.ttlMap.Get(key)
+	if !ok {
+		return nil
+	}
+	expireTime, _ := rawExpireTime.(time.Time)
+	return &expireTime
+}
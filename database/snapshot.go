@@ -0,0 +1,273 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/datastruct/dict"
+	List "github.com/hdt3213/godis/datastruct/list"
+	"github.com/hdt3213/godis/datastruct/lock"
+	"github.com/hdt3213/godis/datastruct/set"
+	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/interface/database"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * A snapshot is a copy-on-write view of db at the moment it was taken.
+ * Before a write command modifies a key, the old value is copied into every active snapshot
+ * unless the snapshot has already dumped the key.
+ * The traversal of snapshot copies live keys under their read locks and marks them dumped,
+ * so writers only pay for copying keys which have not been dumped yet.
+ */
+
+// snapshotEntry is the value of a key when snapshot was taken
+type snapshotEntry struct {
+	entity     *database.DataEntity // nil if the key did not exist
+	expiration *time.Time
+	emitted    bool
+}
+
+// dbSnapshot is a snapshot of a single DB
+type dbSnapshot struct {
+	mu        sync.Mutex
+	preserved map[string]*snapshotEntry
+	dumped    map[string]struct{}
+}
+
+func makeDBSnapshot() *dbSnapshot {
+	return &dbSnapshot{
+		preserved: make(map[string]*snapshotEntry),
+		dumped:    make(map[string]struct{}),
+	}
+}
+
+// preserve copies the current value of keys before they are modified, invoker should hold the write locks of keys
+func (s *dbSnapshot) preserve(db *DB, keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if _, ok := s.dumped[key]; ok {
+			continue
+		}
+		if _, ok := s.preserved[key]; ok {
+			continue
+		}
+		entry := &snapshotEntry{}
+		raw, ok := db.data.Get(key)
+		if ok {
+			entry.entity = cloneEntity(raw.(*database.DataEntity))
+			entry.expiration = db.getExpiration(key)
+		}
+		s.preserved[key] = entry
+	}
+}
+
+// preserveAll moves all keys not dumped into snapshot, it is used before db flushed.
+// Entities will never be modified after flush, so there is no need to copy them.
+func (s *dbSnapshot) preserveAll(db *DB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db.data.ForEach(func(key string, raw interface{}) bool {
+		if _, ok := s.dumped[key]; ok {
+			return true
+		}
+		if _, ok := s.preserved[key]; ok {
+			return true
+		}
+		s.preserved[key] = &snapshotEntry{
+			entity:     raw.(*database.DataEntity),
+			expiration: db.getExpiration(key),
+		}
+		return true
+	})
+}
+
+// forEach traverses all keys in snapshot
+func (s *dbSnapshot) forEach(db *DB, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	for _, key := range db.data.Keys() {
+		if !s.visit(db, key, cb) {
+			return
+		}
+	}
+	// keys removed after snapshot was taken
+	type remain struct {
+		key   string
+		entry *snapshotEntry
+	}
+	var remains []remain
+	s.mu.Lock()
+	for key, entry := range s.preserved {
+		if !entry.emitted && entry.entity != nil {
+			entry.emitted = true
+			remains = append(remains, remain{key: key, entry: entry})
+		}
+	}
+	s.mu.Unlock()
+	for _, r := range remains {
+		// entries will not be modified after emitted
+		if !cb(r.key, r.entry.entity, r.entry.expiration) {
+			return
+		}
+	}
+}
+
+// visit emits key if it has not been emitted. cb is called without lock since it may be slow, e.g. writing file,
+// so live value is copied under the read lock of key
+func (s *dbSnapshot) visit(db *DB, key string, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) bool {
+	entity, expiration, ok := s.read(db, key)
+	if !ok {
+		return true
+	}
+	return cb(key, entity, expiration)
+}
+
+// read returns value of key in snapshot and marks it emitted, ok is false if it should not be emitted
+func (s *dbSnapshot) read(db *DB, key string) (*database.DataEntity, *time.Time, bool) {
+	locker := db.locker // Flush may replace db.locker during traversal
+	locker.RLock(key)
+	defer locker.RUnLock(key)
+
+	s.mu.Lock()
+	if entry, ok := s.preserved[key]; ok {
+		if entry.emitted || entry.entity == nil {
+			s.mu.Unlock()
+			return nil, nil, false
+		}
+		entry.emitted = true
+		s.mu.Unlock()
+		return entry.entity, entry.expiration, true
+	}
+	if _, ok := s.dumped[key]; ok {
+		s.mu.Unlock()
+		return nil, nil, false
+	}
+	s.dumped[key] = struct{}{}
+	s.mu.Unlock()
+
+	raw, ok := db.data.Get(key)
+	if !ok {
+		return nil, nil, false
+	}
+	// key is dumped, so writers will not preserve it after unlocked
+	return cloneEntity(raw.(*database.DataEntity)), db.getExpiration(key), true
+}
+
+// snapshot is a point-in-time view of MultiDB, implements database.Snapshot
+type snapshot struct {
+	mdb         *MultiDB
+	dbSnapshots []*dbSnapshot
+}
+
+// Snapshot creates a point-in-time view of all databases.
+// All the key locks are held while taking snapshot, so atBarrier is invoked while no write command is executing
+func (mdb *MultiDB) Snapshot(atBarrier func()) database.Snapshot {
+	snap := &snapshot{
+		mdb:         mdb,
+		dbSnapshots: make([]*dbSnapshot, len(mdb.dbSet)),
+	}
+	lockers := make([]*lock.Locks, len(mdb.dbSet))
+	for i, db := range mdb.dbSet {
+		lockers[i] = db.locker
+		lockers[i].LockAll()
+	}
+	for i, db := range mdb.dbSet {
+		snap.dbSnapshots[i] = makeDBSnapshot()
+		db.addSnapshot(snap.dbSnapshots[i])
+	}
+	if atBarrier != nil {
+		atBarrier()
+	}
+	for i := len(lockers) - 1; i >= 0; i-- {
+		lockers[i].UnLockAll()
+	}
+	return snap
+}
+
+// ForEach traverses all the keys of the given database in snapshot
+func (snap *snapshot) ForEach(dbIndex int, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	snap.dbSnapshots[dbIndex].forEach(snap.mdb.selectDB(dbIndex), cb)
+}
+
+// Release stops copy-on-write of snapshot
+func (snap *snapshot) Release() {
+	for i, db := range snap.mdb.dbSet {
+		db.removeSnapshot(snap.dbSnapshots[i])
+	}
+}
+
+func (db *DB) addSnapshot(s *dbSnapshot) {
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+	db.snapshots = append(db.snapshots, s)
+	atomic.StoreInt32(&db.snapshotCount, int32(len(db.snapshots)))
+}
+
+func (db *DB) removeSnapshot(s *dbSnapshot) {
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+	for i, snap := range db.snapshots {
+		if snap == s {
+			db.snapshots = append(db.snapshots[:i], db.snapshots[i+1:]...)
+			break
+		}
+	}
+	atomic.StoreInt32(&db.snapshotCount, int32(len(db.snapshots)))
+}
+
+// beforeWrite preserves values of keys for snapshots, invoker should hold the write locks of keys
+func (db *DB) beforeWrite(keys []string) {
+	if len(keys) == 0 || atomic.LoadInt32(&db.snapshotCount) == 0 {
+		return
+	}
+	db.snapshotMu.RLock()
+	defer db.snapshotMu.RUnlock()
+	for _, s := range db.snapshots {
+		s.preserve(db, keys)
+	}
+}
+
+// beforeFlush preserves all keys for snapshots
+func (db *DB) beforeFlush() {
+	if atomic.LoadInt32(&db.snapshotCount) == 0 {
+		return
+	}
+	db.snapshotMu.RLock()
+	defer db.snapshotMu.RUnlock()
+	for _, s := range db.snapshots {
+		s.preserveAll(db)
+	}
+}
+
+func cloneEntity(entity *database.DataEntity) *database.DataEntity {
+	switch val := entity.Data.(type) {
+	case []byte:
+		// string may be modified in place, such as SETRANGE and SETBIT
+		bytes := make([]byte, len(val))
+		copy(bytes, val)
+		return &database.DataEntity{Data: bytes}
+	case *List.LinkedList:
+		list := &List.LinkedList{}
+		val.ForEach(func(i int, v interface{}) bool {
+			list.Add(v)
+			return true
+		})
+		return &database.DataEntity{Data: list}
+	case *set.Set:
+		return &database.DataEntity{Data: set.Make(val.ToSlice()...)}
+	case dict.Dict:
+		hash := dict.MakeSimple()
+		val.ForEach(func(field string, v interface{}) bool {
+			hash.Put(field, v)
+			return true
+		})
+		return &database.DataEntity{Data: hash}
+	case *SortedSet.SortedSet:
+		zset := SortedSet.Make()
+		val.ForEach(int64(0), val.Len(), false, func(element *SortedSet.Element) bool {
+			zset.Add(element.Member, element.Score)
+			return true
+		})
+		return &database.DataEntity{Data: zset}
+	}
+	return entity
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/config"
+	List "github.com/hdt3213/godis/datastruct/list"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	config.Properties = &config.ServerProperties{}
+	mdb := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		mdb.Exec(conn, utils.ToCmdLine("SET", key, key))
+	}
+	mdb.Exec(conn, utils.ToCmdLine("RPUSH", "list", "a"))
+	mdb.Exec(conn, utils.ToCmdLine("SETEX", "ttl", "100", "a"))
+
+	snap := mdb.Snapshot(nil)
+	// modify db after snapshot taken
+	mdb.Exec(conn, utils.ToCmdLine("SET", "0", "changed"))
+	mdb.Exec(conn, utils.ToCmdLine("DEL", "1"))
+	mdb.Exec(conn, utils.ToCmdLine("SET", "new", "new"))
+	mdb.Exec(conn, utils.ToCmdLine("RPUSH", "list", "b"))
+	mdb.Exec(conn, utils.ToCmdLine("PERSIST", "ttl"))
+
+	result := make(map[string]*database.DataEntity)
+	expirations := make(map[string]*time.Time)
+	snap.ForEach(0, func(key string, data *database.DataEntity, expiration *time.Time) bool {
+		if _, ok := result[key]; ok {
+			t.Errorf("duplicated key %s", key)
+		}
+		result[key] = data
+		expirations[key] = expiration
+		return true
+	})
+	snap.Release()
+
+	if len(result) != 12 {
+		t.Errorf("expect 12 keys, actually %d", len(result))
+	}
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		entity, ok := result[key]
+		if !ok {
+			t.Errorf("key %s not found in snapshot", key)
+			continue
+		}
+		if string(entity.Data.([]byte)) != key {
+			t.Errorf("expect %s, actually %s", key, entity.Data.([]byte))
+		}
+	}
+	if _, ok := result["new"]; ok {
+		t.Error("key created after snapshot should not be found")
+	}
+	if list := result["list"].Data.(*List.LinkedList); list.Len() != 1 {
+		t.Errorf("expect list length 1, actually %d", list.Len())
+	}
+	if expirations["ttl"] == nil {
+		t.Error("expiration of ttl should be kept")
+	}
+
+	// live db should not be affected by snapshot
+	asserts.AssertBulkReply(t, mdb.Exec(conn, utils.ToCmdLine("GET", "0")), "changed")
+	asserts.AssertIntReply(t, mdb.Exec(conn, utils.ToCmdLine("LLEN", "list")), 2)
+	asserts.AssertIntReply(t, mdb.Exec(conn, utils.ToCmdLine("TTL", "ttl")), -1)
+}
+
+func TestSnapshotFlush(t *testing.T) {
+	config.Properties = &config.ServerProperties{}
+	mdb := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		mdb.Exec(conn, utils.ToCmdLine("SET", key, key))
+	}
+	snap := mdb.Snapshot(nil)
+	defer snap.Release()
+	mdb.Exec(conn, utils.ToCmdLine("FLUSHDB"))
+	mdb.Exec(conn, utils.ToCmdLine("SET", "new", "new"))
+
+	count := 0
+	snap.ForEach(0, func(key string, data *database.DataEntity, expiration *time.Time) bool {
+		if key == "new" {
+			t.Error("key created after snapshot should not be found")
+		}
+		count++
+		return true
+	})
+	if count != 10 {
+		t.Errorf("expect 10 keys, actually %d", count)
+	}
+}
+
+func TestSnapshotRename(t *testing.T) {
+	config.Properties = &config.ServerProperties{}
+	mdb := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	mdb.Exec(conn, utils.ToCmdLine("SET", "src", "v"))
+	mdb.Exec(conn, utils.ToCmdLine("SET", "src2", "v2"))
+	snap := mdb.Snapshot(nil)
+	defer snap.Release()
+	asserts.AssertStatusReply(t, mdb.Exec(conn, utils.ToCmdLine("RENAME", "src", "dst")), "OK")
+	asserts.AssertIntReply(t, mdb.Exec(conn, utils.ToCmdLine("RENAMENX", "src2", "dst2")), 1)
+
+	result := make(map[string]string)
+	snap.ForEach(0, func(key string, data *database.DataEntity, expiration *time.Time) bool {
+		result[key] = string(data.Data.([]byte))
+		return true
+	})
+	if len(result) != 2 || result["src"] != "v" || result["src2"] != "v2" {
+		t.Errorf("expect src and src2 in snapshot, actually %v", result)
+	}
+}
+
+func TestSnapshotConcurrentWrite(t *testing.T) {
+	config.Properties = &config.ServerProperties{}
+	mdb := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		mdb.Exec(conn, utils.ToCmdLine("SET", key, key))
+	}
+	snap := mdb.Snapshot(nil)
+	defer snap.Release()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writer := &connection.FakeConn{}
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			mdb.Exec(writer, utils.ToCmdLine("DEL", key))
+			mdb.Exec(writer, utils.ToCmdLine("SET", "new"+key, key))
+		}
+	}()
+	count := 0
+	snap.ForEach(0, func(key string, data *database.DataEntity, expiration *time.Time) bool {
+		if string(data.Data.([]byte)) != key {
+			t.Errorf("expect %s, actually %s", key, data.Data.([]byte))
+		}
+		count++
+		return true
+	})
+	<-done
+	if count != 1000 {
+		t.Errorf("expect 1000 keys, actually %d", count)
+	}
+}
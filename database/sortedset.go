@@ -105,8 +105,7 @@ func execZScore(db *DB, args [][]byte) redis.Reply {
 	if !exists {
 		return &protocol.NullBulkReply{}
 	}
-	value := strconv.FormatFloat(element.Score, 'f', -1, 64)
-	return protocol.MakeBulkReply([]byte(value))
+	return protocol.MakeDoubleReply(element.Score)
 }
 
 // execZRank gets index of a member in sortedset, ascending order, start from 0
@@ -592,18 +591,18 @@ func undoZIncr(db *DB, args [][]byte) []CmdLine {
 
 func init() {
 	RegisterCommand("ZAdd", execZAdd, writeFirstKey, undoZAdd, -4)
-	RegisterCommand("ZScore", execZScore, readFirstKey, nil, 3)
+	registerReadOnlyCommand("ZScore", execZScore, readFirstKey, nil, 3)
 	RegisterCommand("ZIncrBy", execZIncrBy, writeFirstKey, undoZIncr, 4)
-	RegisterCommand("ZRank", execZRank, readFirstKey, nil, 3)
-	RegisterCommand("ZCount", execZCount, readFirstKey, nil, 4)
-	RegisterCommand("ZRevRank", execZRevRank, readFirstKey, nil, 3)
-	RegisterCommand("ZCard", execZCard, readFirstKey, nil, 2)
-	RegisterCommand("ZRange", execZRange, readFirstKey, nil, -4)
-	RegisterCommand("ZRangeByScore", execZRangeByScore, readFirstKey, nil, -4)
-	RegisterCommand("ZRange", execZRange, readFirstKey, nil, -4)
-	RegisterCommand("ZRevRange", execZRevRange, readFirstKey, nil, -4)
-	RegisterCommand("ZRangeByScore", execZRangeByScore, readFirstKey, nil, -4)
-	RegisterCommand("ZRevRangeByScore", execZRevRangeByScore, readFirstKey, nil, -4)
+	registerReadOnlyCommand("ZRank", execZRank, readFirstKey, nil, 3)
+	registerReadOnlyCommand("ZCount", execZCount, readFirstKey, nil, 4)
+	registerReadOnlyCommand("ZRevRank", execZRevRank, readFirstKey, nil, 3)
+	registerReadOnlyCommand("ZCard", execZCard, readFirstKey, nil, 2)
+	registerReadOnlyCommand("ZRange", execZRange, readFirstKey, nil, -4)
+	registerReadOnlyCommand("ZRangeByScore", execZRangeByScore, readFirstKey, nil, -4)
+	registerReadOnlyCommand("ZRange", execZRange, readFirstKey, nil, -4)
+	registerReadOnlyCommand("ZRevRange", execZRevRange, readFirstKey, nil, -4)
+	registerReadOnlyCommand("ZRangeByScore", execZRangeByScore, readFirstKey, nil, -4)
+	registerReadOnlyCommand("ZRevRangeByScore", execZRevRangeByScore, readFirstKey, nil, -4)
 	RegisterCommand("ZRem", execZRem, writeFirstKey, undoZRem, -3)
 	RegisterCommand("ZRemRangeByScore", execZRemRangeByScore, writeFirstKey, rollbackFirstKey, 4)
 	RegisterCommand("ZRemRangeByRank", execZRemRangeByRank, writeFirstKey, rollbackFirstKey, 4)
@@ -740,22 +740,22 @@ func init() {
 	RegisterCommand("SetEX", execSetEX, writeFirstKey, rollbackFirstKey, 4)
 	RegisterCommand("PSetEX", execPSetEX, writeFirstKey, rollbackFirstKey, 4)
 	RegisterCommand("MSet", execMSet, prepareMSet, undoMSet, -3)
-	RegisterCommand("MGet", execMGet, prepareMGet, nil, -2)
+	registerReadOnlyCommand("MGet", execMGet, prepareMGet, nil, -2)
 	RegisterCommand("MSetNX", execMSetNX, prepareMSet, undoMSet, -3)
-	RegisterCommand("Get", execGet, readFirstKey, nil, 2)
+	registerReadOnlyCommand("Get", execGet, readFirstKey, nil, 2)
 	RegisterCommand("GetSet", execGetSet, writeFirstKey, rollbackFirstKey, 3)
 	RegisterCommand("Incr", execIncr, writeFirstKey, rollbackFirstKey, 2)
 	RegisterCommand("IncrBy", execIncrBy, writeFirstKey, rollbackFirstKey, 3)
 	RegisterCommand("IncrByFloat", execIncrByFloat, writeFirstKey, rollbackFirstKey, 3)
 	RegisterCommand("Decr", execDecr, writeFirstKey, rollbackFirstKey, 2)
 	RegisterCommand("DecrBy", execDecrBy, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand("StrLen", execStrLen, readFirstKey, nil, 2)
+	registerReadOnlyCommand("StrLen", execStrLen, readFirstKey, nil, 2)
 	RegisterCommand("Append", execAppend, writeFirstKey, rollbackFirstKey, 3)
 	RegisterCommand("SetRange", execSetRange, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("GetRange", execGetRange, readFirstKey, nil, 4)
+	registerReadOnlyCommand("GetRange", execGetRange, readFirstKey, nil, 4)
 	RegisterCommand("SetBit", execSetBit, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("GetBit", execGetBit, readFirstKey, nil, 3)
-	RegisterCommand("BitCount", execBitCount, readFirstKey, nil, -2)
-	RegisterCommand("BitPos", execBitPos, readFirstKey, nil, -3)
+	registerReadOnlyCommand("GetBit", execGetBit, readFirstKey, nil, 3)
+	registerReadOnlyCommand("BitCount", execBitCount, readFirstKey, nil, -2)
+	registerReadOnlyCommand("BitPos", execBitPos, readFirstKey, nil, -3)
 
 }
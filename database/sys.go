@@ -4,8 +4,13 @@ import (
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
 )
 
+// serverVersion is the redis version godis is compatible with, reported by HELLO
+const serverVersion = "7.0.0"
+
 // Ping the server
 func Ping(db *DB, args [][]byte) redis.Reply {
 	if len(args) == 0 {
@@ -33,6 +38,80 @@ func Auth(c redis.Connection, args [][]byte) redis.Reply {
 	return &protocol.OkReply{}
 }
 
+// Hello switches protocol version, and optionally authenticates and sets the name of connection.
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func Hello(c redis.Connection, args [][]byte) redis.Reply {
+	version := c.GetProtocol()
+	var user, passwd, name string
+	var withAuth, withName bool
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if ver != protocol.RESP2 && ver != protocol.RESP3 {
+			return protocol.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+		version = ver
+	}
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		if option == "auth" && i+2 < len(args) {
+			withAuth = true
+			user, passwd = string(args[i+1]), string(args[i+2])
+			i += 2
+		} else if option == "setname" && i+1 < len(args) {
+			withName = true
+			name = string(args[i+1])
+			i++
+		} else {
+			return protocol.MakeErrReply("ERR Syntax error in HELLO option '" + string(args[i]) + "'")
+		}
+	}
+	if withAuth {
+		// only the default user is supported, which accepts any password if requirepass is not set
+		if user != "default" ||
+			(config.Properties.RequirePass != "" && passwd != config.Properties.RequirePass) {
+			return protocol.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+		}
+		c.SetPassword(passwd)
+	} else if !isAuthenticated(c) {
+		return protocol.MakeErrReply("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate " +
+			"the client and select the RESP protocol version at the same time")
+	}
+	if withName {
+		if !IsValidClientName(name) {
+			return protocol.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+		c.SetName(name)
+	}
+	c.SetProtocol(version)
+
+	mode := "standalone"
+	if config.Properties.Self != "" && len(config.Properties.Peers) > 0 {
+		mode = "cluster"
+	}
+	return protocol.MakeMapReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("server")), protocol.MakeBulkReply([]byte("godis")),
+		protocol.MakeBulkReply([]byte("version")), protocol.MakeBulkReply([]byte(serverVersion)),
+		protocol.MakeBulkReply([]byte("proto")), protocol.MakeIntReply(int64(version)),
+		protocol.MakeBulkReply([]byte("mode")), protocol.MakeBulkReply([]byte(mode)),
+		protocol.MakeBulkReply([]byte("role")), protocol.MakeBulkReply([]byte("master")),
+		protocol.MakeBulkReply([]byte("modules")), protocol.MakeEmptyMultiBulkReply(),
+	})
+}
+
+// IsValidClientName returns false if name contains spaces, newlines or other special characters
+func IsValidClientName(name string) bool {
+	for _, ch := range name {
+		if ch < '!' || ch > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 func isAuthenticated(c redis.Connection) bool {
 	if config.Properties.RequirePass == "" {
 		return true
@@ -41,5 +120,5 @@ func isAuthenticated(c redis.Connection) bool {
 }
 
 func init() {
-	RegisterCommand("ping", Ping, noPrepare, nil, -1)
+	registerReadOnlyCommand("ping", Ping, noPrepare, nil, -1)
 }
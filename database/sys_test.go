@@ -4,7 +4,9 @@ import (
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strings"
 	"testing"
 )
 
@@ -38,3 +40,61 @@ func TestAuth(t *testing.T) {
 	asserts.AssertStatusReply(t, ret, "OK")
 
 }
+
+func TestHello(t *testing.T) {
+	c := &connection.FakeConn{}
+	ret := testServer.Exec(c, utils.ToCmdLine("HELLO", "4"))
+	asserts.AssertErrReply(t, ret, "NOPROTO unsupported protocol version")
+	ret = testServer.Exec(c, utils.ToCmdLine("HELLO", "3", "SETNAME"))
+	asserts.AssertErrReply(t, ret, "ERR Syntax error in HELLO option 'SETNAME'")
+	if c.GetProtocol() != protocol.RESP2 {
+		t.Error("protocol should not be changed by failed HELLO")
+	}
+
+	ret = testServer.Exec(c, utils.ToCmdLine("HELLO", "3", "SETNAME", "conn1"))
+	reply, ok := ret.(*protocol.MapReply)
+	if !ok {
+		t.Fatalf("expected map reply, actually %s", ret.ToBytes())
+	}
+	if c.GetProtocol() != protocol.RESP3 || c.GetName() != "conn1" {
+		t.Errorf("wrong protocol %d or name %s", c.GetProtocol(), c.GetName())
+	}
+	if !strings.HasPrefix(string(protocol.Marshal(reply, c.GetProtocol())), "%6\r\n$6\r\nserver\r\n") {
+		t.Errorf("wrong hello reply %s", protocol.Marshal(reply, c.GetProtocol()))
+	}
+
+	// native RESP3 types
+	key := utils.RandString(10)
+	testServer.Exec(c, utils.ToCmdLine("HSET", key, "a", ""))
+	ret = testServer.Exec(c, utils.ToCmdLine("HGETALL", key))
+	if string(protocol.Marshal(ret, c.GetProtocol())) != "%1\r\n$1\r\na\r\n$0\r\n\r\n" {
+		t.Errorf("wrong hgetall reply %s", protocol.Marshal(ret, c.GetProtocol()))
+	}
+	testServer.Exec(c, utils.ToCmdLine("ZADD", key+"z", "1.5", "a"))
+	ret = testServer.Exec(c, utils.ToCmdLine("ZSCORE", key+"z", "a"))
+	if string(protocol.Marshal(ret, c.GetProtocol())) != ",1.5\r\n" {
+		t.Errorf("wrong zscore reply %s", protocol.Marshal(ret, c.GetProtocol()))
+	}
+	testServer.Exec(c, utils.ToCmdLine("SUBSCRIBE", key))
+	if !strings.HasPrefix(string(c.Bytes()), ">3\r\n$9\r\nsubscribe\r\n") {
+		t.Errorf("wrong subscribe message %s", c.Bytes())
+	}
+	testServer.Exec(c, utils.ToCmdLine("UNSUBSCRIBE"))
+
+	// authenticate by HELLO
+	passwd := utils.RandString(10)
+	config.Properties.RequirePass = passwd
+	defer func() {
+		config.Properties.RequirePass = ""
+	}()
+	c = &connection.FakeConn{}
+	ret = testServer.Exec(c, utils.ToCmdLine("HELLO", "3"))
+	asserts.AssertErrReply(t, ret, "NOAUTH HELLO must be called with the client already authenticated, "+
+		"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate "+
+		"the client and select the RESP protocol version at the same time")
+	ret = testServer.Exec(c, utils.ToCmdLine("HELLO", "3", "AUTH", "default", passwd+"wrong"))
+	asserts.AssertErrReply(t, ret, "WRONGPASS invalid username-password pair or user is disabled.")
+	ret = testServer.Exec(c, utils.ToCmdLine("HELLO", "2", "AUTH", "default", passwd))
+	asserts.AssertNotError(t, ret)
+	asserts.AssertStatusReply(t, testServer.Exec(c, utils.ToCmdLine("PING")), "PONG")
+}
@@ -0,0 +1,346 @@
+package database
+
+/*
+ * Server assisted client side caching, see CLIENT TRACKING.
+ * In default mode, the server remembers keys read by each tracking client,
+ * sends an invalidation message when any of them is modified and then forgets it until it is read again.
+ * In BCAST mode, clients receive invalidation messages of all modified keys matching their prefixes.
+ * Messages are sent as RESP3 push, or as messages of __redis__:invalidate to the redirected client using RESP2.
+ */
+
+import (
+	"errors"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/pubsub"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TrackingOptions are options of CLIENT TRACKING ON
+type TrackingOptions struct {
+	// Redirect receives invalidation messages instead of the tracking client if not nil
+	Redirect redis.Connection
+	BCast    bool
+	// Prefixes limit keys in BCAST mode, empty means all keys
+	Prefixes []string
+	// OptIn tracks keys only if CLIENT CACHING yes is called before the read command
+	OptIn bool
+	// OptOut tracks keys unless CLIENT CACHING no is called before the read command
+	OptOut bool
+	// NoLoop skips keys modified by the client itself
+	NoLoop bool
+}
+
+var (
+	invalidateBytes          = []byte("invalidate")
+	trackingRedirBrokenBytes = []byte("tracking-redir-broken")
+)
+
+type trackingClient struct {
+	opts *TrackingOptions
+	// caching is set by CLIENT CACHING, it only affects the next command
+	caching    bool
+	cachingSet bool
+	// redirect client has been closed
+	redirectBroken bool
+	// keys tracked in default mode
+	keys map[string]struct{}
+}
+
+type tracker struct {
+	hub *pubsub.Hub
+	mu  sync.Mutex
+	// number of tracking clients, read without lock to skip tracking quickly
+	count   int32
+	clients map[redis.Connection]*trackingClient
+	// key -> clients have read it, in default mode
+	keys map[string]map[redis.Connection]struct{}
+}
+
+func makeTracker(hub *pubsub.Hub) *tracker {
+	return &tracker{
+		hub:     hub,
+		clients: make(map[redis.Connection]*trackingClient),
+		keys:    make(map[string]map[redis.Connection]struct{}),
+	}
+}
+
+func (t *tracker) isEmpty() bool {
+	return t == nil || atomic.LoadInt32(&t.count) == 0
+}
+
+// enable turns on tracking of c, bcast mode cannot be changed without turning off tracking
+func (t *tracker) enable(c redis.Connection, opts *TrackingOptions) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tc, ok := t.clients[c]; ok {
+		if tc.opts.BCast != opts.BCast {
+			return errors.New("ERR You can't switch BCAST mode on/off before disabling tracking for this client, " +
+				"and then re-enabling it with a different mode.")
+		}
+		tc.opts = opts
+		return nil
+	}
+	t.clients[c] = &trackingClient{
+		opts: opts,
+		keys: make(map[string]struct{}),
+	}
+	atomic.StoreInt32(&t.count, int32(len(t.clients)))
+	return nil
+}
+
+// disable turns off tracking of c and forgets its keys
+func (t *tracker) disable(c redis.Connection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.disable0(c)
+}
+
+func (t *tracker) disable0(c redis.Connection) {
+	tc, ok := t.clients[c]
+	if !ok {
+		return
+	}
+	for key := range tc.keys {
+		clients := t.keys[key]
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(t.keys, key)
+		}
+	}
+	delete(t.clients, c)
+	atomic.StoreInt32(&t.count, int32(len(t.clients)))
+}
+
+// setCaching executes CLIENT CACHING yes|no
+func (t *tracker) setCaching(c redis.Connection, caching bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.clients[c]
+	if !ok || (!tc.opts.OptIn && !tc.opts.OptOut) {
+		return errors.New("ERR CLIENT CACHING can be called only when the client is in tracking mode " +
+			"with OPTIN or OPTOUT mode enabled")
+	}
+	if caching && !tc.opts.OptIn {
+		return errors.New("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+	}
+	if !caching && !tc.opts.OptOut {
+		return errors.New("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+	}
+	tc.caching = caching
+	tc.cachingSet = true
+	return nil
+}
+
+// resetCaching clears the flag set by CLIENT CACHING after a command
+func (t *tracker) resetCaching(c redis.Connection) {
+	if t.isEmpty() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tc, ok := t.clients[c]; ok {
+		tc.cachingSet = false
+	}
+}
+
+// trackRead remembers keys read by c
+func (t *tracker) trackRead(c redis.Connection, keys []string) {
+	if t.isEmpty() || len(keys) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.clients[c]
+	if !ok || tc.opts.BCast {
+		return
+	}
+	if tc.opts.OptIn && !(tc.cachingSet && tc.caching) {
+		return
+	}
+	if tc.opts.OptOut && tc.cachingSet && !tc.caching {
+		return
+	}
+	for _, key := range keys {
+		clients, ok := t.keys[key]
+		if !ok {
+			clients = make(map[redis.Connection]struct{})
+			t.keys[key] = clients
+		}
+		clients[c] = struct{}{}
+		tc.keys[key] = struct{}{}
+	}
+}
+
+func dedupKeys(keys []string) []string {
+	if len(keys) == 1 {
+		return keys
+	}
+	seen := make(map[string]struct{}, len(keys))
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+func matchPrefixes(key string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidate notifies clients tracking the modified keys, writer is nil if keys are modified by server, e.g. expired
+func (t *tracker) invalidate(writer redis.Connection, keys []string) {
+	if t.isEmpty() || len(keys) == 0 {
+		return
+	}
+	keys = dedupKeys(keys)
+	pending := make(map[redis.Connection][]string)
+	t.mu.Lock()
+	for _, key := range keys {
+		for c := range t.keys[key] {
+			// forget key until it is read again
+			delete(t.clients[c].keys, key)
+			if t.clients[c].opts.NoLoop && c == writer {
+				continue
+			}
+			pending[c] = append(pending[c], key)
+		}
+		delete(t.keys, key)
+	}
+	for c, tc := range t.clients {
+		if !tc.opts.BCast || (tc.opts.NoLoop && c == writer) {
+			continue
+		}
+		for _, key := range keys {
+			if matchPrefixes(key, tc.opts.Prefixes) {
+				pending[c] = append(pending[c], key)
+			}
+		}
+	}
+	messages := make([]*invalidation, 0, len(pending))
+	for c, clientKeys := range pending {
+		args := make([][]byte, len(clientKeys))
+		for i, key := range clientKeys {
+			args[i] = []byte(key)
+		}
+		if msg := t.makeInvalidation(c, protocol.MakeMultiBulkReply(args)); msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+	t.mu.Unlock()
+	// send messages without lock, because writing to client may be slow
+	for _, msg := range messages {
+		t.send(msg)
+	}
+}
+
+// invalidateAll notifies all tracking clients that the dataset is flushed
+func (t *tracker) invalidateAll() {
+	if t.isEmpty() {
+		return
+	}
+	t.mu.Lock()
+	t.keys = make(map[string]map[redis.Connection]struct{})
+	messages := make([]*invalidation, 0, len(t.clients))
+	for c, tc := range t.clients {
+		tc.keys = make(map[string]struct{})
+		// null means all keys
+		if msg := t.makeInvalidation(c, protocol.MakeNullBulkReply()); msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+	t.mu.Unlock()
+	for _, msg := range messages {
+		t.send(msg)
+	}
+}
+
+// invalidation is a message to be sent to target
+type invalidation struct {
+	target     redis.Connection
+	redirected bool
+	keys       redis.Reply
+}
+
+// makeInvalidation creates message for tracking client c, invoker should hold lock
+func (t *tracker) makeInvalidation(c redis.Connection, keys redis.Reply) *invalidation {
+	tc := t.clients[c]
+	if tc.opts.Redirect == nil {
+		return &invalidation{target: c, keys: keys}
+	}
+	if tc.redirectBroken {
+		return nil
+	}
+	return &invalidation{target: tc.opts.Redirect, redirected: true, keys: keys}
+}
+
+// send writes invalidation message as RESP3 push, or message of pubsub.InvalidateChannel for redirected RESP2 client
+func (t *tracker) send(msg *invalidation) {
+	if msg.target.GetProtocol() >= protocol.RESP3 {
+		push := protocol.MakePushReply([]redis.Reply{protocol.MakeBulkReply(invalidateBytes), msg.keys})
+		_ = msg.target.Write(push.ToResp3Bytes())
+		return
+	}
+	// RESP2 client cannot receive messages without redirect
+	if msg.redirected {
+		pubsub.SendToSubscriber(t.hub, pubsub.InvalidateChannel, msg.target, msg.keys)
+	}
+}
+
+// removeClient cleans up after client closed, clients redirecting to it are notified
+func (t *tracker) removeClient(c redis.Connection) {
+	if t.isEmpty() {
+		return
+	}
+	t.mu.Lock()
+	t.disable0(c)
+	var broken []redis.Connection
+	for client, tc := range t.clients {
+		if tc.opts.Redirect == c && !tc.redirectBroken {
+			tc.redirectBroken = true
+			broken = append(broken, client)
+		}
+	}
+	t.mu.Unlock()
+	for _, client := range broken {
+		if client.GetProtocol() >= protocol.RESP3 {
+			msg := protocol.MakePushReply([]redis.Reply{protocol.MakeBulkReply(trackingRedirBrokenBytes)})
+			_ = client.Write(msg.ToResp3Bytes())
+		}
+	}
+}
+
+/* ---- tracking commands of MultiDB ---- */
+
+// EnableTracking executes CLIENT TRACKING ON with options
+func (mdb *MultiDB) EnableTracking(c redis.Connection, opts *TrackingOptions) error {
+	return mdb.tracker.enable(c, opts)
+}
+
+// DisableTracking executes CLIENT TRACKING OFF
+func (mdb *MultiDB) DisableTracking(c redis.Connection) {
+	mdb.tracker.disable(c)
+}
+
+// SetTrackingCaching executes CLIENT CACHING yes|no
+func (mdb *MultiDB) SetTrackingCaching(c redis.Connection, caching bool) error {
+	return mdb.tracker.setCaching(c, caching)
+}
+
+// ResetTrackingCaching should be called after each command, because CLIENT CACHING only affects the next command
+func (mdb *MultiDB) ResetTrackingCaching(c redis.Connection) {
+	mdb.tracker.resetCaching(c)
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"testing"
+	"time"
+)
+
+func makeTrackingConn() *connection.FakeConn {
+	conn := &connection.FakeConn{}
+	conn.SetProtocol(protocol.RESP3)
+	return conn
+}
+
+func invalidateMessage(keys ...string) string {
+	push := protocol.MakePushReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("invalidate")),
+		protocol.MakeMultiBulkReply(utils.ToCmdLine(keys...)),
+	})
+	return string(push.ToResp3Bytes())
+}
+
+func TestTrackingDefault(t *testing.T) {
+	testServer.Exec(nil, utils.ToCmdLine("flushall"))
+	reader := makeTrackingConn()
+	writer := makeTrackingConn()
+	defer testServer.AfterClientClose(reader)
+	key := utils.RandString(10)
+	if err := testServer.EnableTracking(reader, &TrackingOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	testServer.Exec(writer, utils.ToCmdLine("set", key, "1"))
+	if len(reader.Bytes()) > 0 {
+		t.Errorf("key not read should not be invalidated: %q", reader.Bytes())
+	}
+	testServer.Exec(reader, utils.ToCmdLine("get", key))
+	reader.Clean()
+	testServer.Exec(writer, utils.ToCmdLine("set", key, "2"))
+	if string(reader.Bytes()) != invalidateMessage(key) {
+		t.Errorf("expect invalidation of %s, actually %q", key, reader.Bytes())
+	}
+	// key is forgotten until it is read again
+	reader.Clean()
+	testServer.Exec(writer, utils.ToCmdLine("set", key, "3"))
+	if len(reader.Bytes()) > 0 {
+		t.Errorf("invalidation should be sent only once: %q", reader.Bytes())
+	}
+
+	testServer.DisableTracking(reader)
+	testServer.Exec(reader, utils.ToCmdLine("get", key))
+	testServer.Exec(writer, utils.ToCmdLine("set", key, "4"))
+	if len(reader.Bytes()) > 0 {
+		t.Errorf("tracking is off: %q", reader.Bytes())
+	}
+}
+
+func TestTrackingBCast(t *testing.T) {
+	testServer.Exec(nil, utils.ToCmdLine("flushall"))
+	c := makeTrackingConn()
+	defer testServer.AfterClientClose(c)
+	err := testServer.EnableTracking(c, &TrackingOptions{BCast: true, Prefixes: []string{"user:"}, NoLoop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testServer.EnableTracking(c, &TrackingOptions{}); err == nil {
+		t.Error("expect error when switching BCAST mode")
+	}
+	writer := makeTrackingConn()
+	testServer.Exec(writer, utils.ToCmdLine("mset", "user:1", "a", "item:1", "b"))
+	if string(c.Bytes()) != invalidateMessage("user:1") {
+		t.Errorf("expect invalidation of user:1, actually %q", c.Bytes())
+	}
+	// NOLOOP skips keys modified by itself
+	c.Clean()
+	testServer.Exec(c, utils.ToCmdLine("set", "user:2", "c"))
+	if len(c.Bytes()) > 0 {
+		t.Errorf("keys modified by itself should be skipped: %q", c.Bytes())
+	}
+
+	// flush invalidates all keys with null
+	testServer.Exec(writer, utils.ToCmdLine("flushall"))
+	push := protocol.MakePushReply([]redis.Reply{protocol.MakeBulkReply([]byte("invalidate")), protocol.MakeNullBulkReply()})
+	if string(c.Bytes()) != string(push.ToResp3Bytes()) {
+		t.Errorf("expect null invalidation, actually %q", c.Bytes())
+	}
+}
+
+func TestTrackingOptIn(t *testing.T) {
+	testServer.Exec(nil, utils.ToCmdLine("flushall"))
+	c := makeTrackingConn()
+	defer testServer.AfterClientClose(c)
+	writer := makeTrackingConn()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	if err := testServer.SetTrackingCaching(c, true); err == nil {
+		t.Error("expect error when tracking is off")
+	}
+	if err := testServer.EnableTracking(c, &TrackingOptions{OptIn: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testServer.SetTrackingCaching(c, false); err == nil {
+		t.Error("expect error of CACHING no in OPTIN mode")
+	}
+	if err := testServer.SetTrackingCaching(c, true); err != nil {
+		t.Fatal(err)
+	}
+	testServer.Exec(c, utils.ToCmdLine("get", key1))
+	testServer.ResetTrackingCaching(c)
+	testServer.Exec(c, utils.ToCmdLine("get", key2))
+	testServer.ResetTrackingCaching(c)
+	testServer.Exec(writer, utils.ToCmdLine("mset", key1, "1", key2, "2"))
+	if string(c.Bytes()) != invalidateMessage(key1) {
+		t.Errorf("expect invalidation of %s only, actually %q", key1, c.Bytes())
+	}
+}
+
+// slowConn blocks writing until released
+type slowConn struct {
+	*connection.FakeConn
+	release chan struct{}
+}
+
+func (c *slowConn) Write(b []byte) error {
+	<-c.release
+	return c.FakeConn.Write(b)
+}
+
+func TestTrackingExpiredNotBlocking(t *testing.T) {
+	testServer.Exec(nil, utils.ToCmdLine("flushall"))
+	reader := &slowConn{FakeConn: makeTrackingConn(), release: make(chan struct{})}
+	defer testServer.AfterClientClose(reader)
+	if err := testServer.EnableTracking(reader, &TrackingOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	key := utils.RandString(10)
+	testServer.Exec(makeTrackingConn(), utils.ToCmdLine("set", key, "1", "px", "50"))
+	testServer.Exec(reader, utils.ToCmdLine("get", key))
+	time.Sleep(100 * time.Millisecond)
+
+	// invalidation of lazily expired key is blocked by reader
+	go testServer.Exec(makeTrackingConn(), utils.ToCmdLine("get", key))
+	time.Sleep(100 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		testServer.Exec(makeTrackingConn(), utils.ToCmdLine("set", key, "2"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("commands on expired key should not wait for slow tracking client")
+	}
+	close(reader.release)
+}
+
+func TestTrackingRenameAndMulti(t *testing.T) {
+	testServer.Exec(nil, utils.ToCmdLine("flushall"))
+	reader := makeTrackingConn()
+	defer testServer.AfterClientClose(reader)
+	writer := makeTrackingConn()
+	if err := testServer.EnableTracking(reader, &TrackingOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	src := utils.RandString(10)
+	dest := utils.RandString(10)
+	testServer.Exec(writer, utils.ToCmdLine("set", src, "1"))
+	testServer.Exec(reader, utils.ToCmdLine("get", src))
+	reader.Clean()
+	testServer.Exec(writer, utils.ToCmdLine("rename", src, dest))
+	if string(reader.Bytes()) != invalidateMessage(src) {
+		t.Errorf("expect invalidation of rename source %s, actually %q", src, reader.Bytes())
+	}
+
+	// keys read within transaction are tracked
+	testServer.Exec(reader, utils.ToCmdLine("multi"))
+	testServer.Exec(reader, utils.ToCmdLine("get", dest))
+	testServer.Exec(reader, utils.ToCmdLine("exec"))
+	reader.Clean()
+	testServer.Exec(writer, utils.ToCmdLine("set", dest, "2"))
+	if string(reader.Bytes()) != invalidateMessage(dest) {
+		t.Errorf("expect invalidation of %s read in multi, actually %q", dest, reader.Bytes())
+	}
+}
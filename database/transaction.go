@@ -5,6 +5,7 @@ import (
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/redis/protocol"
 	"strings"
+	"sync/atomic"
 )
 
 var forbiddenInMulti = set.Make(
@@ -29,7 +30,7 @@ func execGetVersion(db *DB, args [][]byte) redis.Reply {
 }
 
 func init() {
-	RegisterCommand("GetVer", execGetVersion, readAllKeys, nil, 2)
+	registerReadOnlyCommand("GetVer", execGetVersion, readAllKeys, nil, 2)
 }
 
 // invoker should lock watching keys
@@ -87,25 +88,45 @@ func (db *DB) ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLi
 	// prepare
 	writeKeys := make([]string, 0) // may contains duplicate
 	readKeys := make([]string, 0)
+	trackedKeys := make([]string, 0) // keys read by read only commands
+	writeCmdCount := 0
 	for _, cmdLine := range cmdLines {
 		cmdName := strings.ToLower(string(cmdLine[0]))
 		cmd := cmdTable[cmdName]
 		prepare := cmd.prepare
 		write, read := prepare(cmdLine[1:])
+		if len(write) > 0 {
+			writeCmdCount++
+		}
+		if cmd.flags&flagReadOnly > 0 {
+			trackedKeys = append(trackedKeys, read...)
+		}
 		writeKeys = append(writeKeys, write...)
 		readKeys = append(readKeys, read...)
 	}
+	if writeCmdCount > 0 {
+		if reply := db.aofErrReply(); reply != nil {
+			return reply
+		}
+	}
 	// set watch
 	watchingKeys := make([]string, 0, len(watching))
 	for key := range watching {
 		watchingKeys = append(watchingKeys, key)
 	}
 	readKeys = append(readKeys, watchingKeys...)
+	committed := false
+	// notify tracking clients after keys unlocked
+	defer func() {
+		if committed {
+			db.tracker.invalidate(conn, writeKeys)
+		}
+	}()
 	db.RWLocks(writeKeys, readKeys)
 	defer db.RWUnLocks(writeKeys, readKeys)
 
 	if isWatchingChanged(db, watching) { // watching keys changed, abort
-		return protocol.MakeEmptyMultiBulkReply()
+		return protocol.MakeNullMultiBulkReply()
 	}
 	// execute
 	results := make([]redis.Reply, 0, len(cmdLines))
@@ -124,6 +145,15 @@ func (db *DB) ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLi
 	}
 	if !aborted { //success
 		db.addVersion(writeKeys...)
+		atomic.AddInt64(&db.dirty, int64(writeCmdCount))
+		committed = true
+		// remember keys before unlocked, so that any following write will invalidate them
+		db.tracker.trackRead(conn, trackedKeys)
+		if writeCmdCount > 0 {
+			if reply := db.aofErrReply(); reply != nil {
+				return reply
+			}
+		}
 		return protocol.MakeMultiRawReply(results)
 	}
 	// undo if aborted
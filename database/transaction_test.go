@@ -3,6 +3,7 @@ package database
 import (
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
 	"testing"
 )
@@ -90,7 +91,9 @@ func TestWatch(t *testing.T) {
 		value2 := utils.RandString(10)
 		testServer.Exec(conn, utils.ToCmdLine("set", key2, value2))
 		result = testServer.Exec(conn, utils.ToCmdLine("exec"))
-		asserts.AssertNotError(t, result)
+		if _, ok := result.(*protocol.NullMultiBulkReply); !ok {
+			t.Errorf("expect null multi bulk of aborted exec, actually %s", result.ToBytes())
+		}
 		result = testServer.Exec(conn, utils.ToCmdLine("get", key2))
 		asserts.AssertNullBulk(t, result)
 		if len(conn.GetWatching()) > 0 {
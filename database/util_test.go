@@ -14,5 +14,6 @@ func makeTestDB() *DB {
 		addAof: func(line CmdLine) {
 
 		},
+		aofFailure: func() error { return nil },
 	}
 }
@@ -207,15 +207,9 @@ func (dict *ConcurrentDict) ForEach(consumer Consumer) {
 
 // Keys returns all keys in dict
 func (dict *ConcurrentDict) Keys() []string {
-	keys := make([]string, dict.Len())
-	i := 0
+	keys := make([]string, 0, dict.Len())
 	dict.ForEach(func(key string, val interface{}) bool {
-		if i < len(keys) {
-			keys[i] = key
-			i++
-		} else {
-			keys = append(keys, key)
-		}
+		keys = append(keys, key)
 		return true
 	})
 	return keys
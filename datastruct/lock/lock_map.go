@@ -166,3 +166,17 @@ func (locks *Locks) RWUnLocks(writeKeys []string, readKeys []string) {
 		}
 	}
 }
+
+// LockAll obtains all the exclusive locks, it blocks until no key is locked by others
+func (locks *Locks) LockAll() {
+	for _, mu := range locks.table {
+		mu.Lock()
+	}
+}
+
+// UnLockAll releases all the exclusive locks
+func (locks *Locks) UnLockAll() {
+	for i := len(locks.table) - 1; i >= 0; i-- {
+		locks.table[i].Unlock()
+	}
+}
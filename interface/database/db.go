@@ -2,6 +2,7 @@ package database
 
 import (
 	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/rdb/core"
 	"time"
 )
 
@@ -24,6 +25,17 @@ type EmbedDB interface {
 	ForEach(dbIndex int, cb func(key string, data *DataEntity, expiration *time.Time) bool)
 	RWLocks(dbIndex int, writeKeys []string, readKeys []string)
 	RWUnLocks(dbIndex int, writeKeys []string, readKeys []string)
+	// Snapshot creates a point-in-time view of all databases without stopping writes,
+	// atBarrier is invoked while no write command is executing
+	Snapshot(atBarrier func()) Snapshot
+	// LoadRDB loads objects in rdb format into databases
+	LoadRDB(decoder *core.Decoder) error
+}
+
+// Snapshot is a read-only point-in-time view of EmbedDB, it should be released after use
+type Snapshot interface {
+	ForEach(dbIndex int, cb func(key string, data *DataEntity, expiration *time.Time) bool)
+	Release()
 }
 
 // DataEntity stores data bound to a key, including a string, list, hash, set and so on
@@ -23,4 +23,11 @@ type Connection interface {
 	// used for multi database
 	GetDBIndex() int
 	SelectDB(int)
+
+	// protocol version negotiated by HELLO, 2 or 3
+	GetProtocol() int
+	SetProtocol(int)
+	// name set by HELLO SETNAME or CLIENT SETNAME
+	GetName() string
+	SetName(string)
 }
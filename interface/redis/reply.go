@@ -1,6 +1,23 @@
 package redis
 
+import "io"
+
 // Reply is the interface of redis serialization protocol message
 type Reply interface {
 	ToBytes() []byte
 }
+
+// Resp3Reply is a Reply encoded differently for clients using RESP3, ToBytes returns its RESP2 encoding
+type Resp3Reply interface {
+	Reply
+	ToResp3Bytes() []byte
+}
+
+// StreamReply is a Reply which could be encoded into a writer piece by piece, so that a large reply,
+// e.g. LRANGE of a huge list, is never built in memory as a whole.
+// WriteTo writes its RESP2 encoding and WriteResp3To writes its RESP3 encoding.
+type StreamReply interface {
+	Reply
+	io.WriterTo
+	WriteResp3To(w io.Writer) (int64, error)
+}
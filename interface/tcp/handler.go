@@ -13,3 +13,10 @@ type Handler interface {
 	Handle(ctx context.Context, conn net.Conn)
 	Close() error
 }
+
+// ShutdownHandler is a Handler which could request the server to stop, e.g. by SHUTDOWN command
+type ShutdownHandler interface {
+	Handler
+	// ShutdownRequested returns a channel closed when the handler requests the server to stop
+	ShutdownRequested() <-chan struct{}
+}
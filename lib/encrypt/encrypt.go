@@ -0,0 +1,432 @@
+// Package encrypt provides authenticated encryption of persistence files with AES-GCM
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+ * An encrypted file consists of a header and a sequence of chunks, each Write call of Writer produces a chunk,
+ * and Close produces the final chunk which is empty.
+ * header: magic(8 bytes) version(1 byte) key id(8 bytes) nonce prefix(12 bytes)
+ * chunk: length of sealed data(4 bytes, big endian) sealed data
+ * The nonce of a chunk is the nonce prefix XOR its index, so that reordered or missing chunks fail authentication.
+ * The additional data of a chunk is the header followed by a flag byte of the final chunk,
+ * so that a modified header or a file truncated at chunk boundary is detected.
+ */
+
+const (
+	// Magic is the beginning of encrypted files
+	Magic   = "GODISENC"
+	version = 1
+
+	keyIDSize  = 8
+	nonceSize  = 12
+	headerSize = len(Magic) + 1 + keyIDSize + nonceSize
+	// maxChunkSize limits memory used by a corrupted length
+	maxChunkSize = 1 << 30
+
+	// flags in additional data of chunks
+	flagData  = 0
+	flagFinal = 1
+)
+
+var (
+	// ErrNoKey means file is encrypted but no key is configured
+	ErrNoKey = errors.New("file is encrypted but no encryption key is configured")
+	// ErrWrongKey means file is encrypted by a key which is not configured
+	ErrWrongKey = errors.New("file is encrypted by another key, please check encryption-key-file and encryption-old-key-files")
+	// ErrAuthFailed means a chunk is corrupted or modified
+	ErrAuthFailed = errors.New("message authentication failed, encrypted file is corrupted")
+	// ErrClosed means writing into a closed Writer
+	ErrClosed = errors.New("write to closed encrypted file")
+)
+
+// Key is an AES key for encrypting files
+type Key struct {
+	// ID is derived from the key, it is stored in file header to find the key for decrypting
+	ID   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+// NewKey creates Key from 16, 24 or 32 bytes for AES-128, AES-192 or AES-256
+func NewKey(secret []byte) (*Key, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{aead: aead}
+	sum := sha256.Sum256(secret)
+	copy(key.ID[:], sum[:])
+	return key, nil
+}
+
+// LoadKey reads key file, which contains the key in hex or in raw bytes
+func LoadKey(filename string) (*Key, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	secret := data
+	if decoded, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		secret = decoded
+	}
+	key, err := NewKey(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %v", filename, err)
+	}
+	return key, nil
+}
+
+// Keyring holds the key for writing and old keys for reading files written before key rotation
+type Keyring struct {
+	current *Key
+	keys    map[[keyIDSize]byte]*Key
+}
+
+// NewKeyring creates Keyring, current could be nil if encryption is disabled
+func NewKeyring(current *Key, old ...*Key) *Keyring {
+	keyring := &Keyring{
+		current: current,
+		keys:    make(map[[keyIDSize]byte]*Key),
+	}
+	for _, key := range old {
+		keyring.keys[key.ID] = key
+	}
+	if current != nil {
+		keyring.keys[current.ID] = current
+	}
+	return keyring
+}
+
+// LoadKeyring reads current key file and old key files, encryption is disabled if currentFile is empty
+func LoadKeyring(currentFile string, oldFiles []string) (*Keyring, error) {
+	var current *Key
+	var old []*Key
+	if currentFile != "" {
+		key, err := LoadKey(currentFile)
+		if err != nil {
+			return nil, err
+		}
+		current = key
+	}
+	for _, filename := range oldFiles {
+		if filename == "" {
+			continue
+		}
+		key, err := LoadKey(filename)
+		if err != nil {
+			return nil, err
+		}
+		old = append(old, key)
+	}
+	return NewKeyring(current, old...), nil
+}
+
+// Current returns the key for writing, nil if encryption is disabled
+func (keyring *Keyring) Current() *Key {
+	if keyring == nil {
+		return nil
+	}
+	return keyring.current
+}
+
+// IsEncrypted tells whether a file starting with prefix is encrypted
+func IsEncrypted(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(Magic))
+}
+
+func makeNonce(prefix []byte, index uint64) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, prefix)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], index)
+	for i := 0; i < 8; i++ {
+		nonce[nonceSize-8+i] ^= buf[i]
+	}
+	return nonce
+}
+
+// makeAdditionalData returns additional data of chunks, the last byte is the flag
+func makeAdditionalData(header []byte) []byte {
+	ad := make([]byte, len(header)+1)
+	copy(ad, header)
+	return ad
+}
+
+// sealChunk appends a sealed chunk to dst
+func sealChunk(dst []byte, key *Key, nonce []byte, plain []byte, ad []byte) []byte {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	dst = key.aead.Seal(dst, nonce, plain, ad)
+	binary.BigEndian.PutUint32(dst[start:], uint32(len(dst)-start-4))
+	return dst
+}
+
+// Writer encrypts data written into it, each Write call produces a chunk.
+// Close must be called after all data written, otherwise the file is regarded as truncated.
+type Writer struct {
+	writer      io.Writer
+	key         *Key
+	noncePrefix []byte
+	ad          []byte
+	index       uint64
+	buf         []byte
+	closed      bool
+}
+
+// NewWriter writes header into writer and returns a Writer encrypting data by key
+func NewWriter(writer io.Writer, key *Key) (*Writer, error) {
+	noncePrefix := make([]byte, nonceSize)
+	_, err := rand.Read(noncePrefix)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, headerSize)
+	header = append(header, Magic...)
+	header = append(header, version)
+	header = append(header, key.ID[:]...)
+	header = append(header, noncePrefix...)
+	_, err = writer.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		writer:      writer,
+		key:         key,
+		noncePrefix: noncePrefix,
+		ad:          makeAdditionalData(header),
+	}, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// NopCloser returns a WriteCloser with a no-op Close method wrapping w
+func NopCloser(w io.Writer) io.WriteCloser {
+	return nopCloser{w}
+}
+
+// WrapWriter returns writer with a no-op Close method if key is nil, otherwise a Writer encrypting data by key
+func WrapWriter(writer io.Writer, key *Key) (io.WriteCloser, error) {
+	if key == nil {
+		return NopCloser(writer), nil
+	}
+	return NewWriter(writer, key)
+}
+
+// Write encrypts p as a chunk, it returns len(p) if the whole chunk was written
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	w.ad[len(w.ad)-1] = flagData
+	w.buf = sealChunk(w.buf[:0], w.key, makeNonce(w.noncePrefix, w.index), p, w.ad)
+	_, err := w.writer.Write(w.buf)
+	if err != nil {
+		return 0, err
+	}
+	w.index++
+	return len(p), nil
+}
+
+// Close writes the final chunk, it does not close the underlying writer
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.ad[len(w.ad)-1] = flagFinal
+	w.buf = sealChunk(w.buf[:0], w.key, makeNonce(w.noncePrefix, w.index), nil, w.ad)
+	_, err := w.writer.Write(w.buf)
+	if err != nil {
+		return err
+	}
+	w.closed = true
+	return nil
+}
+
+// Reader decrypts an encrypted file
+type Reader struct {
+	reader      io.Reader
+	key         *Key
+	noncePrefix []byte
+	ad          []byte
+	index       uint64
+	plain       []byte // decrypted data not read yet
+	sealed      []byte
+	// end of the last authenticated chunk in file
+	validOffset int64
+	err         error
+	truncated   bool
+	// file ends at chunk boundary without the final chunk
+	missingFinal bool
+	// the final chunk has been read
+	finished bool
+}
+
+// NewReader reads header from reader and finds the key in keyring
+func NewReader(reader io.Reader, keyring *Keyring) (*Reader, error) {
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("read header of encrypted file failed: %v", err)
+	}
+	if !IsEncrypted(header) {
+		return nil, errors.New("file is not encrypted")
+	}
+	if header[len(Magic)] != version {
+		return nil, fmt.Errorf("unsupported version of encrypted file: %d", header[len(Magic)])
+	}
+	if keyring == nil || len(keyring.keys) == 0 {
+		return nil, ErrNoKey
+	}
+	var id [keyIDSize]byte
+	copy(id[:], header[len(Magic)+1:])
+	key, ok := keyring.keys[id]
+	if !ok {
+		return nil, ErrWrongKey
+	}
+	return &Reader{
+		reader:      reader,
+		key:         key,
+		noncePrefix: header[len(Magic)+1+keyIDSize:],
+		ad:          makeAdditionalData(header),
+		validOffset: int64(headerSize),
+	}, nil
+}
+
+// WrapReader returns reader itself if its data is not encrypted, otherwise a *Reader decrypting data by keyring
+func WrapReader(reader *bufio.Reader, keyring *Keyring) (io.Reader, error) {
+	prefix, _ := reader.Peek(len(Magic))
+	if !IsEncrypted(prefix) {
+		return reader, nil
+	}
+	return NewReader(reader, keyring)
+}
+
+// Read reads decrypted data, it returns io.ErrUnexpectedEOF if file ends without the final chunk
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.readChunk()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *Reader) readChunk() error {
+	var lenBuf [4]byte
+	n, err := io.ReadFull(r.reader, lenBuf[:])
+	if r.finished {
+		if err == io.EOF {
+			return io.EOF
+		}
+		// data after the final chunk
+		return ErrAuthFailed
+	}
+	if err == io.EOF {
+		// truncated at chunk boundary
+		r.truncated = true
+		r.missingFinal = true
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		if n > 0 && err == io.ErrUnexpectedEOF {
+			r.truncated = true
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(lenBuf[:])
+	if size > maxChunkSize {
+		return ErrAuthFailed
+	}
+	if cap(r.sealed) < int(size) {
+		r.sealed = make([]byte, size)
+	}
+	r.sealed = r.sealed[:size]
+	_, err = io.ReadFull(r.reader, r.sealed)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.truncated = true
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	nonce := makeNonce(r.noncePrefix, r.index)
+	// data chunks are never empty, so a chunk without plain data must be the final one
+	final := int(size) == r.key.aead.Overhead()
+	if final {
+		r.ad[len(r.ad)-1] = flagFinal
+	} else {
+		r.ad[len(r.ad)-1] = flagData
+	}
+	plain, err := r.key.aead.Open(r.plain[:0], nonce, r.sealed, r.ad)
+	if err != nil {
+		return ErrAuthFailed
+	}
+	r.plain = plain
+	r.index++
+	r.validOffset += int64(4 + size)
+	r.finished = final
+	return nil
+}
+
+// WriteFinal appends the final chunk to a file truncated after the last authenticated chunk,
+// so that the rest of the file could be read as a complete one. The file must have been read until truncated.
+func (r *Reader) WriteFinal(w io.Writer) error {
+	if r.finished || !r.truncated {
+		return errors.New("encrypted file is not truncated")
+	}
+	r.ad[len(r.ad)-1] = flagFinal
+	chunk := sealChunk(nil, r.key, makeNonce(r.noncePrefix, r.index), nil, r.ad)
+	_, err := w.Write(chunk)
+	return err
+}
+
+// ValidOffset returns end of the last authenticated chunk in file, the file could be truncated to it
+func (r *Reader) ValidOffset() int64 {
+	return r.validOffset
+}
+
+// Truncated tells whether the file ends without the final chunk, either the last chunk is incomplete or missing
+func (r *Reader) Truncated() bool {
+	return r.truncated
+}
+
+// MissingFinal tells whether the file ends at chunk boundary without the final chunk, e.g. the writer crashed before Close.
+// Unlike an incomplete chunk, all the data written before is authenticated
+func (r *Reader) MissingFinal() bool {
+	return r.missingFinal
+}
+
+// HasUnread tells whether there is decrypted data not read yet
+func (r *Reader) HasUnread() bool {
+	return len(r.plain) > 0
+}
@@ -0,0 +1,155 @@
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func makeTestKey(t *testing.T, b byte) *Key {
+	key, err := NewKey(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncrypt(t *testing.T) {
+	key := makeTestKey(t, 1)
+	buf := &bytes.Buffer{}
+	writer, err := NewWriter(buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []string{"hello", "world", "godis"}
+	for _, chunk := range chunks {
+		_, err = writer.Write([]byte(chunk))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Write([]byte("more")); err != ErrClosed {
+		t.Errorf("expect ErrClosed, actually %v", err)
+	}
+	data := buf.Bytes()
+	if bytes.Contains(data, []byte("hello")) {
+		t.Error("data is not encrypted")
+	}
+
+	reader, err := WrapReader(bufio.NewReader(bytes.NewReader(data)), NewKeyring(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "helloworldgodis" {
+		t.Errorf("wrong plain data: %s", plain)
+	}
+
+	// rotated key could still read old files
+	_, err = NewReader(bytes.NewReader(data), NewKeyring(makeTestKey(t, 2), key))
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = NewReader(bytes.NewReader(data), NewKeyring(makeTestKey(t, 2)))
+	if err != ErrWrongKey {
+		t.Errorf("expect ErrWrongKey, actually %v", err)
+	}
+	_, err = NewReader(bytes.NewReader(data), NewKeyring(nil))
+	if err != ErrNoKey {
+		t.Errorf("expect ErrNoKey, actually %v", err)
+	}
+
+	// truncated inside a chunk
+	finalSize := 4 + 16
+	reader2, err := NewReader(bytes.NewReader(data[:len(data)-finalSize-3]), NewKeyring(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err = ioutil.ReadAll(reader2)
+	if err != io.ErrUnexpectedEOF || string(plain) != "helloworld" || !reader2.Truncated() || reader2.MissingFinal() {
+		t.Errorf("expect truncated, actually %s %v", plain, err)
+	}
+	if reader2.ValidOffset() != int64(len(data)-finalSize-(4+5+16)) {
+		t.Errorf("wrong valid offset %d", reader2.ValidOffset())
+	}
+
+	// truncated at chunk boundary
+	for _, size := range []int{len(data) - finalSize, len(data) - finalSize - (4 + 5 + 16)} {
+		reader2, err = NewReader(bytes.NewReader(data[:size]), NewKeyring(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(reader2)
+		if err != io.ErrUnexpectedEOF || !reader2.MissingFinal() || reader2.ValidOffset() != int64(size) {
+			t.Errorf("expect truncated at %d, actually %v", size, err)
+		}
+		// fixed by appending the final chunk
+		fixed := bytes.NewBuffer(append([]byte{}, data[:size]...))
+		if err = reader2.WriteFinal(fixed); err != nil {
+			t.Fatal(err)
+		}
+		reader2, err = NewReader(fixed, NewKeyring(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(reader2)
+		if err != nil || reader2.Truncated() {
+			t.Errorf("expect fixed file valid, actually %v", err)
+		}
+	}
+
+	// data after the final chunk
+	reader2, err = NewReader(bytes.NewReader(append(append([]byte{}, data...), data[headerSize:]...)), NewKeyring(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(reader2); err != ErrAuthFailed {
+		t.Errorf("expect ErrAuthFailed, actually %v", err)
+	}
+
+	// tampered
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-finalSize-1] ^= 1
+	reader3, err := NewReader(bytes.NewReader(tampered), NewKeyring(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(reader3)
+	if err != ErrAuthFailed {
+		t.Errorf("expect ErrAuthFailed, actually %v", err)
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	file, err := ioutil.TempFile("", "*.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	_, _ = file.WriteString("0101010101010101010101010101010101010101010101010101010101010101\n")
+	_ = file.Close()
+	key, err := LoadKey(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != makeTestKey(t, 1).ID {
+		t.Error("hex key is not decoded")
+	}
+
+	_ = ioutil.WriteFile(file.Name(), []byte("short"), 0600)
+	_, err = LoadKey(file.Name())
+	if err == nil {
+		t.Error("expect error for invalid key size")
+	}
+}
@@ -0,0 +1,32 @@
+package rdb
+
+// redis uses crc-64-jones (reflected, init 0, no final xor) as rdb checksum,
+// which is not provided by hash/crc64
+
+const jonesPoly = 0x95ac9329ac4bc9b5 // reversed form of 0xad93d23594c935a9
+
+var crcTable = makeCRCTable()
+
+func makeCRCTable() *[256]uint64 {
+	table := new([256]uint64)
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ jonesPoly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+// CRC64 updates crc with p using the checksum algorithm of redis
+func CRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crcTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
@@ -0,0 +1,452 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/rdb/core"
+	"io"
+)
+
+/*
+ * The decoder of github.com/hdt3213/rdb v1.0.0 has three bugs in Decoder.parse:
+ * a key without expiration inherits the expiration of the previous key,
+ * the type byte following the lfu frequency or lru idle time of an object is taken as its key,
+ * and expiration in seconds is read as 8 bytes while redis writes 4 bytes.
+ * compatReader rewrites the rdb stream before it reaches the decoder:
+ * lfu and lru opcodes are dropped, expiration in seconds is converted to milliseconds,
+ * and a zero expiration is inserted before each key without expiration.
+ * Remove it once an upstream release contains the fixes.
+ *
+ * compatReader also handles objects the decoder does not support, e.g. streams:
+ * in strict mode decoding fails, otherwise they are skipped.
+ */
+
+const (
+	opCodeIdle       = 248
+	opCodeFreq       = 249
+	opCodeResizeDB   = 251
+	opCodeExpireTime = 253
+
+	typeZSet          = 3
+	typeModule2       = 7
+	typeHashZipMap    = 9
+	typeListZipList   = 10
+	typeSetIntSet     = 11
+	typeZSetZipList   = 12
+	typeHashZipList   = 13
+	typeListQuickList = 14
+	typeStream        = 15
+
+	moduleOpCodeEOF    = 0
+	moduleOpCodeSInt   = 1
+	moduleOpCodeUInt   = 2
+	moduleOpCodeFloat  = 3
+	moduleOpCodeDouble = 4
+	moduleOpCodeString = 5
+
+	lenSpecial = 0xC0
+	encInt8    = 0
+	encInt16   = 1
+	encInt32   = 2
+	encLZF     = 3
+)
+
+var zeroExpiration = []byte{opCodeExpireTimeMs, 0, 0, 0, 0, 0, 0, 0, 0}
+
+// NewDecoder creates a decoder of github.com/hdt3213/rdb which works around its bugs, see compatReader.
+// If strict is true, decoding fails at an object of unsupported type, otherwise the object is skipped.
+// If reader is a *bufio.Reader, the bytes following the EOF opcode are not consumed, e.g. the checksum
+func NewDecoder(reader io.Reader, strict bool) *core.Decoder {
+	src, ok := reader.(*bufio.Reader)
+	if !ok {
+		src = bufio.NewReader(reader)
+	}
+	return core.NewDecoder(&compatReader{src: src, strict: strict})
+}
+
+// compatReader copies rdb stream object by object, and stops at the EOF opcode
+type compatReader struct {
+	src    *bufio.Reader
+	buf    bytes.Buffer
+	strict bool
+	// buffer for fixed size integers
+	scratch [8]byte
+	// header has been copied
+	started bool
+	// returned after buf drained
+	err error
+}
+
+func (r *compatReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	return r.buf.Read(p)
+}
+
+// next copies a header, an opcode or an object into buf, it returns io.EOF after the EOF opcode
+func (r *compatReader) next() error {
+	if !r.started {
+		r.started = true
+		return r.copyN(9) // magic number and version
+	}
+	b, err := r.src.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case opCodeEOF:
+		r.buf.WriteByte(b)
+		return io.EOF
+	case opCodeIdle:
+		mark := r.buf.Len()
+		_, _, err = r.copyLength()
+		r.buf.Truncate(mark)
+		return err
+	case opCodeFreq:
+		_, err = r.src.ReadByte()
+		return err
+	case opCodeSelectDB:
+		r.buf.WriteByte(b)
+		_, _, err = r.copyLength()
+		return err
+	case opCodeResizeDB:
+		r.buf.WriteByte(b)
+		if _, _, err = r.copyLength(); err != nil {
+			return err
+		}
+		_, _, err = r.copyLength()
+		return err
+	case opCodeAux:
+		r.buf.WriteByte(b)
+		if err = r.copyString(); err != nil {
+			return err
+		}
+		return r.copyString()
+	}
+	// an object is copied with its expiration at once, so that it can be dropped entirely
+	mark := r.buf.Len()
+	switch b {
+	case opCodeExpireTime:
+		// 4 bytes unix time in seconds
+		if _, err = io.ReadFull(r.src, r.scratch[:4]); err != nil {
+			return unexpectedEOF(err)
+		}
+		expireMs := int64(int32(binary.LittleEndian.Uint32(r.scratch[:4]))) * 1000
+		r.buf.WriteByte(opCodeExpireTimeMs)
+		binary.LittleEndian.PutUint64(r.scratch[:], uint64(expireMs))
+		r.buf.Write(r.scratch[:])
+	case opCodeExpireTimeMs:
+		r.buf.WriteByte(b)
+		if err = r.copyN(8); err != nil {
+			return unexpectedEOF(err)
+		}
+	default:
+		r.buf.Write(zeroExpiration)
+		r.src.UnreadByte()
+	}
+	typ, err := r.readType()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	r.buf.WriteByte(typ)
+	keyBegin := r.buf.Len()
+	if err = r.copyString(); err != nil {
+		return unexpectedEOF(err)
+	}
+	if isSupportedType(typ) {
+		return unexpectedEOF(r.copyValue(typ))
+	}
+	key := string(r.buf.Bytes()[keyBegin:])
+	if r.strict {
+		r.buf.Truncate(mark)
+		return fmt.Errorf("unsupported type %d of key %s", typ, key)
+	}
+	if err = r.copyUnsupportedValue(typ); err != nil {
+		r.buf.Truncate(mark)
+		return unexpectedEOF(err)
+	}
+	r.buf.Truncate(mark)
+	logger.Warn(fmt.Sprintf("skip key %s of unsupported type %d", key, typ))
+	return nil
+}
+
+// readType reads the type of object, skipping lfu frequency and lru idle time between expiration and type
+func (r *compatReader) readType() (byte, error) {
+	for {
+		b, err := r.src.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case opCodeIdle:
+			mark := r.buf.Len()
+			_, _, err = r.copyLength()
+			r.buf.Truncate(mark)
+		case opCodeFreq:
+			_, err = r.src.ReadByte()
+		default:
+			return b, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// unexpectedEOF converts io.EOF in the middle of an object
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func isSupportedType(typ byte) bool {
+	switch typ {
+	case typeString, typeList, typeSet, typeZSet, typeHash, typeZSet2,
+		typeHashZipMap, typeListZipList, typeSetIntSet, typeZSetZipList, typeHashZipList, typeListQuickList:
+		return true
+	}
+	return false
+}
+
+func (r *compatReader) copyValue(typ byte) error {
+	switch typ {
+	case typeList, typeSet, typeListQuickList, typeHash:
+		size, _, err := r.copyLength()
+		if err != nil {
+			return err
+		}
+		if typ == typeHash {
+			size *= 2
+		}
+		for i := uint64(0); i < size; i++ {
+			if err = r.copyString(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case typeZSet, typeZSet2:
+		size, _, err := r.copyLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < size; i++ {
+			if err = r.copyString(); err != nil {
+				return err
+			}
+			if typ == typeZSet2 {
+				err = r.copyN(8)
+			} else {
+				err = r.copyFloat()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// other types are encoded as a single string
+	return r.copyString()
+}
+
+// copyUnsupportedValue copies a value which the decoder does not support, so that it can be skipped
+func (r *compatReader) copyUnsupportedValue(typ byte) error {
+	switch typ {
+	case typeStream:
+		return r.copyStream()
+	case typeModule2:
+		return r.copyModule()
+	}
+	// module values of version 1 can only be read by the module itself
+	return fmt.Errorf("cannot skip object of type %d", typ)
+}
+
+// copyStream copies a stream in rdb version 9
+func (r *compatReader) copyStream() error {
+	listPacks, _, err := r.copyLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < listPacks*2; i++ { // master id and listpack
+		if err = r.copyString(); err != nil {
+			return err
+		}
+	}
+	if err = r.copyLengths(3); err != nil { // length and last id
+		return err
+	}
+	groups, _, err := r.copyLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < groups; i++ {
+		if err = r.copyString(); err != nil { // name
+			return err
+		}
+		if err = r.copyLengths(2); err != nil { // last id
+			return err
+		}
+		pending, _, err := r.copyLength()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < pending; j++ {
+			if err = r.copyN(16 + 8); err != nil { // id and delivery time
+				return err
+			}
+			if err = r.copyLengths(1); err != nil { // delivery count
+				return err
+			}
+		}
+		consumers, _, err := r.copyLength()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < consumers; j++ {
+			if err = r.copyString(); err != nil { // name
+				return err
+			}
+			if err = r.copyN(8); err != nil { // seen time
+				return err
+			}
+			pending, _, err := r.copyLength()
+			if err != nil {
+				return err
+			}
+			if err = r.copyN(pending * 16); err != nil { // ids
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyModule copies a module value of version 2, which consists of opcodes and ends with eof opcode
+func (r *compatReader) copyModule() error {
+	if err := r.copyLengths(1); err != nil { // module id
+		return err
+	}
+	for {
+		opCode, _, err := r.copyLength()
+		if err != nil {
+			return err
+		}
+		switch opCode {
+		case moduleOpCodeEOF:
+			return nil
+		case moduleOpCodeSInt, moduleOpCodeUInt:
+			err = r.copyLengths(1)
+		case moduleOpCodeFloat:
+			err = r.copyN(4)
+		case moduleOpCodeDouble:
+			err = r.copyN(8)
+		case moduleOpCodeString:
+			err = r.copyString()
+		default:
+			err = fmt.Errorf("illegal module opcode %d", opCode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *compatReader) copyLengths(n int) error {
+	for i := 0; i < n; i++ {
+		if _, _, err := r.copyLength(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *compatReader) copyN(n uint64) error {
+	copied, err := io.CopyN(&r.buf, r.src, int64(n))
+	if err == io.EOF && copied > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// copyLength copies a length, special is true if the length is an encoding type of string
+func (r *compatReader) copyLength() (length uint64, special bool, err error) {
+	b, err := r.src.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	r.buf.WriteByte(b)
+	switch {
+	case b&lenSpecial == lenSpecial:
+		return uint64(b &^ lenSpecial), true, nil
+	case b&lenSpecial == len14Bit:
+		next, err := r.src.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		r.buf.WriteByte(next)
+		return uint64(b&^lenSpecial)<<8 | uint64(next), false, nil
+	case b == len32Bit:
+		if err = r.copyN(4); err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(r.buf.Bytes()[r.buf.Len()-4:])), false, nil
+	case b == len64Bit:
+		if err = r.copyN(8); err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(r.buf.Bytes()[r.buf.Len()-8:]), false, nil
+	case b&lenSpecial == len6Bit:
+		return uint64(b), false, nil
+	}
+	return 0, false, errors.New("illegal length encoding")
+}
+
+func (r *compatReader) copyString() error {
+	length, special, err := r.copyLength()
+	if err != nil {
+		return err
+	}
+	if !special {
+		return r.copyN(length)
+	}
+	switch length {
+	case encInt8:
+		return r.copyN(1)
+	case encInt16:
+		return r.copyN(2)
+	case encInt32:
+		return r.copyN(4)
+	case encLZF:
+		compressed, _, err := r.copyLength()
+		if err != nil {
+			return err
+		}
+		if _, _, err = r.copyLength(); err != nil { // uncompressed length
+			return err
+		}
+		return r.copyN(compressed)
+	}
+	return errors.New("illegal string encoding")
+}
+
+// copyFloat copies a score of zset in string format
+func (r *compatReader) copyFloat() error {
+	b, err := r.src.ReadByte()
+	if err != nil {
+		return err
+	}
+	r.buf.WriteByte(b)
+	if b >= 253 { // nan, +inf and -inf
+		return nil
+	}
+	return r.copyN(uint64(b))
+}
@@ -0,0 +1,166 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/hdt3213/rdb/parser"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	expiration := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	checkErr := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkErr(enc.WriteHeader())
+	checkErr(enc.WriteSelectDB(0))
+	checkErr(enc.WriteStringObject("ttl", []byte("1"), &expiration))
+	checkErr(enc.WriteStringObject("persist", []byte("2"), nil))
+	// lru idle time in 14 bit length, followed by a string encoded as int8
+	_, err := enc.Write([]byte{opCodeIdle, 0x41, 0x00, typeString, 3, 'i', 'n', 't', 0xC0, 7})
+	checkErr(err)
+	// lfu frequency, followed by a zset with string scores
+	_, err = enc.Write([]byte{opCodeFreq, 5, typeZSet, 4, 'z', 's', 'e', 't', 2, 1, 'a', 3, '1', '.', '5', 1, 'b', 254})
+	checkErr(err)
+	checkErr(enc.WriteHashObject("hash", map[string][]byte{"f": []byte("v")}, nil))
+	checkErr(enc.WriteEnd())
+	buf.WriteString("*1\r\n$4\r\nPING\r\n")
+
+	reader := bufio.NewReader(buf)
+	objects := make(map[string]parser.RedisObject)
+	err = NewDecoder(reader, true).Parse(func(o parser.RedisObject) bool {
+		objects[o.GetKey()] = o
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 5 {
+		t.Errorf("expect 5 objects, actually %d", len(objects))
+	}
+	if o := objects["ttl"]; o == nil || o.GetExpiration() == nil || !o.GetExpiration().Equal(expiration) {
+		t.Error("wrong expiration of ttl")
+	}
+	for key, o := range objects {
+		if key != "ttl" && o.GetExpiration() != nil {
+			t.Errorf("unexpected expiration of %s", key)
+		}
+	}
+	if o, ok := objects["int"].(*parser.StringObject); !ok || string(o.Value) != "7" {
+		t.Error("wrong object after lru idle time")
+	}
+	if o, ok := objects["zset"].(*parser.ZSetObject); !ok || len(o.Entries) != 2 || o.Entries[0].Score != 1.5 {
+		t.Error("wrong object after lfu frequency")
+	}
+
+	// data following rdb is not consumed
+	if _, err = reader.Discard(8); err != nil { // checksum
+		t.Fatal(err)
+	}
+	remains, _ := ioutil.ReadAll(reader)
+	if string(remains) != "*1\r\n$4\r\nPING\r\n" {
+		t.Errorf("wrong remains after rdb: %q", remains)
+	}
+}
+
+func TestDecoderExpireTimeSeconds(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	checkErr := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkErr(enc.WriteHeader())
+	checkErr(enc.WriteSelectDB(0))
+	expiration := time.Now().Add(time.Hour).Truncate(time.Second)
+	seconds := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seconds, uint32(expiration.Unix()))
+	// expiration in seconds, followed by lru idle time
+	_, err := enc.Write(append(append([]byte{opCodeExpireTime}, seconds...), opCodeIdle, 1, typeString, 1, 'a', 1, '1'))
+	checkErr(err)
+	checkErr(enc.WriteStringObject("b", []byte("2"), nil))
+	checkErr(enc.WriteEnd())
+
+	objects := make(map[string]parser.RedisObject)
+	err = NewDecoder(buf, true).Parse(func(o parser.RedisObject) bool {
+		objects[o.GetKey()] = o
+		return true
+	})
+	checkErr(err)
+	if o := objects["a"]; o == nil || o.GetExpiration() == nil || !o.GetExpiration().Equal(expiration) {
+		t.Errorf("wrong expiration of a")
+	}
+	if o, ok := objects["b"].(*parser.StringObject); !ok || string(o.Value) != "2" || o.GetExpiration() != nil {
+		t.Error("wrong object after expiration in seconds")
+	}
+}
+
+func TestDecoderUnsupportedType(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	checkErr := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkErr(enc.WriteHeader())
+	checkErr(enc.WriteSelectDB(0))
+	checkErr(enc.WriteStringObject("a", []byte("1"), nil))
+	// stream with a listpack, a consumer group, a pending entry and a consumer
+	stream := []byte{typeStream, 6, 's', 't', 'r', 'e', 'a', 'm', 1, 2, 'i', 'd', 2, 'l', 'p', 1, 1, 0, 1, 5, 'g', 'r', 'o', 'u', 'p', 1, 0, 1}
+	stream = append(stream, make([]byte, 24)...) // id and delivery time
+	stream = append(stream, 1, 1, 1, 'c')        // delivery count and consumer name
+	stream = append(stream, make([]byte, 8)...)  // seen time
+	stream = append(stream, 1)
+	stream = append(stream, make([]byte, 16)...) // pending id of consumer
+	_, err := enc.Write(stream)
+	checkErr(err)
+	// module value with every kind of opcode
+	expiration := time.Now().Add(time.Hour)
+	ms := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ms, uint64(expiration.UnixNano()/int64(time.Millisecond)))
+	module := append([]byte{opCodeExpireTimeMs}, ms...)
+	module = append(module, typeModule2, 6, 'm', 'o', 'd', 'u', 'l', 'e', 0x80, 0, 0, 0, 1,
+		moduleOpCodeSInt, 1, moduleOpCodeUInt, 2,
+		moduleOpCodeFloat, 0, 0, 0, 0, moduleOpCodeDouble, 0, 0, 0, 0, 0, 0, 0, 0,
+		moduleOpCodeString, 1, 'x', moduleOpCodeEOF)
+	_, err = enc.Write(module)
+	checkErr(err)
+	checkErr(enc.WriteStringObject("b", []byte("2"), nil))
+	checkErr(enc.WriteEnd())
+	data := buf.Bytes()
+
+	keys := make(map[string]bool)
+	err = NewDecoder(bytes.NewReader(data), false).Parse(func(o parser.RedisObject) bool {
+		keys[o.GetKey()] = true
+		if o.GetExpiration() != nil {
+			t.Errorf("unexpected expiration of %s", o.GetKey())
+		}
+		return true
+	})
+	checkErr(err)
+	if len(keys) != 2 || !keys["a"] || !keys["b"] {
+		t.Errorf("expect a and b, actually %v", keys)
+	}
+
+	keys = make(map[string]bool)
+	err = NewDecoder(bytes.NewReader(data), true).Parse(func(o parser.RedisObject) bool {
+		keys[o.GetKey()] = true
+		return true
+	})
+	if err == nil || !strings.Contains(err.Error(), "unsupported type") {
+		t.Errorf("expect error of unsupported type, actually %v", err)
+	}
+	if len(keys) != 1 || !keys["a"] {
+		t.Errorf("expect a before unsupported type, actually %v", keys)
+	}
+}
@@ -0,0 +1,241 @@
+// Package rdb writes redis objects in redis compatible RDB format
+package rdb
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	version = "0009"
+
+	opCodeAux          = 250
+	opCodeExpireTimeMs = 252
+	opCodeSelectDB     = 254
+	opCodeEOF          = 255
+
+	typeString = 0
+	typeList   = 1
+	typeSet    = 2
+	typeHash   = 4
+	typeZSet2  = 5
+
+	len6Bit  = 0x00
+	len14Bit = 0x40
+	len32Bit = 0x80
+	len64Bit = 0x81
+)
+
+// ZSetEntry is a member-score pair in sorted set
+type ZSetEntry struct {
+	Member string
+	Score  float64
+}
+
+// Encoder writes RDB file, all the written bytes are included in the checksum
+type Encoder struct {
+	writer io.Writer
+	crc    uint64
+	buffer []byte
+}
+
+// NewEncoder creates an Encoder writing into writer
+func NewEncoder(writer io.Writer) *Encoder {
+	return &Encoder{
+		writer: writer,
+		buffer: make([]byte, 9),
+	}
+}
+
+// Write writes raw bytes and updates checksum, it is useful to append pre-encoded objects
+func (enc *Encoder) Write(p []byte) (int, error) {
+	n, err := enc.writer.Write(p)
+	enc.crc = CRC64(enc.crc, p[:n])
+	return n, err
+}
+
+func (enc *Encoder) write(p []byte) error {
+	_, err := enc.Write(p)
+	return err
+}
+
+func (enc *Encoder) writeByte(b byte) error {
+	enc.buffer[0] = b
+	return enc.write(enc.buffer[:1])
+}
+
+func (enc *Encoder) writeLength(length uint64) error {
+	var buf []byte
+	if length < 1<<6 {
+		buf = enc.buffer[:1]
+		buf[0] = len6Bit | byte(length)
+	} else if length < 1<<14 {
+		buf = enc.buffer[:2]
+		buf[0] = len14Bit | byte(length>>8)
+		buf[1] = byte(length)
+	} else if length <= math.MaxUint32 {
+		buf = enc.buffer[:5]
+		buf[0] = len32Bit
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+	} else {
+		buf = enc.buffer[:9]
+		buf[0] = len64Bit
+		binary.BigEndian.PutUint64(buf[1:], length)
+	}
+	return enc.write(buf)
+}
+
+func (enc *Encoder) writeString(s []byte) error {
+	err := enc.writeLength(uint64(len(s)))
+	if err != nil {
+		return err
+	}
+	return enc.write(s)
+}
+
+// WriteHeader writes magic number and version
+func (enc *Encoder) WriteHeader() error {
+	return enc.write([]byte("REDIS" + version))
+}
+
+// WriteAux writes an auxiliary field
+func (enc *Encoder) WriteAux(key string, value string) error {
+	err := enc.writeByte(opCodeAux)
+	if err != nil {
+		return err
+	}
+	err = enc.writeString([]byte(key))
+	if err != nil {
+		return err
+	}
+	return enc.writeString([]byte(value))
+}
+
+// WriteSelectDB writes db index of the following objects
+func (enc *Encoder) WriteSelectDB(dbIndex int) error {
+	err := enc.writeByte(opCodeSelectDB)
+	if err != nil {
+		return err
+	}
+	return enc.writeLength(uint64(dbIndex))
+}
+
+func (enc *Encoder) writeObjectHeader(objType byte, key string, expiration *time.Time) error {
+	if expiration != nil {
+		buf := enc.buffer[:9]
+		buf[0] = opCodeExpireTimeMs
+		binary.LittleEndian.PutUint64(buf[1:], uint64(expiration.UnixNano()/1e6))
+		err := enc.write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err := enc.writeByte(objType)
+	if err != nil {
+		return err
+	}
+	return enc.writeString([]byte(key))
+}
+
+// WriteStringObject writes a string object, expiration is nil for persistent object
+func (enc *Encoder) WriteStringObject(key string, value []byte, expiration *time.Time) error {
+	err := enc.writeObjectHeader(typeString, key, expiration)
+	if err != nil {
+		return err
+	}
+	return enc.writeString(value)
+}
+
+func (enc *Encoder) writeStrings(values [][]byte) error {
+	err := enc.writeLength(uint64(len(values)))
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		err = enc.writeString(v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteListObject writes a list object
+func (enc *Encoder) WriteListObject(key string, values [][]byte, expiration *time.Time) error {
+	err := enc.writeObjectHeader(typeList, key, expiration)
+	if err != nil {
+		return err
+	}
+	return enc.writeStrings(values)
+}
+
+// WriteSetObject writes a set object
+func (enc *Encoder) WriteSetObject(key string, members [][]byte, expiration *time.Time) error {
+	err := enc.writeObjectHeader(typeSet, key, expiration)
+	if err != nil {
+		return err
+	}
+	return enc.writeStrings(members)
+}
+
+// WriteHashObject writes a hash object
+func (enc *Encoder) WriteHashObject(key string, hash map[string][]byte, expiration *time.Time) error {
+	err := enc.writeObjectHeader(typeHash, key, expiration)
+	if err != nil {
+		return err
+	}
+	err = enc.writeLength(uint64(len(hash)))
+	if err != nil {
+		return err
+	}
+	for field, value := range hash {
+		err = enc.writeString([]byte(field))
+		if err != nil {
+			return err
+		}
+		err = enc.writeString(value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteZSetObject writes a sorted set object, scores are stored in binary format
+func (enc *Encoder) WriteZSetObject(key string, entries []*ZSetEntry, expiration *time.Time) error {
+	err := enc.writeObjectHeader(typeZSet2, key, expiration)
+	if err != nil {
+		return err
+	}
+	err = enc.writeLength(uint64(len(entries)))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = enc.writeString([]byte(e.Member))
+		if err != nil {
+			return err
+		}
+		buf := enc.buffer[:8]
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(e.Score))
+		err = enc.write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteEnd writes EOF op code and checksum, the Encoder should not be used after WriteEnd
+func (enc *Encoder) WriteEnd() error {
+	err := enc.writeByte(opCodeEOF)
+	if err != nil {
+		return err
+	}
+	buf := enc.buffer[:8]
+	binary.LittleEndian.PutUint64(buf, enc.crc)
+	_, err = enc.writer.Write(buf)
+	return err
+}
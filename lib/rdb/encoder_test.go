@@ -0,0 +1,92 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/hdt3213/rdb/parser"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRC64(t *testing.T) {
+	// check value of crc-64-jones from redis/src/crc64.c
+	crc := CRC64(0, []byte("123456789"))
+	if crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("wrong crc: %x", crc)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	expiration := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	longStr := []byte(strings.Repeat("a", 20000))
+	checkErr := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkErr(enc.WriteHeader())
+	checkErr(enc.WriteAux("redis-ver", "6.0.0"))
+	checkErr(enc.WriteSelectDB(0))
+	checkErr(enc.WriteStringObject("str", []byte("str"), nil))
+	checkErr(enc.WriteStringObject("long", longStr, nil))
+	checkErr(enc.WriteListObject("list", [][]byte{[]byte("1"), []byte("2")}, nil))
+	checkErr(enc.WriteSelectDB(1))
+	checkErr(enc.WriteSetObject("set", [][]byte{[]byte("a")}, nil))
+	checkErr(enc.WriteHashObject("hash", map[string][]byte{"f": []byte("v")}, nil))
+	checkErr(enc.WriteZSetObject("zset", []*ZSetEntry{{Member: "m", Score: 1.5}}, &expiration))
+	checkErr(enc.WriteEnd())
+
+	data := buf.Bytes()
+	sum := binary.LittleEndian.Uint64(data[len(data)-8:])
+	if sum != CRC64(0, data[:len(data)-8]) {
+		t.Error("wrong checksum")
+	}
+
+	count := 0
+	dec := parser.NewDecoder(bytes.NewReader(data))
+	err := dec.Parse(func(o parser.RedisObject) bool {
+		count++
+		switch o.GetKey() {
+		case "str":
+			if string(o.(*parser.StringObject).Value) != "str" || o.GetDBIndex() != 0 {
+				t.Error("wrong string object")
+			}
+		case "long":
+			if len(o.(*parser.StringObject).Value) != len(longStr) {
+				t.Error("wrong long string object")
+			}
+		case "list":
+			values := o.(*parser.ListObject).Values
+			if len(values) != 2 || string(values[1]) != "2" {
+				t.Error("wrong list object")
+			}
+		case "set":
+			members := o.(*parser.SetObject).Members
+			if len(members) != 1 || string(members[0]) != "a" || o.GetDBIndex() != 1 {
+				t.Error("wrong set object")
+			}
+		case "hash":
+			if o.(*parser.HashObject).Hash["f"] == nil {
+				t.Error("wrong hash object")
+			}
+		case "zset":
+			entries := o.(*parser.ZSetObject).Entries
+			if len(entries) != 1 || entries[0].Score != 1.5 {
+				t.Error("wrong zset object")
+			}
+			if o.GetExpiration() == nil || !o.GetExpiration().Equal(expiration) {
+				t.Errorf("wrong expiration: %v", o.GetExpiration())
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 6 {
+		t.Errorf("expect 6 objects, actually %d", count)
+	}
+}
@@ -0,0 +1,51 @@
+package partition
+
+import (
+	"sync"
+)
+
+// Executor runs tasks of different partitions in parallel, tasks of the same partition are executed in order
+type Executor struct {
+	queues  []chan func()
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+}
+
+// NewExecutor creates an Executor with a worker for each partition, queueSize is the capacity of each queue
+func NewExecutor(partitions int, queueSize int) *Executor {
+	e := &Executor{
+		queues: make([]chan func(), partitions),
+	}
+	e.workers.Add(partitions)
+	for i := range e.queues {
+		queue := make(chan func(), queueSize)
+		e.queues[i] = queue
+		go func() {
+			defer e.workers.Done()
+			for task := range queue {
+				task()
+				e.pending.Done()
+			}
+		}()
+	}
+	return e
+}
+
+// Submit adds task to the queue of partition, it blocks if the queue is full
+func (e *Executor) Submit(partition int, task func()) {
+	e.pending.Add(1)
+	e.queues[partition] <- task
+}
+
+// Wait blocks until all submitted tasks finished, it could be used as a barrier between tasks of different partitions
+func (e *Executor) Wait() {
+	e.pending.Wait()
+}
+
+// Close waits for all submitted tasks and stops workers, Submit should not be called after Close
+func (e *Executor) Close() {
+	for _, queue := range e.queues {
+		close(queue)
+	}
+	e.workers.Wait()
+}
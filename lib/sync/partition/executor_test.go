@@ -0,0 +1,42 @@
+package partition
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestExecutor(t *testing.T) {
+	e := NewExecutor(4, 16)
+	results := make([][]int, 4)
+	for i := 0; i < 1000; i++ {
+		i := i
+		p := i % 4
+		e.Submit(p, func() {
+			results[p] = append(results[p], i)
+		})
+	}
+	e.Wait()
+	for p, result := range results {
+		if len(result) != 250 {
+			t.Errorf("partition %d: expect 250 tasks, actually %d", p, len(result))
+			continue
+		}
+		for j, v := range result {
+			if v != j*4+p {
+				t.Errorf("partition %d: tasks are out of order", p)
+				break
+			}
+		}
+	}
+
+	var count int32
+	for i := 0; i < 100; i++ {
+		e.Submit(i%4, func() {
+			atomic.AddInt32(&count, 1)
+		})
+	}
+	e.Close()
+	if count != 100 {
+		t.Errorf("expect 100 tasks finished before close, actually %d", count)
+	}
+}
@@ -0,0 +1,89 @@
+// Package tlsutil creates tls configs from certificate files
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// modes of tls-auth-clients
+const (
+	AuthClientsYes      = "yes"
+	AuthClientsNo       = "no"
+	AuthClientsOptional = "optional"
+)
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca cert file failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate found in ca cert file " + caFile)
+	}
+	return pool, nil
+}
+
+// ServerConfig creates config for tls listener.
+// Client certificates are verified by certificates in caFile according to authClients, which is yes, no or optional.
+func ServerConfig(certFile, keyFile, caFile string, authClients string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls cert file and key file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls key pair failed: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch strings.ToLower(authClients) {
+	case "", AuthClientsYes:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case AuthClientsOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case AuthClientsNo:
+		cfg.ClientAuth = tls.NoClientCert
+		return cfg, nil
+	default:
+		return nil, errors.New("invalid tls-auth-clients: " + authClients)
+	}
+	if caFile == "" {
+		return nil, errors.New("tls ca cert file is required to authenticate clients")
+	}
+	cfg.ClientCAs, err = loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ClientConfig creates config for connecting to tls server.
+// Server certificate is verified by certificates in caFile, or system roots if caFile is empty.
+// The certificate in certFile is presented to server for mutual auth if given.
+func ClientConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls key pair failed: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
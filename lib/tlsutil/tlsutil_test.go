@@ -0,0 +1,225 @@
+package tlsutil
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// makeTestCert creates a certificate signed by parent, or a self-signed ca if parent is nil
+func makeTestCert(t *testing.T, dir string, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	err = ioutil.WriteFile(result.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// serveEcho accepts tls connections and echoes the first line
+func serveEcho(t *testing.T, cfg *tls.Config) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(line))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func echo(addr string, cfg *tls.Config) error {
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping\n"))
+	if err != nil {
+		return err
+	}
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	return err
+}
+
+func TestMutualAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := makeTestCert(t, dir, "ca", nil)
+	server := makeTestCert(t, dir, "server", ca)
+	client := makeTestCert(t, dir, "client", ca)
+	otherCA := makeTestCert(t, dir, "other-ca", nil)
+	stranger := makeTestCert(t, dir, "stranger", otherCA)
+
+	serverCfg, err := ServerConfig(server.certFile, server.keyFile, ca.certFile, AuthClientsYes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveEcho(t, serverCfg)
+
+	clientCfg, err := ClientConfig(client.certFile, client.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(addr, clientCfg); err != nil {
+		t.Errorf("client with valid cert should be accepted: %v", err)
+	}
+	noCertCfg, err := ClientConfig("", "", ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(addr, noCertCfg); err == nil {
+		t.Error("client without cert should be rejected")
+	}
+	strangerCfg, err := ClientConfig(stranger.certFile, stranger.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(addr, strangerCfg); err == nil {
+		t.Error("client with cert signed by unknown ca should be rejected")
+	}
+	untrustedCfg, err := ClientConfig(client.certFile, client.keyFile, otherCA.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(addr, untrustedCfg); err == nil {
+		t.Error("server with cert signed by unknown ca should be rejected")
+	}
+}
+
+func TestAuthClientsOptional(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := makeTestCert(t, dir, "ca", nil)
+	server := makeTestCert(t, dir, "server", ca)
+
+	serverCfg, err := ServerConfig(server.certFile, server.keyFile, ca.certFile, AuthClientsOptional)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveEcho(t, serverCfg)
+	noCertCfg, err := ClientConfig("", "", ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(addr, noCertCfg); err != nil {
+		t.Errorf("client without cert should be accepted: %v", err)
+	}
+	client := makeTestCert(t, dir, "client", ca)
+	clientCfg, err := ClientConfig(client.certFile, client.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(addr, clientCfg); err != nil {
+		t.Errorf("client with valid cert should be accepted: %v", err)
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := makeTestCert(t, dir, "ca", nil)
+	server := makeTestCert(t, dir, "server", ca)
+
+	if _, err := ServerConfig("", "", "", AuthClientsNo); err == nil {
+		t.Error("expect error without cert file")
+	}
+	if _, err := ServerConfig(server.certFile, server.keyFile, "", AuthClientsYes); err == nil {
+		t.Error("expect error without ca file")
+	}
+	if _, err := ServerConfig(server.certFile, server.keyFile, ca.certFile, "maybe"); err == nil {
+		t.Error("expect error for invalid tls-auth-clients")
+	}
+	if _, err := ServerConfig(server.certFile, server.keyFile, "", AuthClientsNo); err != nil {
+		t.Errorf("ca file is not required for tls-auth-clients no: %v", err)
+	}
+	if _, err := ServerConfig(server.certFile, server.keyFile, server.keyFile, AuthClientsYes); err == nil {
+		t.Error("expect error for invalid ca file")
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/tlsutil"
 	RedisServer "github.com/hdt3213/godis/redis/server"
 	"github.com/hdt3213/godis/tcp"
 	"os"
+	"strconv"
 )
 
 var banner = `
@@ -18,11 +20,12 @@ var banner = `
 `
 
 var defaultProperties = &config.ServerProperties{
-	Bind:           "0.0.0.0",
-	Port:           6399,
-	AppendOnly:     false,
-	AppendFilename: "",
-	MaxClients:     1000,
+	Bind:             "0.0.0.0",
+	Port:             6399,
+	AppendOnly:       false,
+	AppendFilename:   "",
+	AofLoadTruncated: true,
+	MaxClients:       1000,
 }
 
 func fileExists(filename string) bool {
@@ -49,10 +52,42 @@ func main() {
 		config.SetupConfig(configFilename)
 	}
 
-	err := tcp.ListenAndServeWithSignal(&tcp.Config{
-		Address: fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
-	}, RedisServer.MakeHandler())
+	cfg, err := makeTCPConfig()
 	if err != nil {
+		logger.Fatal(err)
+	}
+	err = tcp.ListenAndServeWithSignal(cfg, RedisServer.MakeHandler())
+	if err != nil {
+		// e.g. the final persistence failed
 		logger.Error(err)
+		os.Exit(1)
+	}
+}
+
+func makeTCPConfig() (*tcp.Config, error) {
+	cfg := &tcp.Config{}
+	// plain tcp is disabled only if tls or unix socket is enabled and port is 0
+	if config.Properties.Port != 0 || (config.Properties.TLSPort == 0 && config.Properties.UnixSocket == "") {
+		cfg.Address = fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port)
+	}
+	if config.Properties.TLSPort != 0 {
+		tlsConfig, err := tlsutil.ServerConfig(config.Properties.TLSCertFile, config.Properties.TLSKeyFile,
+			config.Properties.TLSCACertFile, config.Properties.TLSAuthClients)
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLSAddress = fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.TLSPort)
+		cfg.TLSConfig = tlsConfig
+	}
+	if config.Properties.UnixSocket != "" {
+		cfg.UnixSocket = config.Properties.UnixSocket
+		if config.Properties.UnixSocketPerm != "" {
+			perm, err := strconv.ParseUint(config.Properties.UnixSocketPerm, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid unixsocketperm: %s", config.Properties.UnixSocketPerm)
+			}
+			cfg.UnixSocketPerm = os.FileMode(perm)
+		}
 	}
+	return cfg, nil
 }
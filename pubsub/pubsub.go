@@ -4,20 +4,31 @@ import (
 	"github.com/hdt3213/godis/datastruct/list"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/redis/protocol"
-	"strconv"
 )
 
 var (
 	_subscribe         = "subscribe"
 	_unsubscribe       = "unsubscribe"
 	messageBytes       = []byte("message")
-	unSubscribeNothing = []byte("*3\r\n$11\r\nunsubscribe\r\n$-1\n:0\r\n")
+	unSubscribeNothing = protocol.MakePushReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(_unsubscribe)),
+		protocol.MakeNullBulkReply(),
+		protocol.MakeIntReply(0),
+	})
 )
 
-func makeMsg(t string, channel string, code int64) []byte {
-	return []byte("*3\r\n$" + strconv.FormatInt(int64(len(t)), 10) + protocol.CRLF + t + protocol.CRLF +
-		"$" + strconv.FormatInt(int64(len(channel)), 10) + protocol.CRLF + channel + protocol.CRLF +
-		":" + strconv.FormatInt(code, 10) + protocol.CRLF)
+// makeMsg creates a push message, which is an array in RESP2
+func makeMsg(t string, channel string, code int64) redis.Reply {
+	return protocol.MakePushReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(t)),
+		protocol.MakeBulkReply([]byte(channel)),
+		protocol.MakeIntReply(code),
+	})
+}
+
+// writeMsg sends msg in the protocol version of client
+func writeMsg(c redis.Connection, msg redis.Reply) {
+	_ = c.Write(protocol.Marshal(msg, c.GetProtocol()))
 }
 
 /*
@@ -77,7 +88,7 @@ func Subscribe(hub *Hub, c redis.Connection, args [][]byte) redis.Reply {
 
 	for _, channel := range channels {
 		if subscribe0(hub, channel, c) {
-			_ = c.Write(makeMsg(_subscribe, channel, int64(c.SubsCount())))
+			writeMsg(c, makeMsg(_subscribe, channel, int64(c.SubsCount())))
 		}
 	}
 	return &protocol.NoReply{}
@@ -112,13 +123,13 @@ func UnSubscribe(db *Hub, c redis.Connection, args [][]byte) redis.Reply {
 	defer db.subsLocker.UnLocks(channels...)
 
 	if len(channels) == 0 {
-		_ = c.Write(unSubscribeNothing)
+		writeMsg(c, unSubscribeNothing)
 		return &protocol.NoReply{}
 	}
 
 	for _, channel := range channels {
 		if unsubscribe0(db, channel, c) {
-			_ = c.Write(makeMsg(_unsubscribe, channel, int64(c.SubsCount())))
+			writeMsg(c, makeMsg(_unsubscribe, channel, int64(c.SubsCount())))
 		}
 	}
 	return &protocol.NoReply{}
@@ -140,14 +151,40 @@ func Publish(hub *Hub, args [][]byte) redis.Reply {
 		return protocol.MakeIntReply(0)
 	}
 	subscribers, _ := raw.(*list.LinkedList)
+	msg := protocol.MakePushReply([]redis.Reply{
+		protocol.MakeBulkReply(messageBytes),
+		protocol.MakeBulkReply([]byte(channel)),
+		protocol.MakeBulkReply(message),
+	})
 	subscribers.ForEach(func(i int, c interface{}) bool {
 		client, _ := c.(redis.Connection)
-		replyArgs := make([][]byte, 3)
-		replyArgs[0] = messageBytes
-		replyArgs[1] = []byte(channel)
-		replyArgs[2] = message
-		_ = client.Write(protocol.MakeMultiBulkReply(replyArgs).ToBytes())
+		writeMsg(client, msg)
 		return true
 	})
 	return protocol.MakeIntReply(int64(subscribers.Len()))
 }
+
+// InvalidateChannel is the channel of invalidation messages for client side caching.
+// A RESP2 client subscribing it receives messages of clients redirecting to it by CLIENT TRACKING.
+const InvalidateChannel = "__redis__:invalidate"
+
+// SendToSubscriber sends payload as a message of channel to the given client only, returns false if it is not subscribing channel
+func SendToSubscriber(hub *Hub, channel string, c redis.Connection, payload redis.Reply) bool {
+	hub.subsLocker.Lock(channel)
+	defer hub.subsLocker.UnLock(channel)
+
+	raw, ok := hub.subs.Get(channel)
+	if !ok {
+		return false
+	}
+	subscribers, _ := raw.(*list.LinkedList)
+	if !subscribers.Contains(c) {
+		return false
+	}
+	writeMsg(c, protocol.MakePushReply([]redis.Reply{
+		protocol.MakeBulkReply(messageBytes),
+		protocol.MakeBulkReply([]byte(channel)),
+		payload,
+	}))
+	return true
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/sync/wait"
@@ -8,6 +9,7 @@ import (
 	"github.com/hdt3213/godis/redis/protocol"
 	"net"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,6 +21,7 @@ type Client struct {
 	waitingReqs chan *request // waiting response
 	ticker      *time.Ticker
 	addr        string
+	dial        func() (net.Conn, error) // connects to addr, used for reconnecting
 
 	working *sync.WaitGroup // its counter presents unfinished requests(pending and waiting)
 }
@@ -38,14 +41,34 @@ const (
 	maxWait  = 3 * time.Second
 )
 
-// MakeClient creates a new client
+// unixPrefix is prefix of unix socket address, e.g. unix:///tmp/godis.sock
+const unixPrefix = "unix://"
+
+// MakeClient creates a new client, addr is host:port or unix:// followed by path of unix socket
 func MakeClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
+	return makeClient(addr, func() (net.Conn, error) {
+		if strings.HasPrefix(addr, unixPrefix) {
+			return net.Dial("unix", strings.TrimPrefix(addr, unixPrefix))
+		}
+		return net.Dial("tcp", addr)
+	})
+}
+
+// MakeTLSClient creates a new client connecting to server with tls
+func MakeTLSClient(addr string, tlsConfig *tls.Config) (*Client, error) {
+	return makeClient(addr, func() (net.Conn, error) {
+		return tls.Dial("tcp", addr, tlsConfig)
+	})
+}
+
+func makeClient(addr string, dial func() (net.Conn, error)) (*Client, error) {
+	conn, err := dial()
 	if err != nil {
 		return nil, err
 	}
 	return &Client{
 		addr:        addr,
+		dial:        dial,
 		conn:        conn,
 		pendingReqs: make(chan *request, chanSize),
 		waitingReqs: make(chan *request, chanSize),
@@ -91,7 +114,7 @@ func (client *Client) handleConnectionError(err error) error {
 			return err1
 		}
 	}
-	conn, err1 := net.Dial("tcp", client.addr)
+	conn, err1 := client.dial()
 	if err1 != nil {
 		logger.Error(err1)
 		return err1
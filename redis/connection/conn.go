@@ -1,22 +1,47 @@
 package connection
 
 import (
+	"bufio"
 	"bytes"
+	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/sync/wait"
+	"github.com/hdt3213/godis/redis/protocol"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// lastID is the id of the latest connection, ids increase from 1
+var lastID uint64
+
+// writeBufferSize is the threshold of buffered replies, they are flushed once the buffer is full
+const writeBufferSize = 16 * 1024
+
+// closeFlushTimeout limits time of sending buffered replies on close, in case of client not reading
+const closeFlushTimeout = 10 * time.Second
+
 // Connection represents a connection with a redis-cli
 type Connection struct {
-	conn net.Conn
+	conn      net.Conn
+	id        uint64
+	createdAt time.Time
 
 	// waiting until protocol finished
 	waitingReply wait.Wait
 
 	// lock while server sending response
 	mu sync.Mutex
+	// writer buffers replies of pipelined requests, it is created on first use
+	writer *bufio.Writer
+	// streaming is true while WriteReply sends a reply without holding mu, the writer is owned by it.
+	// Replies written by other goroutines meanwhile, e.g. messages of pub/sub, are queued and sent after it
+	streaming bool
+	queued    [][]byte
+
+	// statMu protects states which could be read by other connections through CLIENT LIST,
+	// they are only modified by the goroutine serving this connection
+	statMu sync.Mutex
 
 	// subscribing channels
 	subs map[string]bool
@@ -31,6 +56,13 @@ type Connection struct {
 
 	// selected db
 	selectedDB int
+
+	// protocol version, 0 means RESP2, accessed atomically as it is read by publishers and tracking
+	protocol int32
+	name     string
+
+	lastInteraction time.Time
+	lastCmd         string
 }
 
 // RemoteAddr returns the remote network address
@@ -38,21 +70,86 @@ func (c *Connection) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
-// Close disconnect with the client
+// Close sends buffered replies and then disconnect with the client
 func (c *Connection) Close() error {
 	c.waitingReply.WaitWithTimeout(10 * time.Second)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a reply being streamed to a slow client is abandoned
+	if !c.streaming && c.writer != nil && c.writer.Buffered() > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		_ = c.writer.Flush()
+	}
 	_ = c.conn.Close()
 	return nil
 }
 
 // NewConn creates Connection instance
 func NewConn(conn net.Conn) *Connection {
+	now := time.Now()
 	return &Connection{
-		conn: conn,
+		conn:            conn,
+		id:              atomic.AddUint64(&lastID, 1),
+		createdAt:       now,
+		lastInteraction: now,
 	}
 }
 
-// Write sends response to client over tcp connection
+// ID returns the unique id of connection
+func (c *Connection) ID() uint64 {
+	return c.id
+}
+
+// SetLastCmd records the command being executed
+func (c *Connection) SetLastCmd(cmd string) {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
+	c.lastCmd = cmd
+	c.lastInteraction = time.Now()
+}
+
+// Stats is a snapshot of connection states, shown by CLIENT LIST
+type Stats struct {
+	ID        uint64
+	Addr      string
+	LocalAddr string
+	Name      string
+	Age       time.Duration
+	Idle      time.Duration
+	DB        int
+	Subs      int
+	// Multi is the number of queued commands in transaction, -1 if not in transaction
+	Multi   int
+	LastCmd string
+}
+
+// GetStats returns a snapshot of connection states, it is safe to be called by other connections
+func (c *Connection) GetStats() *Stats {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
+	now := time.Now()
+	stats := &Stats{
+		ID:      c.id,
+		Name:    c.name,
+		Age:     now.Sub(c.createdAt),
+		Idle:    now.Sub(c.lastInteraction),
+		DB:      c.selectedDB,
+		Subs:    len(c.subs),
+		Multi:   -1,
+		LastCmd: c.lastCmd,
+	}
+	if c.conn != nil {
+		stats.Addr = c.conn.RemoteAddr().String()
+		stats.LocalAddr = c.conn.LocalAddr().String()
+	}
+	if c.multiState {
+		stats.Multi = len(c.queue)
+	}
+	return stats
+}
+
+// Write sends response to client over tcp connection immediately, buffered replies are sent before it.
+// If a reply is being streamed by WriteReply, b is queued and sent after it rather than waiting for a slow client
 func (c *Connection) Write(b []byte) error {
 	if len(b) == 0 {
 		return nil
@@ -64,14 +161,96 @@ func (c *Connection) Write(b []byte) error {
 		c.mu.Unlock()
 	}()
 
+	if c.streaming {
+		c.queued = append(c.queued, b)
+		return nil
+	}
+	if c.writer != nil && c.writer.Buffered() > 0 {
+		// send buffered replies and b in one syscall if possible
+		_, err := c.writer.Write(b)
+		if err != nil {
+			return err
+		}
+		return c.writer.Flush()
+	}
 	_, err := c.conn.Write(b)
 	return err
 }
 
-// Subscribe add current connection into subscribers of the given channel
-func (c *Connection) Subscribe(channel string) {
+// WriteBuffered appends response to buffer, which is sent by Flush or once the buffer is full.
+// It is used to reply pipelined requests with less syscalls.
+func (c *Connection) WriteBuffered(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	c.waitingReply.Add(1)
+	defer func() {
+		c.waitingReply.Done()
+		c.mu.Unlock()
+	}()
+
+	if c.writer == nil {
+		c.writer = bufio.NewWriterSize(c.conn, writeBufferSize)
+	}
+	_, err := c.writer.Write(b)
+	return err
+}
+
+// WriteReply encodes reply into buffer in the protocol of connection.
+// A large redis.StreamReply is sent in chunks once the buffer is full, rather than encoded in memory as a whole.
+// The lock is not held while sending, so writes of other goroutines are not blocked by a slow client.
+// WriteReply, WriteBuffered and Flush should only be called by the goroutine serving the connection
+func (c *Connection) WriteReply(reply redis.Reply) error {
+	c.waitingReply.Add(1)
+	defer c.waitingReply.Done()
+	c.mu.Lock()
+	if c.writer == nil {
+		c.writer = bufio.NewWriterSize(c.conn, writeBufferSize)
+	}
+	c.streaming = true
+	c.mu.Unlock()
+
+	err := protocol.MarshalTo(c.writer, reply, c.GetProtocol())
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.streaming = false
+	if len(c.queued) == 0 {
+		return err
+	}
+	// queued replies were expected to be sent immediately
+	for _, b := range c.queued {
+		if err == nil {
+			_, err = c.writer.Write(b)
+		}
+	}
+	c.queued = nil
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	return err
+}
+
+// Flush sends buffered responses to client
+func (c *Connection) Flush() error {
+	c.mu.Lock()
+	c.waitingReply.Add(1)
+	defer func() {
+		c.waitingReply.Done()
+		c.mu.Unlock()
+	}()
+
+	if c.writer == nil {
+		return nil
+	}
+	return c.writer.Flush()
+}
+
+// Subscribe add current connection into subscribers of the given channel
+func (c *Connection) Subscribe(channel string) {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
 
 	if c.subs == nil {
 		c.subs = make(map[string]bool)
@@ -81,8 +260,8 @@ func (c *Connection) Subscribe(channel string) {
 
 // UnSubscribe removes current connection into subscribers of the given channel
 func (c *Connection) UnSubscribe(channel string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
 
 	if len(c.subs) == 0 {
 		return
@@ -92,11 +271,15 @@ func (c *Connection) UnSubscribe(channel string) {
 
 // SubsCount returns the number of subscribing channels
 func (c *Connection) SubsCount() int {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
 	return len(c.subs)
 }
 
 // GetChannels returns all subscribing channels
 func (c *Connection) GetChannels() []string {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
 	if c.subs == nil {
 		return make([]string, 0)
 	}
@@ -126,6 +309,8 @@ func (c *Connection) InMultiState() bool {
 
 // SetMultiState sets transaction flag
 func (c *Connection) SetMultiState(state bool) {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
 	if !state { // reset data when cancel multi
 		c.watching = nil
 		c.queue = nil
@@ -140,11 +325,15 @@ func (c *Connection) GetQueuedCmdLine() [][][]byte {
 
 // EnqueueCmd  enqueues command of current transaction
 func (c *Connection) EnqueueCmd(cmdLine [][]byte) {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
 	c.queue = append(c.queue, cmdLine)
 }
 
 // ClearQueuedCmds clears queued commands of current transaction
 func (c *Connection) ClearQueuedCmds() {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
 	c.queue = nil
 }
 
@@ -163,9 +352,37 @@ func (c *Connection) GetDBIndex() int {
 
 // SelectDB selects a database
 func (c *Connection) SelectDB(dbNum int) {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
 	c.selectedDB = dbNum
 }
 
+// GetProtocol returns the protocol version negotiated by HELLO
+func (c *Connection) GetProtocol() int {
+	version := atomic.LoadInt32(&c.protocol)
+	if version == 0 {
+		return protocol.RESP2
+	}
+	return int(version)
+}
+
+// SetProtocol sets the protocol version
+func (c *Connection) SetProtocol(version int) {
+	atomic.StoreInt32(&c.protocol, int32(version))
+}
+
+// GetName returns the name of connection
+func (c *Connection) GetName() string {
+	return c.name
+}
+
+// SetName sets the name of connection
+func (c *Connection) SetName(name string) {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
+	c.name = name
+}
+
 // FakeConn implements redis.Connection for test
 type FakeConn struct {
 	Connection
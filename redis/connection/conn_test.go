@@ -0,0 +1,76 @@
+package connection
+
+import (
+	"bytes"
+	"github.com/hdt3213/godis/redis/protocol"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloseFlush(t *testing.T) {
+	server, client := net.Pipe()
+	conn := NewConn(server)
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(client)
+		received <- data
+	}()
+	_ = conn.WriteReply(protocol.MakeOkReply())
+	_ = conn.WriteReply(protocol.MakeIntReply(1))
+	_ = conn.Close()
+	data := <-received
+	if string(data) != "+OK\r\n:1\r\n" {
+		t.Errorf("buffered replies are lost on close: %q", data)
+	}
+}
+
+func TestWriteWhileStreaming(t *testing.T) {
+	server, client := net.Pipe()
+	conn := NewConn(server)
+	args := make([][]byte, 1000)
+	for i := range args {
+		args[i] = bytes.Repeat([]byte{'a'}, 100)
+	}
+	reply := protocol.MakeMultiBulkReply(args)
+	replied := make(chan error, 1)
+	go func() {
+		// client does not read yet, so WriteReply is blocked once the buffer is full
+		replied <- conn.WriteReply(reply)
+	}()
+	for {
+		conn.mu.Lock()
+		streaming := conn.streaming
+		conn.mu.Unlock()
+		if streaming {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	written := make(chan error, 1)
+	go func() {
+		written <- conn.Write([]byte("+message\r\n"))
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write should not wait for a reply streamed to a slow client")
+	}
+
+	expected := append(reply.ToBytes(), "+message\r\n"...)
+	data := make([]byte, len(expected))
+	if _, err := io.ReadFull(client, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-replied; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Error("message should be sent after the streamed reply")
+	}
+}
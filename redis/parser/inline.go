@@ -0,0 +1,141 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+)
+
+/*
+ * Inline commands are space separated arguments in a single line, e.g. typed in telnet.
+ * Arguments could be quoted like redis-cli:
+ * "..." supports escapes such as \n, \r, \t, \b, \a, \\, \" and \xHH, '...' supports \' only.
+ */
+
+var (
+	errTooBigInline    = errors.New("ERR Protocol error: too big inline request")
+	errUnbalancedQuote = errors.New("ERR Protocol error: unbalanced quotes in request")
+)
+
+// readLimitedLine reads until '\n', returns errTooBigInline if the line is longer than limit.
+// Zero limit means no limit
+func readLimitedLine(reader *bufio.Reader, limit int64) ([]byte, error) {
+	var line []byte
+	for {
+		slice, err := reader.ReadSlice('\n')
+		if limit > 0 && int64(len(line)+len(slice)) > limit {
+			return nil, errTooBigInline
+		}
+		// slice is overwritten by the next read
+		line = append(line, slice...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+func hexValue(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// parseInline splits an inline command into arguments, it returns nil for empty line
+func parseInline(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg []byte
+		inDoubleQuotes, inSingleQuotes, done := false, false, false
+		for !done {
+			if inDoubleQuotes {
+				if i >= len(line) {
+					return nil, errUnbalancedQuote
+				}
+				if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' {
+					hi, ok1 := hexValue(line[i+2])
+					lo, ok2 := hexValue(line[i+3])
+					if ok1 && ok2 {
+						arg = append(arg, hi<<4|lo)
+						i += 4
+						continue
+					}
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					c := line[i]
+					switch c {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					}
+					arg = append(arg, c)
+				} else if line[i] == '"' {
+					// closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuote
+					}
+					done = true
+				} else {
+					arg = append(arg, line[i])
+				}
+			} else if inSingleQuotes {
+				if i >= len(line) {
+					return nil, errUnbalancedQuote
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if line[i] == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuote
+					}
+					done = true
+				} else {
+					arg = append(arg, line[i])
+				}
+			} else {
+				if i >= len(line) {
+					break
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDoubleQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			i++
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
@@ -0,0 +1,73 @@
+package parser
+
+import (
+	"errors"
+	"io"
+)
+
+// Limits restricts the size of requests from clients, zero means no limit
+type Limits struct {
+	// MaxBulkLen is the max length of a bulk string
+	MaxBulkLen int64
+	// MaxMultiBulkLen is the max number of elements in a multi bulk
+	MaxMultiBulkLen int64
+	// MaxQueryBuffer is the max size of a request which has not been parsed completely
+	MaxQueryBuffer int64
+	// MaxInlineLen is the max length of a line, including inline commands and headers of multi bulk and bulk
+	MaxInlineLen int64
+}
+
+var (
+	errInvalidMultiBulkLen = errors.New("ERR Protocol error: invalid multibulk length")
+	errInvalidBulkLen      = errors.New("ERR Protocol error: invalid bulk length")
+	errQueryBufferLimit    = errors.New("ERR Protocol error: query buffer limit exceeded")
+)
+
+// ParseStreamWithLimits is like ParseStream, but stops with a fatal error if a request exceeds limits
+func ParseStreamWithLimits(reader io.Reader, limits *Limits) <-chan *Payload {
+	ch := make(chan *Payload)
+	go parse0(reader, ch, limits)
+	return ch
+}
+
+// isFatal returns true if the rest of stream cannot be parsed after err, so that parsing should stop
+func isFatal(err error) bool {
+	return err == errTooBigInline ||
+		err == errInvalidMultiBulkLen ||
+		err == errInvalidBulkLen ||
+		err == errQueryBufferLimit
+}
+
+func (l *Limits) checkMultiBulkLen(n uint64) error {
+	if l != nil && l.MaxMultiBulkLen > 0 && n > uint64(l.MaxMultiBulkLen) {
+		return errInvalidMultiBulkLen
+	}
+	return nil
+}
+
+// checkBulkLen checks the bulk to be read before allocating buffer for it
+func (l *Limits) checkBulkLen(state *readState, n int64) error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxBulkLen > 0 && n > l.MaxBulkLen {
+		return errInvalidBulkLen
+	}
+	return l.checkQueryBuffer(state.size + n)
+}
+
+// inlineLimit returns the max length of a line, zero means no limit
+func (l *Limits) inlineLimit() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.MaxInlineLen
+}
+
+// checkQueryBuffer checks the size of the request being read
+func (l *Limits) checkQueryBuffer(size int64) error {
+	if l != nil && l.MaxQueryBuffer > 0 && size > l.MaxQueryBuffer {
+		return errQueryBufferLimit
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/redis/protocol"
 	"io"
+	"math/big"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -17,12 +18,17 @@ import (
 type Payload struct {
 	Data redis.Reply
 	Err  error
+	// Offset is the number of bytes consumed from reader after the payload was read, incomplete lines are not counted
+	Offset int64
+	// Pending is true if the next payload has been parsed without waiting for input, e.g. following requests of a pipeline.
+	// A partial request received does not make the previous one pending
+	Pending bool
 }
 
 // ParseStream reads data from io.Reader and send payloads through channel
 func ParseStream(reader io.Reader) <-chan *Payload {
 	ch := make(chan *Payload)
-	go parse0(reader, ch)
+	go parse0(reader, ch, nil)
 	return ch
 }
 
@@ -30,7 +36,7 @@ func ParseStream(reader io.Reader) <-chan *Payload {
 func ParseBytes(data []byte) ([]redis.Reply, error) {
 	ch := make(chan *Payload)
 	reader := bytes.NewReader(data)
-	go parse0(reader, ch)
+	go parse0(reader, ch, nil)
 	var results []redis.Reply
 	for payload := range ch {
 		if payload == nil {
@@ -51,7 +57,7 @@ func ParseBytes(data []byte) ([]redis.Reply, error) {
 func ParseOne(data []byte) (redis.Reply, error) {
 	ch := make(chan *Payload)
 	reader := bytes.NewReader(data)
-	go parse0(reader, ch)
+	go parse0(reader, ch, nil)
 	payload := <-ch // parse0 will close the channel
 	if payload == nil {
 		return nil, errors.New("no protocol")
@@ -65,126 +71,222 @@ type readState struct {
 	msgType           byte
 	args              [][]byte
 	bulkLen           int64
+	emptyBulk         bool  // the next line is the CRLF of an empty bulk string
+	size              int64 // bytes of current request have been read
 }
 
 func (s *readState) finished() bool {
 	return s.expectedArgsCount > 0 && len(s.args) == s.expectedArgsCount
 }
 
-func parse0(reader io.Reader, ch chan<- *Payload) {
+func parse0(reader io.Reader, ch chan<- *Payload, limits *Limits) {
+	out := &payloadSender{ch: ch}
 	defer func() {
 		if err := recover(); err != nil {
 			logger.Error(string(debug.Stack()))
+			out.close()
 		}
 	}()
-	bufReader := bufio.NewReader(reader)
+	bufReader := bufio.NewReader(&flushReader{reader: reader, sender: out})
 	var state readState
 	var err error
 	var msg []byte
+	var offset int64
 	for {
 		// read line
 		var ioErr bool
-		msg, ioErr, err = readLine(bufReader, &state)
+		msg, ioErr, err = readLine(bufReader, &state, limits)
+		offset += int64(len(msg))
 		if err != nil {
-			if ioErr { // encounter io err, stop read
-				ch <- &Payload{
-					Err: err,
-				}
-				close(ch)
+			if ioErr { // encounter io err or too big line, stop read
+				out.send(&Payload{
+					Offset: offset,
+					Err:    err,
+				})
+				out.close()
 				return
 			}
 			// protocol err, reset read state
-			ch <- &Payload{
-				Err: err,
-			}
+			out.send(&Payload{
+				Offset: offset,
+				Err:    err,
+			})
 			state = readState{}
 			continue
 		}
+		state.size += int64(len(msg))
+		if err = limits.checkQueryBuffer(state.size); err != nil {
+			stopWithFatal(out, offset, err)
+			return
+		}
 
 		// parse line
 		if !state.readingMultiLine {
 			// receive new response
-			if msg[0] == '*' {
-				// multi bulk protocol
-				err = parseMultiBulkHeader(msg, &state)
+			if isAggregateType(msg[0]) {
+				// multi bulk protocol, or map, set and push of RESP3
+				err = parseMultiBulkHeader(msg, &state, limits)
+				if isFatal(err) {
+					stopWithFatal(out, offset, err)
+					return
+				}
 				if err != nil {
-					ch <- &Payload{
-						Err: errors.New("protocol error: " + string(msg)),
-					}
+					out.send(&Payload{
+						Offset: offset,
+						Err:    errors.New("protocol error: " + string(msg)),
+					})
+					state = readState{} // reset state
+					continue
+				}
+				if state.expectedArgsCount < 0 {
+					out.send(&Payload{
+						Offset: offset,
+						Data:   &protocol.NullMultiBulkReply{},
+					})
 					state = readState{} // reset state
 					continue
 				}
 				if state.expectedArgsCount == 0 {
-					ch <- &Payload{
-						Data: &protocol.EmptyMultiBulkReply{},
-					}
+					out.send(&Payload{
+						Offset: offset,
+						Data:   makeAggregateReply(msg[0], nil),
+					})
 					state = readState{} // reset state
 					continue
 				}
-			} else if msg[0] == '$' { // bulk protocol
-				err = parseBulkHeader(msg, &state)
+			} else if msg[0] == '$' || msg[0] == '=' { // bulk protocol or verbatim string of RESP3
+				err = parseBulkHeader(msg, &state, limits)
+				if isFatal(err) {
+					stopWithFatal(out, offset, err)
+					return
+				}
 				if err != nil {
-					ch <- &Payload{
-						Err: errors.New("protocol error: " + string(msg)),
-					}
+					out.send(&Payload{
+						Offset: offset,
+						Err:    errors.New("protocol error: " + string(msg)),
+					})
 					state = readState{} // reset state
 					continue
 				}
 				if state.bulkLen == -1 { // null bulk protocol
-					ch <- &Payload{
-						Data: &protocol.NullBulkReply{},
-					}
+					out.send(&Payload{
+						Offset: offset,
+						Data:   &protocol.NullBulkReply{},
+					})
 					state = readState{} // reset state
 					continue
 				}
 			} else {
 				// single line protocol
 				result, err := parseSingleLineReply(msg)
-				ch <- &Payload{
-					Data: result,
-					Err:  err,
+				if result == nil && err == nil {
+					// empty inline command is ignored
+					continue
 				}
+				out.send(&Payload{
+					Offset: offset,
+					Data:   result,
+					Err:    err,
+				})
 				state = readState{} // reset state
 				continue
 			}
 		} else {
 			// receive following bulk protocol
-			err = readBody(msg, &state)
+			err = readBody(msg, &state, limits)
+			if isFatal(err) {
+				stopWithFatal(out, offset, err)
+				return
+			}
 			if err != nil {
-				ch <- &Payload{
-					Err: errors.New("protocol error: " + string(msg)),
-				}
+				out.send(&Payload{
+					Offset: offset,
+					Err:    errors.New("protocol error: " + string(msg)),
+				})
 				state = readState{} // reset state
 				continue
 			}
 			// if sending finished
 			if state.finished() {
 				var result redis.Reply
-				if state.msgType == '*' {
-					result = protocol.MakeMultiBulkReply(state.args)
+				if isAggregateType(state.msgType) {
+					result = makeAggregateReply(state.msgType, state.args)
 				} else if state.msgType == '$' {
 					result = protocol.MakeBulkReply(state.args[0])
+				} else if state.msgType == '=' {
+					result, err = parseVerbatim(state.args[0])
 				}
-				ch <- &Payload{
-					Data: result,
-					Err:  err,
-				}
+				out.send(&Payload{
+					Offset: offset,
+					Data:   result,
+					Err:    err,
+				})
 				state = readState{}
 			}
 		}
 	}
 }
 
-func readLine(bufReader *bufio.Reader, state *readState) ([]byte, bool, error) {
+// stopWithFatal sends a fatal error and stops parsing
+func stopWithFatal(out *payloadSender, offset int64, err error) {
+	out.send(&Payload{
+		Offset: offset,
+		Err:    err,
+	})
+	out.close()
+}
+
+// payloadSender holds the latest payload until the next one is parsed or the parser is going to wait for input,
+// so that Pending tells whether following requests could be parsed without waiting
+type payloadSender struct {
+	ch   chan<- *Payload
+	held *Payload
+}
+
+func (s *payloadSender) send(payload *Payload) {
+	if s.held != nil {
+		s.held.Pending = true
+		s.ch <- s.held
+	}
+	s.held = payload
+}
+
+// flush sends the held payload as not pending
+func (s *payloadSender) flush() {
+	if s.held != nil {
+		s.ch <- s.held
+		s.held = nil
+	}
+}
+
+func (s *payloadSender) close() {
+	s.flush()
+	close(s.ch)
+}
+
+// flushReader flushes payloads before reading from underlying reader which may block
+type flushReader struct {
+	reader io.Reader
+	sender *payloadSender
+}
+
+func (r *flushReader) Read(p []byte) (int, error) {
+	r.sender.flush()
+	return r.reader.Read(p)
+}
+
+func readLine(bufReader *bufio.Reader, state *readState, limits *Limits) ([]byte, bool, error) {
 	var msg []byte
 	var err error
 	if state.bulkLen == 0 { // read normal line
-		msg, err = bufReader.ReadBytes('\n')
+		msg, err = readLimitedLine(bufReader, limits.inlineLimit())
 		if err != nil {
 			return nil, true, err
 		}
-		if len(msg) == 0 || msg[len(msg)-2] != '\r' {
-			return nil, false, errors.New("protocol error: " + string(msg))
+		// inline command could end with \n only
+		requireCRLF := state.readingMultiLine || isAggregateType(msg[0]) || msg[0] == '$' || msg[0] == '='
+		if requireCRLF && (len(msg) < 2 || msg[len(msg)-2] != '\r') {
+			return msg, false, errors.New("protocol error: " + string(msg))
 		}
 	} else { // read bulk line (binary safe)
 		msg = make([]byte, state.bulkLen+2)
@@ -195,20 +297,34 @@ func readLine(bufReader *bufio.Reader, state *readState) ([]byte, bool, error) {
 		if len(msg) == 0 ||
 			msg[len(msg)-2] != '\r' ||
 			msg[len(msg)-1] != '\n' {
-			return nil, false, errors.New("protocol error: " + string(msg))
+			return msg, false, errors.New("protocol error: " + string(msg))
 		}
 		state.bulkLen = 0
 	}
 	return msg, false, nil
 }
 
-func parseMultiBulkHeader(msg []byte, state *readState) error {
+// maxPreallocArgs limits the capacity allocated for args before they were actually read
+const maxPreallocArgs = 1024
+
+func parseMultiBulkHeader(msg []byte, state *readState, limits *Limits) error {
 	var err error
 	var expectedLine uint64
+	if msg[0] == '*' && string(msg[1:len(msg)-2]) == "-1" { // null multi bulk
+		state.expectedArgsCount = -1
+		return nil
+	}
 	expectedLine, err = strconv.ParseUint(string(msg[1:len(msg)-2]), 10, 32)
 	if err != nil {
 		return errors.New("protocol error: " + string(msg))
 	}
+	if err = limits.checkMultiBulkLen(expectedLine); err != nil {
+		return err
+	}
+	if msg[0] == '%' {
+		// map has a key and a value in each entry
+		expectedLine *= 2
+	}
 	if expectedLine == 0 {
 		state.expectedArgsCount = 0
 		return nil
@@ -217,22 +333,30 @@ func parseMultiBulkHeader(msg []byte, state *readState) error {
 		state.msgType = msg[0]
 		state.readingMultiLine = true
 		state.expectedArgsCount = int(expectedLine)
-		state.args = make([][]byte, 0, expectedLine)
+		capacity := expectedLine
+		if capacity > maxPreallocArgs {
+			capacity = maxPreallocArgs
+		}
+		state.args = make([][]byte, 0, capacity)
 		return nil
 	} else {
 		return errors.New("protocol error: " + string(msg))
 	}
 }
 
-func parseBulkHeader(msg []byte, state *readState) error {
+func parseBulkHeader(msg []byte, state *readState, limits *Limits) error {
 	var err error
 	state.bulkLen, err = strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 64)
 	if err != nil {
 		return errors.New("protocol error: " + string(msg))
 	}
+	if err = limits.checkBulkLen(state, state.bulkLen); err != nil {
+		return err
+	}
 	if state.bulkLen == -1 { // null bulk
 		return nil
-	} else if state.bulkLen > 0 {
+	} else if state.bulkLen >= 0 {
+		state.emptyBulk = state.bulkLen == 0
 		state.msgType = msg[0]
 		state.readingMultiLine = true
 		state.expectedArgsCount = 1
@@ -244,7 +368,7 @@ func parseBulkHeader(msg []byte, state *readState) error {
 }
 
 func parseSingleLineReply(msg []byte) (redis.Reply, error) {
-	str := strings.TrimSuffix(string(msg), "\r\n")
+	str := strings.TrimRight(string(msg), "\r\n")
 	var result redis.Reply
 	switch msg[0] {
 	case '+': // status protocol
@@ -257,29 +381,94 @@ func parseSingleLineReply(msg []byte) (redis.Reply, error) {
 			return nil, errors.New("protocol error: " + string(msg))
 		}
 		result = protocol.MakeIntReply(val)
+	case ',': // double of RESP3
+		val, err := strconv.ParseFloat(str[1:], 64)
+		if err != nil {
+			return nil, errors.New("protocol error: " + string(msg))
+		}
+		result = protocol.MakeDoubleReply(val)
+	case '(': // big number of RESP3
+		val, ok := new(big.Int).SetString(str[1:], 10)
+		if !ok {
+			return nil, errors.New("protocol error: " + string(msg))
+		}
+		result = protocol.MakeBigNumberReply(val)
+	case '_', '#':
+		// null and boolean of RESP3, other lines are parsed as text protocol such as annotations in aof
+		switch str {
+		case "_":
+			return protocol.MakeNullBulkReply(), nil
+		case "#t", "#f":
+			return protocol.MakeBoolReply(str == "#t"), nil
+		}
+		fallthrough
 	default:
-		// parse as text protocol
-		strs := strings.Split(str, " ")
-		args := make([][]byte, len(strs))
-		for i, s := range strs {
-			args[i] = []byte(s)
+		// parse as inline command, returns nil for empty line
+		args, err := parseInline(msg)
+		if err != nil || len(args) == 0 {
+			return nil, err
 		}
 		result = protocol.MakeMultiBulkReply(args)
 	}
 	return result, nil
 }
 
+func isAggregateType(msgType byte) bool {
+	return msgType == '*' || msgType == '%' || msgType == '~' || msgType == '>'
+}
+
+// makeAggregateReply creates reply of multi bulk, map, set or push whose elements are strings
+func makeAggregateReply(msgType byte, args [][]byte) redis.Reply {
+	if msgType == '*' {
+		if len(args) == 0 {
+			return &protocol.EmptyMultiBulkReply{}
+		}
+		return protocol.MakeMultiBulkReply(args)
+	}
+	replies := make([]redis.Reply, len(args))
+	for i, arg := range args {
+		replies[i] = protocol.MakeBulkReply(arg)
+	}
+	switch msgType {
+	case '%':
+		return protocol.MakeMapReply(replies)
+	case '~':
+		return protocol.MakeSetReply(replies)
+	default:
+		return protocol.MakePushReply(replies)
+	}
+}
+
+// parseVerbatim parses verbatim string in format of "txt:content"
+func parseVerbatim(body []byte) (redis.Reply, error) {
+	if len(body) < 4 || body[3] != ':' {
+		return nil, errors.New("protocol error: invalid verbatim string")
+	}
+	return protocol.MakeVerbatimReply(string(body[:3]), body[4:]), nil
+}
+
 // read the non-first lines of multi bulk protocol or bulk protocol
-func readBody(msg []byte, state *readState) error {
+func readBody(msg []byte, state *readState, limits *Limits) error {
 	line := msg[0 : len(msg)-2]
 	var err error
-	if line[0] == '$' {
+	if state.emptyBulk {
+		if len(line) != 0 {
+			return errors.New("protocol error: " + string(msg))
+		}
+		state.emptyBulk = false
+		state.args = append(state.args, []byte{})
+	} else if len(line) > 0 && line[0] == '$' {
 		// bulk protocol
 		state.bulkLen, err = strconv.ParseInt(string(line[1:]), 10, 64)
 		if err != nil {
 			return errors.New("protocol error: " + string(msg))
 		}
-		if state.bulkLen <= 0 { // null bulk in multi bulks
+		if err = limits.checkBulkLen(state, state.bulkLen); err != nil {
+			return err
+		}
+		if state.bulkLen == 0 { // empty bulk is followed by CRLF
+			state.emptyBulk = true
+		} else if state.bulkLen < 0 { // null bulk in multi bulks
 			state.args = append(state.args, []byte{})
 			state.bulkLen = 0
 		}
@@ -6,7 +6,11 @@ import (
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"io"
+	"math"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseStream(t *testing.T) {
@@ -16,11 +20,18 @@ func TestParseStream(t *testing.T) {
 		protocol.MakeErrReply("ERR unknown"),
 		protocol.MakeBulkReply([]byte("a\r\nb")), // test binary safe
 		protocol.MakeNullBulkReply(),
+		protocol.MakeBulkReply([]byte{}),
 		protocol.MakeMultiBulkReply([][]byte{
 			[]byte("a"),
 			[]byte("\r\n"),
 		}),
+		protocol.MakeMultiBulkReply([][]byte{
+			[]byte("set"),
+			[]byte("a"),
+			[]byte{},
+		}),
 		protocol.MakeEmptyMultiBulkReply(),
+		protocol.MakeNullMultiBulkReply(),
 	}
 	reqs := bytes.Buffer{}
 	for _, re := range replies {
@@ -79,3 +90,176 @@ func TestParseOne(t *testing.T) {
 		}
 	}
 }
+
+func TestParseOffset(t *testing.T) {
+	cmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "a")).ToBytes()
+	data := append(append([]byte{}, cmd...), cmd...)
+	data = append(data, cmd[:len(cmd)-3]...) // incomplete command
+	ch := ParseStream(bytes.NewReader(data))
+	var offsets []int64
+	for payload := range ch {
+		if payload.Err != nil {
+			if payload.Err != io.EOF && payload.Err != io.ErrUnexpectedEOF {
+				t.Error(payload.Err)
+			}
+			break
+		}
+		offsets = append(offsets, payload.Offset)
+	}
+	if len(offsets) != 2 || offsets[0] != int64(len(cmd)) || offsets[1] != int64(2*len(cmd)) {
+		t.Errorf("wrong offsets: %v", offsets)
+	}
+}
+
+func TestParsePending(t *testing.T) {
+	cmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "a")).ToBytes()
+	data := append(append([]byte{}, cmd...), cmd...)
+	ch := ParseStream(bytes.NewReader(data))
+	var pending []bool
+	for payload := range ch {
+		if payload.Err != nil {
+			break
+		}
+		pending = append(pending, payload.Pending)
+	}
+	if len(pending) != 2 || !pending[0] || pending[1] {
+		t.Errorf("only the last request of pipeline should not be pending: %v", pending)
+	}
+}
+
+func TestParsePartialPending(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	ch := ParseStream(reader)
+	cmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "a")).ToBytes()
+	go func() {
+		_, _ = writer.Write(append(append([]byte{}, cmd...), cmd[:5]...))
+	}()
+	select {
+	case payload := <-ch:
+		if payload.Err != nil {
+			t.Fatal(payload.Err)
+		}
+		if payload.Pending {
+			t.Error("partial request should not make the previous one pending")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("payload should be sent before waiting for the rest of the next request")
+	}
+}
+
+func TestParseResp3(t *testing.T) {
+	replies := []redis.Reply{
+		protocol.MakeMapReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("a")), protocol.MakeBulkReply([]byte("1")),
+		}),
+		protocol.MakeSetReply([]redis.Reply{protocol.MakeBulkReply([]byte("a"))}),
+		protocol.MakePushReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("message")), protocol.MakeBulkReply([]byte("")),
+		}),
+		protocol.MakeMapReply(nil),
+		protocol.MakeDoubleReply(1.5),
+		protocol.MakeDoubleReply(math.Inf(-1)),
+		protocol.MakeBoolReply(true),
+		protocol.MakeBoolReply(false),
+		protocol.MakeNullBulkReply(),
+		protocol.MakeBigNumberReply(new(big.Int).Lsh(big.NewInt(1), 100)),
+		protocol.MakeVerbatimReply("txt", []byte("a\r\nb")),
+	}
+	reqs := bytes.Buffer{}
+	for _, re := range replies {
+		reqs.Write(protocol.Marshal(re, protocol.RESP3))
+	}
+	reqs.Write([]byte("#TS:1628217470" + protocol.CRLF)) // annotation in aof is not a boolean
+	expected := append(replies, protocol.MakeMultiBulkReply(utils.ToCmdLine("#TS:1628217470")))
+	results, err := ParseBytes(reqs.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d replies, actually %d", len(expected), len(results))
+	}
+	for i, exp := range expected {
+		expBytes := protocol.Marshal(exp, protocol.RESP3)
+		if !utils.BytesEquals(expBytes, protocol.Marshal(results[i], protocol.RESP3)) {
+			t.Errorf("parse failed: %s", expBytes)
+		}
+	}
+}
+
+func TestParseInline(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected []string
+	}{
+		{"set a b\n", []string{"set", "a", "b"}},
+		{"  set   a\tb  \r\n", []string{"set", "a", "b"}},
+		{`set "a b" 'c d'` + "\r\n", []string{"set", "a b", "c d"}},
+		{`set "\x41\n\"" 'it\'s'` + "\n", []string{"set", "A\n\"", "it's"}},
+		{`set "" ''` + "\n", []string{"set", "", ""}},
+	}
+	for _, tc := range testCases {
+		args, err := parseInline([]byte(tc.line))
+		if err != nil {
+			t.Errorf("%q: %v", tc.line, err)
+			continue
+		}
+		if !utils.BytesEquals(protocol.MakeMultiBulkReply(args).ToBytes(),
+			protocol.MakeMultiBulkReply(utils.ToCmdLine(tc.expected...)).ToBytes()) {
+			t.Errorf("%q: wrong args %q", tc.line, args)
+		}
+	}
+	for _, line := range []string{`set "a` + "\n", `set 'a'b` + "\n", `set "a"b` + "\n"} {
+		_, err := parseInline([]byte(line))
+		if err != errUnbalancedQuote {
+			t.Errorf("%q: expect unbalanced quotes, actually %v", line, err)
+		}
+	}
+
+	// empty lines are ignored and too big line stops parsing
+	data := "\r\n\nPING\n" + strings.Repeat("a", 101) + "\nPING\n"
+	var payloads []*Payload
+	for payload := range ParseStreamWithLimits(strings.NewReader(data), &Limits{MaxInlineLen: 100}) {
+		payloads = append(payloads, payload)
+	}
+	if len(payloads) != 2 || payloads[0].Err != nil || payloads[1].Err != errTooBigInline {
+		t.Errorf("unexpected payloads %v", payloads)
+	}
+	// lines are not limited without Limits, e.g. loading aof
+	payloads = nil
+	for payload := range ParseStream(strings.NewReader(data)) {
+		payloads = append(payloads, payload)
+	}
+	if len(payloads) != 4 || payloads[1].Err != nil || payloads[2].Err != nil || payloads[3].Err != io.EOF {
+		t.Errorf("unexpected payloads %v", payloads)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits := &Limits{
+		MaxBulkLen:      10,
+		MaxMultiBulkLen: 3,
+		MaxQueryBuffer:  40,
+	}
+	cmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "a")).ToBytes()
+	testCases := []struct {
+		name     string
+		data     string
+		expected error
+	}{
+		{"multi bulk", "*2147483647\r\n", errInvalidMultiBulkLen},
+		{"bulk", "*1\r\n$999999999\r\n", errInvalidBulkLen},
+		{"top level bulk", "$11\r\n", errInvalidBulkLen},
+		{"query buffer", "*3\r\n$3\r\nSET\r\n$10\r\n0123456789\r\n$10\r\n", errQueryBufferLimit},
+	}
+	for _, tc := range testCases {
+		var payloads []*Payload
+		for payload := range ParseStreamWithLimits(strings.NewReader(string(cmd)+tc.data+string(cmd)), limits) {
+			payloads = append(payloads, payload)
+		}
+		// parsing stops after the fatal error
+		if len(payloads) != 2 || payloads[0].Err != nil || payloads[1].Err != tc.expected {
+			t.Errorf("%s: unexpected payloads %v", tc.name, payloads)
+		}
+	}
+}
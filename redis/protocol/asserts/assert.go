@@ -36,6 +36,11 @@ func AssertIntReplyGreaterThan(t *testing.T, actual redis.Reply, expected int) {
 func AssertBulkReply(t *testing.T, actual redis.Reply, expected string) {
 	bulkReply, ok := actual.(*protocol.BulkReply)
 	if !ok {
+		// may be a RESP3 type encoded as bulk in RESP2, e.g. protocol.DoubleReply
+		expectBytes := protocol.MakeBulkReply([]byte(expected)).ToBytes()
+		if utils.BytesEquals(actual.ToBytes(), expectBytes) {
+			return
+		}
 		t.Errorf("expected bulk protocol, actually %s, %s", actual.ToBytes(), printStack())
 		return
 	}
@@ -114,6 +119,11 @@ func AssertNullBulk(t *testing.T, result redis.Reply) {
 func AssertMultiBulkReply(t *testing.T, actual redis.Reply, expected []string) {
 	multiBulk, ok := actual.(*protocol.MultiBulkReply)
 	if !ok {
+		// may be a RESP3 type encoded as multi bulk in RESP2, e.g. protocol.MapReply
+		expectBytes := protocol.MakeMultiBulkReply(utils.ToCmdLine(expected...)).ToBytes()
+		if utils.BytesEquals(actual.ToBytes(), expectBytes) {
+			return
+		}
 		t.Errorf("expected bulk protocol, actually %s, %s", actual.ToBytes(), printStack())
 		return
 	}
@@ -42,6 +42,26 @@ func MakeNullBulkReply() *NullBulkReply {
 	return &NullBulkReply{}
 }
 
+var nullMultiBulkBytes = []byte("*-1\r\n")
+
+// NullMultiBulkReply is a null array, e.g. the result of EXEC aborted by WATCH
+type NullMultiBulkReply struct{}
+
+// ToBytes marshal redis.Reply
+func (r *NullMultiBulkReply) ToBytes() []byte {
+	return nullMultiBulkBytes
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3
+func (r *NullMultiBulkReply) ToResp3Bytes() []byte {
+	return resp3NullBytes
+}
+
+// MakeNullMultiBulkReply creates a new NullMultiBulkReply
+func MakeNullMultiBulkReply() *NullMultiBulkReply {
+	return &NullMultiBulkReply{}
+}
+
 var emptyMultiBulkBytes = []byte("*0\r\n")
 
 // EmptyMultiBulkReply is a empty list
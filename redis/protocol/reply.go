@@ -7,8 +7,6 @@ import (
 )
 
 var (
-	nullBulkReplyBytes = []byte("$-1")
-
 	// CRLF is the line separator of redis serialization protocol
 	CRLF = "\r\n"
 )
@@ -27,14 +25,22 @@ func MakeBulkReply(arg []byte) *BulkReply {
 	}
 }
 
-// ToBytes marshal redis.Reply
+// ToBytes marshal redis.Reply, nil Arg means null bulk while empty Arg is an empty string
 func (r *BulkReply) ToBytes() []byte {
-	if len(r.Arg) == 0 {
-		return nullBulkReplyBytes
+	if r.Arg == nil {
+		return nullBulkBytes
 	}
 	return []byte("$" + strconv.Itoa(len(r.Arg)) + CRLF + string(r.Arg) + CRLF)
 }
 
+// ToResp3Bytes marshal redis.Reply in RESP3, nil Arg is encoded as null
+func (r *BulkReply) ToResp3Bytes() []byte {
+	if r.Arg == nil {
+		return resp3NullBytes
+	}
+	return r.ToBytes()
+}
+
 /* ---- Multi Bulk Reply ---- */
 
 // MultiBulkReply stores a list of string
@@ -51,16 +57,15 @@ func MakeMultiBulkReply(args [][]byte) *MultiBulkReply {
 
 // ToBytes marshal redis.Reply
 func (r *MultiBulkReply) ToBytes() []byte {
-	argLen := len(r.Args)
 	var buf bytes.Buffer
-	buf.WriteString("*" + strconv.Itoa(argLen) + CRLF)
-	for _, arg := range r.Args {
-		if arg == nil {
-			buf.WriteString("$-1" + CRLF)
-		} else {
-			buf.WriteString("$" + strconv.Itoa(len(arg)) + CRLF + string(arg) + CRLF)
-		}
-	}
+	_, _ = r.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3
+func (r *MultiBulkReply) ToResp3Bytes() []byte {
+	var buf bytes.Buffer
+	_, _ = r.WriteResp3To(&buf)
 	return buf.Bytes()
 }
 
@@ -80,12 +85,8 @@ func MakeMultiRawReply(replies []redis.Reply) *MultiRawReply {
 
 // ToBytes marshal redis.Reply
 func (r *MultiRawReply) ToBytes() []byte {
-	argLen := len(r.Replies)
 	var buf bytes.Buffer
-	buf.WriteString("*" + strconv.Itoa(argLen) + CRLF)
-	for _, arg := range r.Replies {
-		buf.Write(arg.ToBytes())
-	}
+	_, _ = r.WriteTo(&buf)
 	return buf.Bytes()
 }
 
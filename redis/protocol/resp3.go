@@ -0,0 +1,239 @@
+package protocol
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+/*
+ * RESP3 types are encoded as the closest RESP2 types by ToBytes,
+ * so commands could return them no matter which protocol the client uses.
+ * Use Marshal to encode a reply in the protocol negotiated by HELLO.
+ */
+
+const (
+	// RESP2 is the default protocol version
+	RESP2 = 2
+	// RESP3 is the protocol version negotiated by `HELLO 3`
+	RESP3 = 3
+)
+
+var resp3NullBytes = []byte("_\r\n")
+
+// Marshal encodes reply in the given protocol version
+func Marshal(reply redis.Reply, version int) []byte {
+	if version >= RESP3 {
+		if r, ok := reply.(redis.Resp3Reply); ok {
+			return r.ToResp3Bytes()
+		}
+	}
+	return reply.ToBytes()
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3, nested RESP3 types are kept
+func (r *MultiRawReply) ToResp3Bytes() []byte {
+	return marshalAggregate("*", len(r.Replies), r.Replies, RESP3)
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3
+func (r *NullBulkReply) ToResp3Bytes() []byte {
+	return resp3NullBytes
+}
+
+/* ---- Map Reply ---- */
+
+// MapReply stores key-value pairs, keys are at even positions of Args and values at odd positions.
+// It is encoded as a flat array in RESP2.
+type MapReply struct {
+	Args []redis.Reply
+}
+
+// MakeMapReply creates MapReply
+func MakeMapReply(args []redis.Reply) *MapReply {
+	return &MapReply{
+		Args: args,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *MapReply) ToBytes() []byte {
+	return marshalAggregate("*", len(r.Args), r.Args, RESP2)
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3
+func (r *MapReply) ToResp3Bytes() []byte {
+	return marshalAggregate("%", len(r.Args)/2, r.Args, RESP3)
+}
+
+/* ---- Set Reply ---- */
+
+// SetReply stores unordered distinct elements, it is encoded as an array in RESP2
+type SetReply struct {
+	Args []redis.Reply
+}
+
+// MakeSetReply creates SetReply
+func MakeSetReply(args []redis.Reply) *SetReply {
+	return &SetReply{
+		Args: args,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *SetReply) ToBytes() []byte {
+	return marshalAggregate("*", len(r.Args), r.Args, RESP2)
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3
+func (r *SetReply) ToResp3Bytes() []byte {
+	return marshalAggregate("~", len(r.Args), r.Args, RESP3)
+}
+
+/* ---- Push Reply ---- */
+
+// PushReply is an out-of-band message sent to client, such as pub/sub messages.
+// It is encoded as an array in RESP2.
+type PushReply struct {
+	Args []redis.Reply
+}
+
+// MakePushReply creates PushReply
+func MakePushReply(args []redis.Reply) *PushReply {
+	return &PushReply{
+		Args: args,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *PushReply) ToBytes() []byte {
+	return marshalAggregate("*", len(r.Args), r.Args, RESP2)
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3
+func (r *PushReply) ToResp3Bytes() []byte {
+	return marshalAggregate(">", len(r.Args), r.Args, RESP3)
+}
+
+/* ---- Double Reply ---- */
+
+// DoubleReply stores a floating point number, it is encoded as a bulk string in RESP2
+type DoubleReply struct {
+	Value float64
+}
+
+// MakeDoubleReply creates DoubleReply
+func MakeDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{
+		Value: value,
+	}
+}
+
+func (r *DoubleReply) String() string {
+	switch {
+	case math.IsInf(r.Value, 1):
+		return "inf"
+	case math.IsInf(r.Value, -1):
+		return "-inf"
+	case math.IsNaN(r.Value):
+		return "nan"
+	}
+	return strconv.FormatFloat(r.Value, 'f', -1, 64)
+}
+
+// ToBytes marshal redis.Reply
+func (r *DoubleReply) ToBytes() []byte {
+	return MakeBulkReply([]byte(r.String())).ToBytes()
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3
+func (r *DoubleReply) ToResp3Bytes() []byte {
+	return []byte("," + r.String() + CRLF)
+}
+
+/* ---- Boolean Reply ---- */
+
+// BoolReply stores a boolean, it is encoded as integer 1 or 0 in RESP2
+type BoolReply struct {
+	Value bool
+}
+
+var (
+	trueResp3Bytes  = []byte("#t\r\n")
+	falseResp3Bytes = []byte("#f\r\n")
+)
+
+// MakeBoolReply creates BoolReply
+func MakeBoolReply(value bool) *BoolReply {
+	return &BoolReply{
+		Value: value,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *BoolReply) ToBytes() []byte {
+	if r.Value {
+		return MakeIntReply(1).ToBytes()
+	}
+	return MakeIntReply(0).ToBytes()
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3
+func (r *BoolReply) ToResp3Bytes() []byte {
+	if r.Value {
+		return trueResp3Bytes
+	}
+	return falseResp3Bytes
+}
+
+/* ---- Big Number Reply ---- */
+
+// BigNumberReply stores an integer out of the range of int64, it is encoded as a bulk string in RESP2
+type BigNumberReply struct {
+	Value *big.Int
+}
+
+// MakeBigNumberReply creates BigNumberReply
+func MakeBigNumberReply(value *big.Int) *BigNumberReply {
+	return &BigNumberReply{
+		Value: value,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *BigNumberReply) ToBytes() []byte {
+	return MakeBulkReply([]byte(r.Value.String())).ToBytes()
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3
+func (r *BigNumberReply) ToResp3Bytes() []byte {
+	return []byte("(" + r.Value.String() + CRLF)
+}
+
+/* ---- Verbatim String Reply ---- */
+
+// VerbatimReply stores a string with its format, such as "txt" or "mkd".
+// It is encoded as a bulk string without format in RESP2.
+type VerbatimReply struct {
+	Format string
+	Text   []byte
+}
+
+// MakeVerbatimReply creates VerbatimReply, format must be 3 characters
+func MakeVerbatimReply(format string, text []byte) *VerbatimReply {
+	return &VerbatimReply{
+		Format: format,
+		Text:   text,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *VerbatimReply) ToBytes() []byte {
+	return MakeBulkReply(r.Text).ToBytes()
+}
+
+// ToResp3Bytes marshal redis.Reply in RESP3
+func (r *VerbatimReply) ToResp3Bytes() []byte {
+	return []byte("=" + strconv.Itoa(len(r.Format)+1+len(r.Text)) + CRLF + r.Format + ":" + string(r.Text) + CRLF)
+}
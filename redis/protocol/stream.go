@@ -0,0 +1,139 @@
+package protocol
+
+/*
+ * Aggregate replies may be huge, e.g. KEYS * or LRANGE 0 -1 of a large list.
+ * They implement redis.StreamReply, so elements are encoded directly into the connection writer
+ * rather than a buffer holding the whole reply. ToBytes is kept and shares the same encoding.
+ */
+
+import (
+	"bytes"
+	"github.com/hdt3213/godis/interface/redis"
+	"io"
+	"strconv"
+)
+
+// MarshalTo encodes reply into w in the given protocol version, a redis.StreamReply is written piece by piece
+func MarshalTo(w io.Writer, reply redis.Reply, version int) error {
+	if r, ok := reply.(redis.StreamReply); ok {
+		var err error
+		if version >= RESP3 {
+			_, err = r.WriteResp3To(w)
+		} else {
+			_, err = r.WriteTo(w)
+		}
+		return err
+	}
+	_, err := w.Write(Marshal(reply, version))
+	return err
+}
+
+// streamWriter counts written bytes and skips following writes after the first error
+type streamWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+// Write implements io.Writer, so that nested replies could be encoded by MarshalTo
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	n, err := sw.w.Write(b)
+	sw.n += int64(n)
+	sw.err = err
+	return n, err
+}
+
+func (sw *streamWriter) writeString(s string) {
+	if sw.err != nil {
+		return
+	}
+	n, err := io.WriteString(sw.w, s)
+	sw.n += int64(n)
+	sw.err = err
+}
+
+// writeAggregate encodes an aggregate type whose elements may be RESP3 types
+func writeAggregate(w io.Writer, prefix string, size int, replies []redis.Reply, version int) (int64, error) {
+	sw := &streamWriter{w: w}
+	sw.writeString(prefix + strconv.Itoa(size) + CRLF)
+	for _, reply := range replies {
+		if sw.err != nil {
+			break
+		}
+		sw.err = MarshalTo(sw, reply, version)
+	}
+	return sw.n, sw.err
+}
+
+// marshalAggregate encodes an aggregate type into bytes
+func marshalAggregate(prefix string, size int, replies []redis.Reply, version int) []byte {
+	var buf bytes.Buffer
+	_, _ = writeAggregate(&buf, prefix, size, replies, version)
+	return buf.Bytes()
+}
+
+/* ---- Multi Bulk Reply ---- */
+
+// WriteTo encodes reply into w element by element
+func (r *MultiBulkReply) WriteTo(w io.Writer) (int64, error) {
+	return r.writeTo(w, nullBulkBytes)
+}
+
+// WriteResp3To encodes reply into w in RESP3, in which nil elements are encoded as null
+func (r *MultiBulkReply) WriteResp3To(w io.Writer) (int64, error) {
+	return r.writeTo(w, resp3NullBytes)
+}
+
+func (r *MultiBulkReply) writeTo(w io.Writer, null []byte) (int64, error) {
+	sw := &streamWriter{w: w}
+	sw.writeString("*" + strconv.Itoa(len(r.Args)) + CRLF)
+	for _, arg := range r.Args {
+		if arg == nil {
+			_, _ = sw.Write(null)
+			continue
+		}
+		sw.writeString("$" + strconv.Itoa(len(arg)) + CRLF)
+		_, _ = sw.Write(arg)
+		sw.writeString(CRLF)
+	}
+	return sw.n, sw.err
+}
+
+/* ---- Multi Raw Reply ---- */
+
+// WriteTo encodes reply into w element by element
+func (r *MultiRawReply) WriteTo(w io.Writer) (int64, error) {
+	return writeAggregate(w, "*", len(r.Replies), r.Replies, RESP2)
+}
+
+// WriteResp3To encodes reply into w in RESP3, nested RESP3 types are kept
+func (r *MultiRawReply) WriteResp3To(w io.Writer) (int64, error) {
+	return writeAggregate(w, "*", len(r.Replies), r.Replies, RESP3)
+}
+
+/* ---- Map Reply ---- */
+
+// WriteTo encodes reply into w as a flat array
+func (r *MapReply) WriteTo(w io.Writer) (int64, error) {
+	return writeAggregate(w, "*", len(r.Args), r.Args, RESP2)
+}
+
+// WriteResp3To encodes reply into w in RESP3
+func (r *MapReply) WriteResp3To(w io.Writer) (int64, error) {
+	return writeAggregate(w, "%", len(r.Args)/2, r.Args, RESP3)
+}
+
+/* ---- Set Reply ---- */
+
+// WriteTo encodes reply into w as an array
+func (r *SetReply) WriteTo(w io.Writer) (int64, error) {
+	return writeAggregate(w, "*", len(r.Args), r.Args, RESP2)
+}
+
+// WriteResp3To encodes reply into w in RESP3
+func (r *SetReply) WriteResp3To(w io.Writer) (int64, error) {
+	return writeAggregate(w, "~", len(r.Args), r.Args, RESP3)
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hdt3213/godis/interface/redis"
+	"testing"
+)
+
+func TestMarshalTo(t *testing.T) {
+	replies := []redis.Reply{
+		MakeMultiBulkReply([][]byte{[]byte("a"), nil, []byte("")}),
+		MakeMultiBulkReply(nil),
+		MakeMultiRawReply([]redis.Reply{
+			MakeIntReply(1),
+			MakeMapReply([]redis.Reply{MakeBulkReply([]byte("k")), MakeDoubleReply(1.5)}),
+			MakeNullBulkReply(),
+		}),
+		MakeSetReply([]redis.Reply{MakeBulkReply([]byte("a")), MakeBoolReply(true)}),
+		MakeStatusReply("OK"),
+	}
+	for _, reply := range replies {
+		for _, version := range []int{RESP2, RESP3} {
+			var buf bytes.Buffer
+			if err := MarshalTo(&buf, reply, version); err != nil {
+				t.Fatal(err)
+			}
+			expected := Marshal(reply, version)
+			if !bytes.Equal(buf.Bytes(), expected) {
+				t.Errorf("expect %q, actually %q", expected, buf.Bytes())
+			}
+		}
+	}
+}
+
+// limitedWriter fails after limit bytes were written
+type limitedWriter struct {
+	limit  int
+	writes int
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if len(b) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errors.New("no space")
+	}
+	w.limit -= len(b)
+	return len(b), nil
+}
+
+func TestWriteToInChunks(t *testing.T) {
+	args := make([][]byte, 1000)
+	for i := range args {
+		args[i] = []byte("value")
+	}
+	reply := MakeMultiBulkReply(args)
+	w := &limitedWriter{limit: 1 << 20}
+	n, err := reply.WriteTo(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(reply.ToBytes())) {
+		t.Errorf("expect %d bytes written, actually %d", len(reply.ToBytes()), n)
+	}
+	if w.writes <= 1 {
+		t.Error("reply should be written element by element")
+	}
+
+	// stops after the first error
+	w = &limitedWriter{limit: 100}
+	n, err = MakeMultiRawReply([]redis.Reply{reply, reply}).WriteTo(w)
+	if err == nil {
+		t.Error("expect error")
+	}
+	if n != 100 {
+		t.Errorf("expect 100 bytes written, actually %d", n)
+	}
+	if writes := w.writes; writes > 100 {
+		t.Errorf("writing should stop after error, actually %d writes", writes)
+	}
+}
+
+func TestNullInResp3(t *testing.T) {
+	cases := []struct {
+		reply redis.Reply
+		resp2 string
+		resp3 string
+	}{
+		{MakeBulkReply(nil), "$-1\r\n", "_\r\n"},
+		{MakeBulkReply([]byte{}), "$0\r\n\r\n", "$0\r\n\r\n"},
+		{MakeNullBulkReply(), "$-1\r\n", "_\r\n"},
+		{MakeNullMultiBulkReply(), "*-1\r\n", "_\r\n"},
+		{MakeMultiBulkReply([][]byte{nil, {}}), "*2\r\n$-1\r\n$0\r\n\r\n", "*2\r\n_\r\n$0\r\n\r\n"},
+		{MakeMultiRawReply([]redis.Reply{MakeBulkReply(nil)}), "*1\r\n$-1\r\n", "*1\r\n_\r\n"},
+	}
+	for _, c := range cases {
+		if actual := string(Marshal(c.reply, RESP2)); actual != c.resp2 {
+			t.Errorf("expect %q in RESP2, actually %q", c.resp2, actual)
+		}
+		if actual := string(Marshal(c.reply, RESP3)); actual != c.resp3 {
+			t.Errorf("expect %q in RESP3, actually %q", c.resp3, actual)
+		}
+		var buf bytes.Buffer
+		if err := MarshalTo(&buf, c.reply, RESP3); err != nil || buf.String() != c.resp3 {
+			t.Errorf("expect %q written in RESP3, actually %q %v", c.resp3, buf.String(), err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+/*
+ * CLIENT commands inspect and manage connections of the server, so they are executed by Handler rather than database
+ */
+
+import (
+	"fmt"
+	"github.com/hdt3213/godis/config"
+	database2 "github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultUser is the only user of godis
+const defaultUser = "default"
+
+func isAuthenticated(c *connection.Connection) bool {
+	if config.Properties.RequirePass == "" {
+		return true
+	}
+	return c.GetPassword() == config.Properties.RequirePass
+}
+
+// execClient executes CLIENT subcommands, closeSelf is true if current connection should be closed after reply
+func (h *Handler) execClient(c *connection.Connection, args [][]byte) (result redis.Reply, closeSelf bool) {
+	if !isAuthenticated(c) {
+		return protocol.MakeErrReply("NOAUTH Authentication required"), false
+	}
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("client"), false
+	}
+	subCmd := strings.ToLower(string(args[1]))
+	switch subCmd {
+	case "id":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|id"), false
+		}
+		return protocol.MakeIntReply(int64(c.ID())), false
+	case "getname":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|getname"), false
+		}
+		name := c.GetName()
+		if name == "" {
+			return protocol.MakeNullBulkReply(), false
+		}
+		return protocol.MakeBulkReply([]byte(name)), false
+	case "setname":
+		if len(args) != 3 {
+			return protocol.MakeArgNumErrReply("client|setname"), false
+		}
+		name := string(args[2])
+		if !database2.IsValidClientName(name) {
+			return protocol.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters."), false
+		}
+		c.SetName(name)
+		return protocol.MakeOkReply(), false
+	case "info":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|info"), false
+		}
+		return protocol.MakeVerbatimReply("txt", []byte(formatClientInfo(c.GetStats()))), false
+	case "list":
+		return h.clientList(args[2:]), false
+	case "kill":
+		return h.clientKill(c, args[2:])
+	case "tracking":
+		return h.execClientTracking(c, args[2:]), false
+	case "caching":
+		return h.execClientCaching(c, args[2:]), false
+	case "pause":
+		return h.execClientPause(args[2:]), false
+	case "unpause":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|unpause"), false
+		}
+		h.unpauseClients(true)
+		return protocol.MakeOkReply(), false
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[1]) + "'"), false
+}
+
+// formatClientInfo formats stats like a line of CLIENT LIST, fields not supported by godis are omitted
+func formatClientInfo(stats *connection.Stats) string {
+	flags := "N"
+	if stats.Subs > 0 {
+		flags = "P"
+	}
+	if stats.Multi >= 0 {
+		flags += "x"
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=0 multi=%d user=%s cmd=%s\n",
+		stats.ID, stats.Addr, stats.LocalAddr, stats.Name, int64(stats.Age.Seconds()), int64(stats.Idle.Seconds()),
+		flags, stats.DB, stats.Subs, stats.Multi, defaultUser, stats.LastCmd)
+}
+
+// clientFilter selects clients by CLIENT LIST or CLIENT KILL options
+type clientFilter struct {
+	ids       map[uint64]bool
+	addr      string
+	localAddr string
+	// clientType is normal or pubsub
+	clientType string
+	skipMe     bool
+}
+
+func (f *clientFilter) match(self *connection.Connection, c *connection.Connection, stats *connection.Stats) bool {
+	if f.skipMe && c == self {
+		return false
+	}
+	if f.ids != nil && !f.ids[stats.ID] {
+		return false
+	}
+	if f.addr != "" && f.addr != stats.Addr {
+		return false
+	}
+	if f.localAddr != "" && f.localAddr != stats.LocalAddr {
+		return false
+	}
+	switch f.clientType {
+	case "normal":
+		return stats.Subs == 0
+	case "pubsub":
+		return stats.Subs > 0
+	case "master", "replica", "slave":
+		return false
+	}
+	return true
+}
+
+// parseClientType parses TYPE option, master and replica are valid but never matched
+func parseClientType(arg []byte) (string, bool) {
+	clientType := strings.ToLower(string(arg))
+	switch clientType {
+	case "normal", "pubsub", "master", "replica", "slave":
+		return clientType, true
+	}
+	return "", false
+}
+
+func parseClientID(arg []byte) (uint64, bool) {
+	id, err := strconv.ParseUint(string(arg), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// forEachClient iterates connected clients which match filter
+func (h *Handler) forEachClient(self *connection.Connection, filter *clientFilter, consumer func(*connection.Connection, *connection.Stats)) {
+	h.activeConn.Range(func(key, value interface{}) bool {
+		c := key.(*connection.Connection)
+		stats := c.GetStats()
+		if filter.match(self, c, stats) {
+			consumer(c, stats)
+		}
+		return true
+	})
+}
+
+// clientList executes CLIENT LIST [TYPE normal|master|replica|pubsub] [ID client-id [client-id ...]]
+func (h *Handler) clientList(args [][]byte) redis.Reply {
+	filter := &clientFilter{}
+	if len(args) > 0 {
+		option := strings.ToLower(string(args[0]))
+		if option == "type" && len(args) == 2 {
+			clientType, ok := parseClientType(args[1])
+			if !ok {
+				return protocol.MakeErrReply("ERR Unknown client type '" + string(args[1]) + "'")
+			}
+			filter.clientType = clientType
+		} else if option == "id" && len(args) >= 2 {
+			filter.ids = make(map[uint64]bool)
+			for _, arg := range args[1:] {
+				id, ok := parseClientID(arg)
+				if !ok {
+					return protocol.MakeErrReply("ERR Invalid client ID")
+				}
+				filter.ids[id] = true
+			}
+		} else {
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	var list []*connection.Stats
+	h.forEachClient(nil, filter, func(c *connection.Connection, stats *connection.Stats) {
+		list = append(list, stats)
+	})
+	// sort by id as redis does
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	var builder strings.Builder
+	for _, stats := range list {
+		builder.WriteString(formatClientInfo(stats))
+	}
+	return protocol.MakeVerbatimReply("txt", []byte(builder.String()))
+}
+
+// clientKill executes CLIENT KILL ip:port, or CLIENT KILL <filter> <value> ... which returns the number of killed clients.
+// Filters are ID, ADDR, LADDR, USER, TYPE and SKIPME.
+func (h *Handler) clientKill(self *connection.Connection, args [][]byte) (redis.Reply, bool) {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("client|kill"), false
+	}
+	// old style: CLIENT KILL ip:port
+	if len(args) == 1 {
+		filter := &clientFilter{addr: string(args[0])}
+		killed, closeSelf := h.killClients(self, filter)
+		if killed == 0 {
+			return protocol.MakeErrReply("ERR No such client"), false
+		}
+		return protocol.MakeOkReply(), closeSelf
+	}
+	if len(args)%2 != 0 {
+		return protocol.MakeSyntaxErrReply(), false
+	}
+	filter := &clientFilter{skipMe: true}
+	for i := 0; i < len(args); i += 2 {
+		option := strings.ToLower(string(args[i]))
+		value := args[i+1]
+		switch option {
+		case "id":
+			id, ok := parseClientID(value)
+			if !ok {
+				return protocol.MakeErrReply("ERR client-id should be greater than 0"), false
+			}
+			filter.ids = map[uint64]bool{id: true}
+		case "addr":
+			filter.addr = string(value)
+		case "laddr":
+			filter.localAddr = string(value)
+		case "type":
+			clientType, ok := parseClientType(value)
+			if !ok {
+				return protocol.MakeErrReply("ERR Unknown client type '" + string(value) + "'"), false
+			}
+			filter.clientType = clientType
+		case "user":
+			if string(value) != defaultUser {
+				return protocol.MakeErrReply("ERR No such user '" + string(value) + "'"), false
+			}
+		case "skipme":
+			switch strings.ToLower(string(value)) {
+			case "yes":
+				filter.skipMe = true
+			case "no":
+				filter.skipMe = false
+			default:
+				return protocol.MakeSyntaxErrReply(), false
+			}
+		default:
+			return protocol.MakeSyntaxErrReply(), false
+		}
+	}
+	killed, closeSelf := h.killClients(self, filter)
+	return protocol.MakeIntReply(int64(killed)), closeSelf
+}
+
+// killClients closes clients matching filter except self, which should be closed after reply
+func (h *Handler) killClients(self *connection.Connection, filter *clientFilter) (killed int, closeSelf bool) {
+	h.forEachClient(self, filter, func(c *connection.Connection, stats *connection.Stats) {
+		killed++
+		if c == self {
+			closeSelf = true
+			return
+		}
+		// closing may wait for pending replies of c, which should not block the killer.
+		// The goroutine serving c finds connection closed and cleans up
+		go func() {
+			_ = c.Close()
+		}()
+	})
+	return killed, closeSelf
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"github.com/hdt3213/godis/tcp"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	conn    net.Conn
+	replies <-chan *parser.Payload
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{
+		conn:    conn,
+		replies: parser.ParseStream(conn),
+	}
+}
+
+func (c *testClient) send(t *testing.T, args ...string) redis.Reply {
+	_, err := c.conn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine(args...)).ToBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.receive(t)
+}
+
+func (c *testClient) receive(t *testing.T) redis.Reply {
+	select {
+	case payload, ok := <-c.replies:
+		if !ok {
+			return nil
+		}
+		if payload.Err != nil {
+			return nil
+		}
+		return payload.Data
+	case <-time.After(3 * time.Second):
+		t.Fatal("receive reply timeout")
+	}
+	return nil
+}
+
+func startTestServer(t testing.TB) (addr string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := MakeHandler()
+	waitLoaded(handler)
+	closeChan := make(chan struct{})
+	go tcp.ListenAndServe(listener, handler, closeChan)
+	return listener.Addr().String(), func() {
+		closeChan <- struct{}{}
+	}
+}
+
+func getClientList(t *testing.T, c *testClient, args ...string) []string {
+	ret := c.send(t, append([]string{"CLIENT", "LIST"}, args...)...)
+	bulk, ok := ret.(*protocol.BulkReply)
+	if !ok {
+		t.Fatalf("expect bulk reply, actually %s", ret.ToBytes())
+	}
+	return strings.Split(strings.TrimSuffix(string(bulk.Arg), "\n"), "\n")
+}
+
+func TestClientCommands(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+	c1 := dialTestClient(t, addr)
+	defer c1.conn.Close()
+	c2 := dialTestClient(t, addr)
+	defer c2.conn.Close()
+
+	ret := c1.send(t, "CLIENT", "ID")
+	intReply, ok := ret.(*protocol.IntReply)
+	if !ok {
+		t.Fatalf("expect int reply, actually %s", ret.ToBytes())
+	}
+	id1 := strconv.FormatInt(intReply.Code, 10)
+
+	ret = c1.send(t, "CLIENT", "GETNAME")
+	asserts.AssertNullBulk(t, ret)
+	ret = c1.send(t, "CLIENT", "SETNAME", "a b")
+	asserts.AssertErrReply(t, ret, "ERR Client names cannot contain spaces, newlines or special characters.")
+	ret = c1.send(t, "CLIENT", "SETNAME", "first")
+	asserts.AssertStatusReply(t, ret, "OK")
+	ret = c1.send(t, "CLIENT", "GETNAME")
+	asserts.AssertBulkReply(t, ret, "first")
+
+	ret = c1.send(t, "SELECT", "1")
+	asserts.AssertStatusReply(t, ret, "OK")
+	ret = c1.send(t, "CLIENT", "INFO")
+	bulk, ok := ret.(*protocol.BulkReply)
+	if !ok {
+		t.Fatalf("expect bulk reply, actually %s", ret.ToBytes())
+	}
+	info := string(bulk.Arg)
+	for _, field := range []string{"id=" + id1 + " ", "name=first ", "db=1 ", "flags=N ", "multi=-1 ", "cmd=client\n"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("expect %s in client info: %s", field, info)
+		}
+	}
+
+	ret = c2.send(t, "SUBSCRIBE", "ch")
+	asserts.AssertMultiBulkReply(t, ret, []string{"subscribe", "ch", ":1"})
+	list := getClientList(t, c1)
+	if len(list) != 2 {
+		t.Fatalf("expect 2 clients, actually %d", len(list))
+	}
+	if !strings.HasPrefix(list[0], "id="+id1+" ") {
+		t.Errorf("clients should be sorted by id: %v", list)
+	}
+	if !strings.Contains(list[1], "flags=P ") || !strings.Contains(list[1], "sub=1 ") ||
+		!strings.HasSuffix(list[1], "cmd=subscribe") {
+		t.Errorf("wrong info of subscriber: %s", list[1])
+	}
+	list = getClientList(t, c1, "TYPE", "pubsub")
+	if len(list) != 1 || strings.HasPrefix(list[0], "id="+id1+" ") {
+		t.Errorf("expect subscriber only: %v", list)
+	}
+	list = getClientList(t, c1, "ID", id1)
+	if len(list) != 1 || !strings.HasPrefix(list[0], "id="+id1+" ") {
+		t.Errorf("expect client %s only: %v", id1, list)
+	}
+
+	ret = c1.send(t, "CLIENT", "NO-SUCH-SUBCOMMAND")
+	asserts.AssertErrReply(t, ret, "ERR unknown subcommand 'NO-SUCH-SUBCOMMAND'")
+}
+
+func TestClientKill(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+	c1 := dialTestClient(t, addr)
+	defer c1.conn.Close()
+	c2 := dialTestClient(t, addr)
+	defer c2.conn.Close()
+	c3 := dialTestClient(t, addr)
+	defer c3.conn.Close()
+
+	ret := c2.send(t, "CLIENT", "ID")
+	id2 := strconv.FormatInt(ret.(*protocol.IntReply).Code, 10)
+	ret = c1.send(t, "CLIENT", "KILL", "ID", id2)
+	asserts.AssertIntReply(t, ret, 1)
+	if ret = c2.receive(t); ret != nil {
+		t.Errorf("expect client killed, actually %s", ret.ToBytes())
+	}
+
+	ret = c1.send(t, "CLIENT", "KILL", "USER", "nobody")
+	asserts.AssertErrReply(t, ret, "ERR No such user 'nobody'")
+	ret = c1.send(t, "CLIENT", "KILL", "127.0.0.1:1")
+	asserts.AssertErrReply(t, ret, "ERR No such client")
+
+	// old style kill by address
+	ret = c1.send(t, "CLIENT", "KILL", c3.conn.LocalAddr().String())
+	asserts.AssertStatusReply(t, ret, "OK")
+	if ret = c3.receive(t); ret != nil {
+		t.Errorf("expect client killed, actually %s", ret.ToBytes())
+	}
+
+	// skip current client by default
+	ret = c1.send(t, "CLIENT", "KILL", "USER", "default")
+	asserts.AssertIntReply(t, ret, 0)
+	ret = c1.send(t, "CLIENT", "KILL", "USER", "default", "SKIPME", "no")
+	asserts.AssertIntReply(t, ret, 1)
+	if ret = c1.receive(t); ret != nil {
+		t.Errorf("expect client killed, actually %s", ret.ToBytes())
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+	c1 := dialTestClient(t, addr)
+	defer c1.conn.Close()
+	c2 := dialTestClient(t, addr)
+	defer c2.conn.Close()
+
+	ret := c1.send(t, "CLIENT", "PAUSE", "500", "WRITE")
+	asserts.AssertStatusReply(t, ret, "OK")
+	start := time.Now()
+	ret = c2.send(t, "GET", "a")
+	asserts.AssertNullBulk(t, ret)
+	if time.Since(start) > 200*time.Millisecond {
+		t.Error("read should not be paused in WRITE mode")
+	}
+	ret = c2.send(t, "SET", "a", "1")
+	asserts.AssertStatusReply(t, ret, "OK")
+	if time.Since(start) < 400*time.Millisecond {
+		t.Error("write should be paused in WRITE mode")
+	}
+
+	// transaction with writes is paused at EXEC
+	ret = c1.send(t, "CLIENT", "PAUSE", "500", "WRITE")
+	asserts.AssertStatusReply(t, ret, "OK")
+	start = time.Now()
+	asserts.AssertStatusReply(t, c2.send(t, "MULTI"), "OK")
+	asserts.AssertStatusReply(t, c2.send(t, "SET", "a", "2"), "QUEUED")
+	if time.Since(start) > 200*time.Millisecond {
+		t.Error("commands should be queued during pause")
+	}
+	asserts.AssertMultiBulkReplySize(t, c2.send(t, "EXEC"), 1)
+	if time.Since(start) < 400*time.Millisecond {
+		t.Error("exec should be paused in WRITE mode")
+	}
+
+	// all commands are paused until unpause
+	ret = c1.send(t, "CLIENT", "PAUSE", "10000")
+	asserts.AssertStatusReply(t, ret, "OK")
+	_, err := c2.conn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("GET", "a")).ToBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-c2.replies:
+		t.Errorf("read should be paused in ALL mode, got %v", payload)
+	case <-time.After(300 * time.Millisecond):
+	}
+	ret = c1.send(t, "CLIENT", "UNPAUSE")
+	asserts.AssertStatusReply(t, ret, "OK")
+	asserts.AssertBulkReply(t, c2.receive(t), "2")
+}
+
+func TestClientTrackingRedirect(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+	c1 := dialTestClient(t, addr)
+	defer c1.conn.Close()
+	// test client cannot parse nested array, so read messages of subscriber as raw bytes
+	subscriber, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	reader := bufio.NewReader(subscriber)
+	readRaw := func(expected string) {
+		_ = subscriber.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != expected {
+			t.Fatalf("expect %q, actually %q", expected, buf)
+		}
+	}
+	_, err = subscriber.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("SUBSCRIBE", "__redis__:invalidate")).ToBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRaw("*3\r\n$9\r\nsubscribe\r\n$20\r\n__redis__:invalidate\r\n:1\r\n")
+	var subscriberID string
+	for _, line := range getClientList(t, c1, "TYPE", "pubsub") {
+		subscriberID = strings.TrimPrefix(strings.Fields(line)[0], "id=")
+	}
+
+	ret := c1.send(t, "CLIENT", "TRACKING", "ON", "REDIRECT", "999999")
+	asserts.AssertErrReply(t, ret, "ERR The client ID you want redirect to does not exist")
+	ret = c1.send(t, "CLIENT", "TRACKING", "ON", "PREFIX", "a")
+	asserts.AssertErrReply(t, ret, "ERR PREFIX option requires BCAST mode to be enabled")
+	ret = c1.send(t, "CLIENT", "TRACKING", "ON", "OPTIN", "OPTOUT")
+	asserts.AssertErrReply(t, ret, "ERR You can't use both OPTIN and OPTOUT.")
+	ret = c1.send(t, "CLIENT", "CACHING", "yes")
+	asserts.AssertErrReply(t, ret, "ERR CLIENT CACHING can be called only when the client is in tracking mode "+
+		"with OPTIN or OPTOUT mode enabled")
+
+	ret = c1.send(t, "CLIENT", "TRACKING", "ON", "REDIRECT", subscriberID, "OPTIN")
+	asserts.AssertStatusReply(t, ret, "OK")
+	asserts.AssertStatusReply(t, c1.send(t, "CLIENT", "CACHING", "yes"), "OK")
+	asserts.AssertNullBulk(t, c1.send(t, "GET", "a"))
+	// CLIENT CACHING only affects the next command
+	asserts.AssertNullBulk(t, c1.send(t, "GET", "b"))
+	asserts.AssertIntReply(t, c1.send(t, "DEL", "b"), 0)
+	asserts.AssertStatusReply(t, c1.send(t, "SET", "a", "1"), "OK")
+	readRaw("*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$1\r\na\r\n")
+
+	ret = c1.send(t, "CLIENT", "TRACKING", "OFF")
+	asserts.AssertStatusReply(t, ret, "OK")
+}
+
+func TestClientPausePipeline(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+	c1 := dialTestClient(t, addr)
+	defer c1.conn.Close()
+	c2 := dialTestClient(t, addr)
+	defer c2.conn.Close()
+
+	ret := c1.send(t, "CLIENT", "PAUSE", "10000", "WRITE")
+	asserts.AssertStatusReply(t, ret, "OK")
+	// reply of GET should not be held by the paused SET in the same pipeline
+	pipeline := append(protocol.MakeMultiBulkReply(utils.ToCmdLine("GET", "a")).ToBytes(),
+		protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "1")).ToBytes()...)
+	_, err := c2.conn.Write(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-c2.replies:
+		asserts.AssertNullBulk(t, payload.Data)
+	case <-time.After(time.Second):
+		t.Error("reply of GET is held by pause")
+	}
+	select {
+	case payload := <-c2.replies:
+		t.Errorf("write should be paused in WRITE mode, got %v", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+	ret = c1.send(t, "CLIENT", "UNPAUSE")
+	asserts.AssertStatusReply(t, ret, "OK")
+	asserts.AssertStatusReply(t, c2.receive(t), "OK")
+}
@@ -0,0 +1,175 @@
+package server
+
+/*
+ * CLIENT PAUSE holds commands from clients until timeout or CLIENT UNPAUSE, it is used for failover.
+ * In WRITE mode, commands which may modify dataset are paused and read only commands are still served.
+ * CLIENT commands are never paused, so that CLIENT UNPAUSE is always available.
+ */
+
+import (
+	database2 "github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modes of CLIENT PAUSE, ALL overrides WRITE
+const (
+	pauseNone = iota
+	pauseWrite
+	pauseAll
+)
+
+// commands out of router which never modify dataset, they are served during WRITE pause
+var pauseWriteAllowedCommands = map[string]bool{
+	"auth":         true,
+	"hello":        true,
+	"info":         true,
+	"select":       true,
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"multi":        true,
+	"discard":      true,
+	"watch":        true,
+	"save":         true,
+	"bgsave":       true,
+	"bgrewriteaof": true,
+	"rewriteaof":   true,
+	"lastsave":     true,
+}
+
+// expirationPauser is implemented by standalone database, expired keys are kept during pause
+type expirationPauser interface {
+	PauseExpiration(until time.Time)
+	ResumeExpiration()
+}
+
+type pauseState struct {
+	mu    sync.Mutex
+	mode  int
+	end   time.Time
+	done  chan struct{} // closed when pause ends
+	timer *time.Timer
+}
+
+// pauseClients pauses commands until end, a pause in progress is extended
+func (h *Handler) pauseClients(mode int, end time.Time) {
+	p := &h.pause
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mode == pauseNone {
+		p.done = make(chan struct{})
+	} else {
+		if p.mode > mode {
+			mode = p.mode
+		}
+		if p.end.After(end) {
+			end = p.end
+		}
+		p.timer.Stop()
+	}
+	p.mode = mode
+	p.end = end
+	p.timer = time.AfterFunc(time.Until(end), func() {
+		h.unpauseClients(false)
+	})
+	if pauser, ok := h.db.(expirationPauser); ok {
+		pauser.PauseExpiration(end)
+	}
+}
+
+// unpauseClients resumes paused commands, the pause is kept if it is not timeout unless force is true
+func (h *Handler) unpauseClients(force bool) {
+	p := &h.pause
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mode == pauseNone {
+		return
+	}
+	if !force && time.Now().Before(p.end) {
+		// the pause has been extended
+		return
+	}
+	p.mode = pauseNone
+	p.timer.Stop()
+	close(p.done)
+	if pauser, ok := h.db.(expirationPauser); ok {
+		pauser.ResumeExpiration()
+	}
+}
+
+// isPaused returns whether the command of c should wait for the pause
+func (h *Handler) isPaused(c *connection.Connection, cmdName string) bool {
+	p := &h.pause
+	p.mu.Lock()
+	mode := p.mode
+	p.mu.Unlock()
+	return mode != pauseNone && isPausedCommand(mode, c, cmdName)
+}
+
+// waitPause blocks until the command could be executed
+func (h *Handler) waitPause(c *connection.Connection, cmdName string) {
+	p := &h.pause
+	for {
+		p.mu.Lock()
+		mode, done := p.mode, p.done
+		p.mu.Unlock()
+		if mode == pauseNone || !isPausedCommand(mode, c, cmdName) {
+			return
+		}
+		// flush again in case of the pause started after the check of invoker
+		_ = c.Flush()
+		<-done
+	}
+}
+
+func isPausedCommand(mode int, c *connection.Connection, cmdName string) bool {
+	if cmdName == "client" {
+		return false
+	}
+	if mode == pauseAll {
+		return true
+	}
+	if cmdName == "exec" {
+		// transaction is paused if any queued command is a write
+		for _, cmdLine := range c.GetQueuedCmdLine() {
+			if !database2.IsReadOnlyCommand(string(cmdLine[0])) {
+				return true
+			}
+		}
+		return false
+	}
+	if c.InMultiState() {
+		// commands are queued rather than executed
+		return false
+	}
+	return !database2.IsReadOnlyCommand(cmdName) && !pauseWriteAllowedCommands[cmdName]
+}
+
+// execClientPause executes CLIENT PAUSE timeout [WRITE|ALL]
+func (h *Handler) execClientPause(args [][]byte) redis.Reply {
+	if len(args) != 1 && len(args) != 2 {
+		return protocol.MakeArgNumErrReply("client|pause")
+	}
+	timeout, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || timeout < 0 {
+		return protocol.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	mode := pauseAll
+	if len(args) == 2 {
+		switch strings.ToLower(string(args[1])) {
+		case "write":
+			mode = pauseWrite
+		case "all":
+			mode = pauseAll
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	h.pauseClients(mode, time.Now().Add(time.Duration(timeout)*time.Millisecond))
+	return protocol.MakeOkReply()
+}
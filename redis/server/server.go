@@ -10,6 +10,7 @@ import (
 	"github.com/hdt3213/godis/config"
 	database2 "github.com/hdt3213/godis/database"
 	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/sync/atomic"
 	"github.com/hdt3213/godis/redis/connection"
@@ -19,37 +20,138 @@ import (
 	"net"
 	"strings"
 	"sync"
+	syncatomic "sync/atomic"
+	"time"
 )
 
 var (
-	unknownErrReplyBytes = []byte("-ERR unknown\r\n")
+	unknownErrReplyBytes    = []byte("-ERR unknown\r\n")
+	loadingErrReplyBytes    = []byte("-LOADING godis is loading the dataset in memory\r\n")
+	maxClientsErrReplyBytes = []byte("-ERR max number of clients reached\r\n")
+	protocolErrReplyBytes   = []byte("-ERR Protocol error: expected multi bulk or inline command\r\n")
 )
 
+// defaultMaxClients is used if maxclients is not set, same as redis
+const defaultMaxClients = 10000
+
+// default limits of requests, same as redis
+const (
+	defaultProtoMaxBulkLen        = 512 * 1024 * 1024
+	defaultProtoMaxMultiBulkLen   = 1024 * 1024
+	defaultClientQueryBufferLimit = 1024 * 1024 * 1024
+	protoInlineMaxSize            = 64 * 1024
+)
+
+// getParseLimits returns limits of requests in config, zero values are replaced by defaults
+func getParseLimits() *parser.Limits {
+	limits := &parser.Limits{
+		MaxBulkLen:      int64(config.Properties.ProtoMaxBulkLen),
+		MaxMultiBulkLen: int64(config.Properties.ProtoMaxMultiBulkLen),
+		MaxQueryBuffer:  int64(config.Properties.ClientQueryBufferLimit),
+		MaxInlineLen:    protoInlineMaxSize,
+	}
+	if limits.MaxBulkLen <= 0 {
+		limits.MaxBulkLen = defaultProtoMaxBulkLen
+	}
+	if limits.MaxMultiBulkLen <= 0 {
+		limits.MaxMultiBulkLen = defaultProtoMaxMultiBulkLen
+	}
+	if limits.MaxQueryBuffer <= 0 {
+		limits.MaxQueryBuffer = defaultClientQueryBufferLimit
+	}
+	return limits
+}
+
+// commands which do not touch dataset could be executed during loading
+var loadingAllowedCommands = map[string]bool{
+	"auth":        true,
+	"client":      true,
+	"hello":       true,
+	"info":        true,
+	"select":      true,
+	"subscribe":   true,
+	"unsubscribe": true,
+	"publish":     true,
+}
+
 // Handler implements tcp.Handler and serves as a redis server
 type Handler struct {
-	activeConn sync.Map // *client -> placeholder
-	db         database.DB
-	closing    atomic.Boolean // refusing new client and new request
+	activeConn  sync.Map // *client -> placeholder
+	db          database.DB
+	closing     atomic.Boolean // refusing new client and new request
+	loading     atomic.Boolean // dataset is being loaded in background
+	clientCount int32          // number of connected clients
+	pause       pauseState     // set by CLIENT PAUSE
+	shutdown    shutdownState  // set by SHUTDOWN
+	maxClients  int32          // read from config once, as it is checked for every connection
+	idleTimeout time.Duration  // read from config once, as it is checked for every request
+	// read locked while executing a command, Close locks it to wait for executing commands before closing db
+	executing sync.RWMutex
 }
 
 // MakeHandler creates a Handler instance
 func MakeHandler() *Handler {
-	var db database.DB
+	h := &Handler{
+		shutdown:    shutdownState{requested: make(chan struct{})},
+		maxClients:  int32(config.Properties.MaxClients),
+		idleTimeout: time.Duration(config.Properties.Timeout) * time.Second,
+	}
+	if h.maxClients <= 0 {
+		h.maxClients = defaultMaxClients
+	}
 	if config.Properties.Self != "" &&
 		len(config.Properties.Peers) > 0 {
-		db = cluster.MakeCluster()
-	} else {
-		db = database2.NewStandaloneServer()
-	}
-	return &Handler{
-		db: db,
+		h.db = cluster.MakeCluster()
+		return h
 	}
+	// load dataset in background, so that clients could connect and get LOADING error rather than connection refused
+	mdb := database2.MakeStandaloneServer()
+	h.db = mdb
+	h.loading.Set(true)
+	go func() {
+		err := mdb.Load()
+		if err != nil {
+			logger.Fatal("load dataset failed: ", err)
+		}
+		h.loading.Set(false)
+		logger.Info("dataset loaded")
+	}()
+	return h
 }
 
 func (h *Handler) closeClient(client *connection.Connection) {
 	_ = client.Close()
 	h.db.AfterClientClose(client)
 	h.activeConn.Delete(client)
+	syncatomic.AddInt32(&h.clientCount, -1)
+}
+
+// acquireClient counts a new client, returns false if the number of clients reaches maxclients
+func (h *Handler) acquireClient() bool {
+	for {
+		n := syncatomic.LoadInt32(&h.clientCount)
+		if n >= h.maxClients {
+			return false
+		}
+		if syncatomic.CompareAndSwapInt32(&h.clientCount, n, n+1) {
+			return true
+		}
+	}
+}
+
+// resetIdleDeadline closes the connection if no request is received before timeout.
+// Subscribers are waiting for messages rather than idle, so they never timeout.
+func (h *Handler) resetIdleDeadline(conn net.Conn, client *connection.Connection) {
+	if h.idleTimeout <= 0 || client.SubsCount() > 0 {
+		_ = conn.SetReadDeadline(time.Time{})
+		return
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(h.idleTimeout))
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
 }
 
 // Handle receives and executes redis commands
@@ -60,16 +162,30 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 		return
 	}
 
+	if !h.acquireClient() {
+		_, _ = conn.Write(maxClientsErrReplyBytes)
+		_ = conn.Close()
+		return
+	}
 	client := connection.NewConn(conn)
 	h.activeConn.Store(client, 1)
 
-	ch := parser.ParseStream(conn)
+	h.resetIdleDeadline(conn, client)
+	ch := parser.ParseStreamWithLimits(conn, getParseLimits())
 	for payload := range ch {
+		if payload.Err != nil && isTimeout(payload.Err) {
+			h.closeClient(client)
+			logger.Info("closing idle client: " + client.RemoteAddr().String())
+			return
+		}
+		// any request, even a bad one, means client is not idle
+		h.resetIdleDeadline(conn, client)
 		if payload.Err != nil {
 			if payload.Err == io.EOF ||
 				payload.Err == io.ErrUnexpectedEOF ||
 				strings.Contains(payload.Err.Error(), "use of closed network connection") {
-				// connection closed
+				// connection closed, the peer may still read replies if it only closed writing
+				_ = client.Flush()
 				h.closeClient(client)
 				logger.Info("connection closed: " + client.RemoteAddr().String())
 				return
@@ -84,34 +200,83 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 			}
 			continue
 		}
-		if payload.Data == nil {
-			logger.Error("empty payload")
+		if _, ok := payload.Data.(*protocol.EmptyMultiBulkReply); ok {
+			// empty request is ignored, same as redis
+			if !payload.Pending {
+				_ = client.Flush()
+			}
 			continue
 		}
 		r, ok := payload.Data.(*protocol.MultiBulkReply)
 		if !ok {
-			logger.Error("require multi bulk protocol")
+			// other types are not requests, e.g. "+OK", client must not wait for reply forever
+			_ = client.Write(protocolErrReplyBytes)
 			continue
 		}
-		result := h.db.Exec(client, r.Args)
+		cmdName := strings.ToLower(string(r.Args[0]))
+		client.SetLastCmd(cmdName)
+		if h.loading.Get() && !loadingAllowedCommands[cmdName] {
+			_ = client.Write(loadingErrReplyBytes)
+			continue
+		}
+		// client executing a command, e.g. blocked, is not idle
+		_ = conn.SetReadDeadline(time.Time{})
+		if h.isPaused(client, cmdName) {
+			// replies of previous requests should not be held during the pause
+			_ = client.Flush()
+			h.waitPause(client, cmdName)
+		}
+		h.executing.RLock()
+		if h.closing.Get() {
+			h.executing.RUnlock()
+			// released from pause by shutdown, the dataset has been persisted.
+			// Requests left are not executed, but replies of executed ones must be sent
+			_ = client.Flush()
+			continue
+		}
+		var result redis.Reply
+		closeSelf := false
+		if cmdName == "client" {
+			result, closeSelf = h.execClient(client, r.Args)
+		} else if cmdName == "shutdown" {
+			result = h.execShutdown(client, r.Args)
+		} else {
+			result = h.db.Exec(client, r.Args)
+		}
+		// writing reply may be slow, it should not block Close
+		h.executing.RUnlock()
+		h.resetTrackingCaching(client, r.Args)
 		if result != nil {
-			_ = client.Write(result.ToBytes())
+			_ = client.WriteReply(result)
 		} else {
-			_ = client.Write(unknownErrReplyBytes)
+			_ = client.WriteBuffered(unknownErrReplyBytes)
+		}
+		// replies of a pipeline are sent together after its last request
+		if !payload.Pending || closeSelf {
+			_ = client.Flush()
+		}
+		if closeSelf {
+			// parser finds connection closed, then the loop ends
+			_ = client.Close()
+			continue
 		}
+		h.resetIdleDeadline(conn, client)
 	}
+	// parser stopped after replying a fatal protocol error, e.g. request exceeds limits
+	h.closeClient(client)
+	logger.Info("connection closed: " + client.RemoteAddr().String())
 }
 
 // Close stops handler
 func (h *Handler) Close() error {
 	logger.Info("handler shutting down...")
 	h.closing.Set(true)
-	// TODO: concurrent wait
-	h.activeConn.Range(func(key interface{}, val interface{}) bool {
-		client := key.(*connection.Connection)
-		_ = client.Close()
-		return true
-	})
-	h.db.Close()
-	return nil
+	// release paused clients, so that they could find handler closing
+	h.unpauseClients(true)
+	h.drainClients()
+	// clients not drained before timeout may be still executing commands, which must not write to closed db and aof.
+	// Commands received later are not executed since handler is closing
+	h.executing.Lock()
+	defer h.executing.Unlock()
+	return h.closeDB()
 }
@@ -2,12 +2,31 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/client"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
 	"github.com/hdt3213/godis/tcp"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+func waitLoaded(handler *Handler) {
+	for handler.loading.Get() {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestListenAndServe(t *testing.T) {
 	var err error
 	closeChan := make(chan struct{})
@@ -17,7 +36,9 @@ func TestListenAndServe(t *testing.T) {
 		return
 	}
 	addr := listener.Addr().String()
-	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	handler := MakeHandler()
+	waitLoaded(handler)
+	go tcp.ListenAndServe(listener, handler, closeChan)
 
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -42,3 +63,419 @@ func TestListenAndServe(t *testing.T) {
 	closeChan <- struct{}{}
 	time.Sleep(time.Second)
 }
+
+func TestLoading(t *testing.T) {
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler := MakeHandler()
+	waitLoaded(handler)
+	handler.loading.Set(true) // pretend to be loading
+	go tcp.ListenAndServe(listener, handler, closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bufReader := bufio.NewReader(conn)
+	_, _ = conn.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	line, _, err := bufReader.ReadLine()
+	if err != nil || string(line) != "-LOADING godis is loading the dataset in memory" {
+		t.Errorf("expect LOADING error, actually %s %v", line, err)
+		return
+	}
+	_, _ = conn.Write([]byte("*2\r\n$4\r\nINFO\r\n$11\r\npersistence\r\n"))
+	line, _, err = bufReader.ReadLine()
+	if err != nil || line[0] != '$' {
+		t.Errorf("expect INFO allowed during loading, actually %s %v", line, err)
+		return
+	}
+}
+
+func TestInline(t *testing.T) {
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler := MakeHandler()
+	waitLoaded(handler)
+	go tcp.ListenAndServe(listener, handler, closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bufReader := bufio.NewReader(conn)
+	_, _ = conn.Write([]byte("SET inline \"a b\"\nGET inline\r\n"))
+	expected := []string{"+OK", "$3", "a b"}
+	for _, exp := range expected {
+		line, _, err := bufReader.ReadLine()
+		if err != nil || string(line) != exp {
+			t.Errorf("expect %s, actually %s %v", exp, line, err)
+			return
+		}
+	}
+
+	// requests other than multi bulk and inline commands get protocol error
+	_, _ = conn.Write([]byte("*0\r\n+PING\r\n:1\r\nPING\r\n"))
+	expected = []string{
+		"-ERR Protocol error: expected multi bulk or inline command",
+		"-ERR Protocol error: expected multi bulk or inline command",
+		"+PONG",
+	}
+	for _, exp := range expected {
+		line, _, err := bufReader.ReadLine()
+		if err != nil || string(line) != exp {
+			t.Errorf("expect %s, actually %s %v", exp, line, err)
+			return
+		}
+	}
+
+	// connection is closed after too big inline request
+	_, _ = conn.Write([]byte(strings.Repeat("a", 64*1024+1) + "\n"))
+	line, _, err := bufReader.ReadLine()
+	if err != nil || string(line) != "-ERR Protocol error: too big inline request" {
+		t.Errorf("expect protocol error, actually %s %v", line, err)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = bufReader.ReadLine()
+	if err != io.EOF {
+		t.Errorf("expect connection closed, actually %v", err)
+	}
+}
+
+func TestProtocolLimits(t *testing.T) {
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler := MakeHandler()
+	waitLoaded(handler)
+	go tcp.ListenAndServe(listener, handler, closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+	}()
+
+	requests := map[string]string{
+		"*2147483647\r\n":         "-ERR Protocol error: invalid multibulk length",
+		"*1\r\n$999999999999\r\n": "-ERR Protocol error: invalid bulk length",
+	}
+	for request, expected := range requests {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		bufReader := bufio.NewReader(conn)
+		_, _ = conn.Write([]byte(request))
+		line, _, err := bufReader.ReadLine()
+		if err != nil || string(line) != expected {
+			t.Errorf("expect %s, actually %s %v", expected, line, err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = bufReader.ReadLine()
+		if err != io.EOF {
+			t.Errorf("expect connection closed, actually %v", err)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "godis.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler := MakeHandler()
+	waitLoaded(handler)
+	closeChan := make(chan struct{})
+	go tcp.ListenAndServe(listener, handler, closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+	}()
+
+	c, err := client.MakeClient("unix://" + path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	c.Start()
+	defer c.Close()
+	result := c.Send([][]byte{[]byte("PING")})
+	if status, ok := result.(*protocol.StatusReply); !ok || status.Status != "PONG" {
+		t.Errorf("expect PONG, actually %s", result.ToBytes())
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	maxClients := config.Properties.MaxClients
+	config.Properties.MaxClients = 1
+	defer func() {
+		config.Properties.MaxClients = maxClients
+	}()
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler := MakeHandler()
+	waitLoaded(handler)
+	go tcp.ListenAndServe(listener, handler, closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+	}()
+
+	conn1, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reader1 := bufio.NewReader(conn1)
+	_, _ = conn1.Write([]byte("PING\r\n"))
+	line, _, err := reader1.ReadLine()
+	if err != nil || string(line) != "+PONG" {
+		t.Errorf("expect PONG, actually %s %v", line, err)
+		return
+	}
+
+	conn2, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reader2 := bufio.NewReader(conn2)
+	line, _, err = reader2.ReadLine()
+	if err != nil || string(line) != "-ERR max number of clients reached" {
+		t.Errorf("expect max clients error, actually %s %v", line, err)
+		return
+	}
+	_ = conn2.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = reader2.ReadLine()
+	if err != io.EOF {
+		t.Errorf("expect connection closed, actually %v", err)
+	}
+
+	// slot is released after client closed
+	_ = conn1.Close()
+	time.Sleep(100 * time.Millisecond)
+	conn3, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn3.Close()
+	_, _ = conn3.Write([]byte("PING\r\n"))
+	line, _, err = bufio.NewReader(conn3).ReadLine()
+	if err != nil || string(line) != "+PONG" {
+		t.Errorf("expect PONG, actually %s %v", line, err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	timeout := config.Properties.Timeout
+	config.Properties.Timeout = 1
+	defer func() {
+		config.Properties.Timeout = timeout
+	}()
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler := MakeHandler()
+	waitLoaded(handler)
+	go tcp.ListenAndServe(listener, handler, closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+	}()
+
+	idle, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	subscriber, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer subscriber.Close()
+	subReader := bufio.NewReader(subscriber)
+	_, _ = subscriber.Write([]byte("SUBSCRIBE ch\r\n"))
+	for i := 0; i < 6; i++ {
+		_, _, err = subReader.ReadLine()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	_ = idle.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _, err = bufio.NewReader(idle).ReadLine()
+	if err != io.EOF {
+		t.Errorf("expect idle client closed, actually %v", err)
+	}
+
+	// subscriber is still alive
+	publisher, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer publisher.Close()
+	_, _ = publisher.Write([]byte("PUBLISH ch hello\r\n"))
+	expected := []string{"*3", "$7", "message", "$2", "ch", "$5", "hello"}
+	_ = subscriber.SetReadDeadline(time.Now().Add(time.Second))
+	for _, exp := range expected {
+		line, _, err := subReader.ReadLine()
+		if err != nil || string(line) != exp {
+			t.Errorf("expect %s, actually %s %v", exp, line, err)
+			return
+		}
+	}
+}
+
+// countingConn counts Write calls, i.e. syscalls of sending replies
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestPipelineBatching(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	handler := MakeHandler()
+	waitLoaded(handler)
+	defer handler.Close()
+	serverConn := make(chan *countingConn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		counting := &countingConn{Conn: conn}
+		serverConn <- counting
+		handler.Handle(context.Background(), counting)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	const n = 100
+	var pipeline []byte
+	for i := 0; i < n; i++ {
+		pipeline = append(pipeline, protocol.MakeMultiBulkReply(utils.ToCmdLine("INCR", "counter")).ToBytes()...)
+	}
+	if _, err = conn.Write(pipeline); err != nil {
+		t.Fatal(err)
+	}
+	ch := parser.ParseStream(conn)
+	for i := 1; i <= n; i++ {
+		payload := <-ch
+		if payload.Err != nil {
+			t.Fatal(payload.Err)
+		}
+		asserts.AssertIntReply(t, payload.Data, i)
+	}
+	writes := atomic.LoadInt32(&(<-serverConn).writes)
+	// the pipeline may be received in several reads, but far less than one write per request
+	if writes >= n/10 {
+		t.Errorf("replies of pipeline should be batched, actually %d writes", writes)
+	}
+}
+
+func TestPartialPipeline(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a full request followed by a partial one, reply of the former should not wait for the rest
+	data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "a")).ToBytes()
+	data = append(data, "*2\r\n$3\r\nGET"...)
+	if _, err = conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	ch := parser.ParseStream(conn)
+	payload := <-ch
+	if payload.Err != nil {
+		t.Fatal(payload.Err)
+	}
+	asserts.AssertStatusReply(t, payload.Data, "OK")
+	_ = conn.SetReadDeadline(time.Time{})
+	if _, err = conn.Write([]byte("\r\n$1\r\na\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	payload = <-ch
+	if payload.Err != nil {
+		t.Fatal(payload.Err)
+	}
+	asserts.AssertBulkReply(t, payload.Data, "a")
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	addr, stop := startTestServer(b)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	// the same as redis-benchmark -P 16
+	const depth = 16
+	var pipeline []byte
+	for i := 0; i < depth; i++ {
+		pipeline = append(pipeline, protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "key", "value")).ToBytes()...)
+	}
+	ch := parser.ParseStream(conn)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = conn.Write(pipeline); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < depth; j++ {
+			if payload := <-ch; payload.Err != nil {
+				b.Fatal(payload.Err)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+/*
+ * SHUTDOWN persists the dataset while clients are paused, so that the server could keep running if persistence failed.
+ * Then the tcp server is requested to stop, which closes all clients concurrently and the database.
+ */
+
+import (
+	"github.com/hdt3213/godis/config"
+	database2 "github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout is used if shutdown-timeout is not set
+const defaultShutdownTimeout = 10 * time.Second
+
+// shutdownPauseTimeout is long enough for persisting dataset, the pause ends when shutdown aborted
+const shutdownPauseTimeout = time.Hour
+
+// shutdownDB is implemented by databases reporting persistence errors, cluster does not support it yet
+type shutdownDB interface {
+	PrepareShutdown(saveMode int) error
+	Shutdown(saveMode int) error
+}
+
+type shutdownState struct {
+	once      sync.Once
+	requested chan struct{} // closed by SHUTDOWN
+	// saveMode of the final saving in Close, dataset may have been saved by SHUTDOWN
+	saveMode int
+	// err is the persistence error ignored by SHUTDOWN FORCE, the process should exit with failure
+	err error
+}
+
+// ShutdownRequested implements tcp.ShutdownHandler, the returned channel is closed by SHUTDOWN
+func (h *Handler) ShutdownRequested() <-chan struct{} {
+	return h.shutdown.requested
+}
+
+// execShutdown executes SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE], it replies nothing on success.
+// NOW is accepted for compatibility, godis has no replica to wait for.
+func (h *Handler) execShutdown(c *connection.Connection, args [][]byte) redis.Reply {
+	if !isAuthenticated(c) {
+		return protocol.MakeErrReply("NOAUTH Authentication required")
+	}
+	saveMode := database2.ShutdownSaveDefault
+	force := false
+	for _, arg := range args[1:] {
+		switch strings.ToLower(string(arg)) {
+		case "nosave":
+			if saveMode == database2.ShutdownSave {
+				return protocol.MakeSyntaxErrReply()
+			}
+			saveMode = database2.ShutdownNoSave
+		case "save":
+			if saveMode == database2.ShutdownNoSave {
+				return protocol.MakeSyntaxErrReply()
+			}
+			saveMode = database2.ShutdownSave
+		case "now":
+		case "force":
+			force = true
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+
+	var err error
+	if sdb, ok := h.db.(shutdownDB); ok {
+		// no more writes after the dataset persisted
+		h.pauseClients(pauseAll, time.Now().Add(shutdownPauseTimeout))
+		err = sdb.PrepareShutdown(saveMode)
+		if err != nil {
+			logger.Error("persist dataset before shutdown failed: " + err.Error())
+			if !force {
+				h.unpauseClients(true)
+				return protocol.MakeErrReply("ERR Errors trying to SHUTDOWN. Check logs.")
+			}
+		}
+		// dataset has been saved, only aof is flushed on close
+		saveMode = database2.ShutdownNoSave
+	}
+	h.shutdown.once.Do(func() {
+		h.shutdown.saveMode = saveMode
+		h.shutdown.err = err
+		close(h.shutdown.requested)
+	})
+	logger.Info("user requested shutdown...")
+	return &protocol.NoReply{}
+}
+
+// drainClients closes all clients concurrently, each of them waits for replies being sent.
+// It stops waiting after shutdown-timeout.
+func (h *Handler) drainClients() {
+	timeout := time.Duration(config.Properties.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	var wg sync.WaitGroup
+	h.activeConn.Range(func(key interface{}, val interface{}) bool {
+		client := key.(*connection.Connection)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = client.Close()
+		}()
+		return true
+	})
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warn("timeout waiting for clients to close")
+	}
+}
+
+// closeDB closes database after clients closed, it returns error if persistence failed
+func (h *Handler) closeDB() error {
+	sdb, ok := h.db.(shutdownDB)
+	if !ok {
+		h.db.Close()
+		return nil
+	}
+	// saveMode and err were written before requested was closed
+	saveMode, err := database2.ShutdownSaveDefault, error(nil)
+	select {
+	case <-h.shutdown.requested:
+		saveMode, err = h.shutdown.saveMode, h.shutdown.err
+	default:
+	}
+	if closeErr := sdb.Shutdown(saveMode); closeErr != nil {
+		logger.Error("persist dataset on shutdown failed: " + closeErr.Error())
+		return closeErr
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"github.com/hdt3213/godis/tcp"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startShutdownTestServer starts a server which is stopped by SHUTDOWN, the error of ListenAndServe is sent to done
+func startShutdownTestServer(t *testing.T) (addr string, done <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := MakeHandler()
+	waitLoaded(handler)
+	ch := make(chan error, 1)
+	go func() {
+		ch <- tcp.ListenAndServe(listener, handler, make(chan struct{}))
+	}()
+	return listener.Addr().String(), ch
+}
+
+func waitServerStopped(t *testing.T, done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("server is not stopped")
+	}
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rdbFilename := config.Properties.RDBFilename
+	defer func() {
+		config.Properties.RDBFilename = rdbFilename
+	}()
+	addr, done := startShutdownTestServer(t)
+	config.Properties.RDBFilename = filepath.Join(dir, "dump.rdb")
+	c1 := dialTestClient(t, addr)
+	defer c1.conn.Close()
+	c2 := dialTestClient(t, addr)
+	defer c2.conn.Close()
+
+	asserts.AssertErrReply(t, c1.send(t, "SHUTDOWN", "SAVE", "NOSAVE"), "Err syntax error")
+	asserts.AssertStatusReply(t, c1.send(t, "SET", "a", "1"), "OK")
+	if ret := c1.send(t, "SHUTDOWN", "SAVE", "NOW"); ret != nil {
+		t.Errorf("expect connection closed, actually %s", ret.ToBytes())
+	}
+	if ret := c2.receive(t); ret != nil {
+		t.Errorf("expect connection closed, actually %s", ret.ToBytes())
+	}
+	if err := waitServerStopped(t, done); err != nil {
+		t.Errorf("expect shutdown without error, actually %v", err)
+	}
+	if _, err := os.Stat(config.Properties.RDBFilename); err != nil {
+		t.Errorf("rdb should be saved: %v", err)
+	}
+}
+
+func TestShutdownFailed(t *testing.T) {
+	rdbFilename := config.Properties.RDBFilename
+	defer func() {
+		config.Properties.RDBFilename = rdbFilename
+	}()
+	addr, done := startShutdownTestServer(t)
+	config.Properties.RDBFilename = filepath.Join(os.TempDir(), "no-such-dir", "dump.rdb")
+	c := dialTestClient(t, addr)
+	defer c.conn.Close()
+
+	ret := c.send(t, "SHUTDOWN", "SAVE")
+	asserts.AssertErrReply(t, ret, "ERR Errors trying to SHUTDOWN. Check logs.")
+	// server keeps running
+	asserts.AssertStatusReply(t, c.send(t, "SET", "a", "1"), "OK")
+
+	if ret = c.send(t, "SHUTDOWN", "SAVE", "FORCE"); ret != nil {
+		t.Errorf("expect connection closed, actually %s", ret.ToBytes())
+	}
+	if err := waitServerStopped(t, done); err == nil {
+		t.Error("expect error of persistence")
+	}
+}
+
+// blockingDB blocks executing commands until released
+type blockingDB struct {
+	executing chan struct{}
+	release   chan struct{}
+	closed    int32
+	// a command finished after db closed
+	execAfterClose int32
+}
+
+func (db *blockingDB) Exec(c redis.Connection, cmdLine [][]byte) redis.Reply {
+	db.executing <- struct{}{}
+	<-db.release
+	if atomic.LoadInt32(&db.closed) == 1 {
+		atomic.StoreInt32(&db.execAfterClose, 1)
+	}
+	return protocol.MakeOkReply()
+}
+
+func (db *blockingDB) AfterClientClose(c redis.Connection) {}
+
+func (db *blockingDB) Close() {
+	atomic.StoreInt32(&db.closed, 1)
+}
+
+func TestCloseWaitsForExecutingCommands(t *testing.T) {
+	shutdownTimeout := config.Properties.ShutdownTimeout
+	defer func() {
+		config.Properties.ShutdownTimeout = shutdownTimeout
+	}()
+	config.Properties.ShutdownTimeout = 1
+	db := &blockingDB{executing: make(chan struct{}, 1), release: make(chan struct{})}
+	h := &Handler{
+		db:         db,
+		maxClients: defaultMaxClients,
+		shutdown:   shutdownState{requested: make(chan struct{})},
+	}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go h.Handle(context.Background(), serverConn)
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, clientConn)
+	}()
+	_, _ = clientConn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "1")).ToBytes())
+	<-db.executing
+
+	closed := make(chan struct{})
+	go func() {
+		_ = h.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Error("db should not be closed while executing commands after drain timeout")
+	case <-time.After(1500 * time.Millisecond):
+	}
+	close(db.release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler is not closed")
+	}
+	if atomic.LoadInt32(&db.execAfterClose) == 1 {
+		t.Error("command executed after db closed")
+	}
+}
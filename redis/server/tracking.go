@@ -0,0 +1,131 @@
+package server
+
+import (
+	database2 "github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// trackingDB is implemented by databases supporting CLIENT TRACKING, cluster does not support it yet
+type trackingDB interface {
+	EnableTracking(c redis.Connection, opts *database2.TrackingOptions) error
+	DisableTracking(c redis.Connection)
+	SetTrackingCaching(c redis.Connection, caching bool) error
+	ResetTrackingCaching(c redis.Connection)
+}
+
+var trackingNotSupportedErr = protocol.MakeErrReply("ERR CLIENT TRACKING is not supported in cluster mode")
+
+// findClient returns the connected client with the given id
+func (h *Handler) findClient(id uint64) *connection.Connection {
+	var found *connection.Connection
+	h.activeConn.Range(func(key, value interface{}) bool {
+		c := key.(*connection.Connection)
+		if c.ID() == id {
+			found = c
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// execClientTracking executes CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix [PREFIX prefix ...]] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+func (h *Handler) execClientTracking(c *connection.Connection, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("client|tracking")
+	}
+	tdb, ok := h.db.(trackingDB)
+	if !ok {
+		return trackingNotSupportedErr
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "on":
+	case "off":
+		tdb.DisableTracking(c)
+		return protocol.MakeOkReply()
+	default:
+		return protocol.MakeSyntaxErrReply()
+	}
+	opts := &database2.TrackingOptions{}
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "redirect" && i+1 < len(args):
+			i++
+			id, err := strconv.ParseUint(string(args[i]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			target := h.findClient(id)
+			if target == nil {
+				return protocol.MakeErrReply("ERR The client ID you want redirect to does not exist")
+			}
+			opts.Redirect = target
+		case option == "prefix" && i+1 < len(args):
+			i++
+			opts.Prefixes = append(opts.Prefixes, string(args[i]))
+		case option == "bcast":
+			opts.BCast = true
+		case option == "optin":
+			opts.OptIn = true
+		case option == "optout":
+			opts.OptOut = true
+		case option == "noloop":
+			opts.NoLoop = true
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	if len(opts.Prefixes) > 0 && !opts.BCast {
+		return protocol.MakeErrReply("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+	if opts.OptIn && opts.OptOut {
+		return protocol.MakeErrReply("ERR You can't use both OPTIN and OPTOUT.")
+	}
+	if (opts.OptIn || opts.OptOut) && opts.BCast {
+		return protocol.MakeErrReply("ERR OPTIN and OPTOUT are not compatible with BCAST")
+	}
+	if err := tdb.EnableTracking(c, opts); err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+// execClientCaching executes CLIENT CACHING YES|NO
+func (h *Handler) execClientCaching(c *connection.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("client|caching")
+	}
+	tdb, ok := h.db.(trackingDB)
+	if !ok {
+		return trackingNotSupportedErr
+	}
+	var caching bool
+	switch strings.ToLower(string(args[0])) {
+	case "yes":
+		caching = true
+	case "no":
+		caching = false
+	default:
+		return protocol.MakeSyntaxErrReply()
+	}
+	if err := tdb.SetTrackingCaching(c, caching); err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+// resetTrackingCaching resets CLIENT CACHING flag, which only affects the next command
+func (h *Handler) resetTrackingCaching(c *connection.Connection, cmdLine [][]byte) {
+	if len(cmdLine) >= 2 && strings.EqualFold(string(cmdLine[0]), "client") &&
+		strings.EqualFold(string(cmdLine[1]), "caching") {
+		return
+	}
+	if tdb, ok := h.db.(trackingDB); ok {
+		tdb.ResetTrackingCaching(c)
+	}
+}
@@ -2,8 +2,12 @@ package tcp
 
 import (
 	"bufio"
+	"errors"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -51,3 +55,225 @@ func TestListenAndServe(t *testing.T) {
 	closeChan <- struct{}{}
 	time.Sleep(time.Second)
 }
+
+func TestServeListeners(t *testing.T) {
+	closeChan := make(chan struct{})
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		listeners = append(listeners, listener)
+	}
+	done := make(chan struct{})
+	go func() {
+		ServeListeners(listeners, MakeEchoHandler(), closeChan)
+		close(done)
+	}()
+
+	for _, listener := range listeners {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, err = conn.Write([]byte("hello\n"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		line, _, err := bufio.NewReader(conn).ReadLine()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(line) != "hello" {
+			t.Error("get wrong response")
+			return
+		}
+		_ = conn.Close()
+	}
+	closeChan <- struct{}{}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Error("server is not stopped")
+		return
+	}
+	for _, listener := range listeners {
+		_, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			t.Error("listener should be closed")
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "godis.sock")
+	// stale socket file should be replaced
+	err = ioutil.WriteFile(path, nil, 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	listeners, err := listen(&Config{
+		UnixSocket:     path,
+		UnixSocketPerm: 0700,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("expect perm 0700, actually %o", info.Mode().Perm())
+	}
+	closeChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ServeListeners(listeners, MakeEchoHandler(), closeChan)
+		close(done)
+	}()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = conn.Write([]byte("hello\n"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	line, _, err := bufio.NewReader(conn).ReadLine()
+	if err != nil || string(line) != "hello" {
+		t.Errorf("get wrong response: %s %v", line, err)
+		return
+	}
+	_ = conn.Close()
+	closeChan <- struct{}{}
+	<-done
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Error("socket file should be removed")
+	}
+}
+
+// shutdownEchoHandler requests to stop the server once shutdown is closed
+type shutdownEchoHandler struct {
+	*EchoHandler
+	shutdown chan struct{}
+}
+
+func (h *shutdownEchoHandler) ShutdownRequested() <-chan struct{} {
+	return h.shutdown
+}
+
+func (h *shutdownEchoHandler) Close() error {
+	_ = h.EchoHandler.Close()
+	return errors.New("persistence failed")
+}
+
+func TestShutdownHandler(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &shutdownEchoHandler{
+		EchoHandler: MakeEchoHandler(),
+		shutdown:    make(chan struct{}),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- ListenAndServe(listener, handler, make(chan struct{}))
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	close(handler.shutdown)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expect error of closing handler")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("server is not stopped")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection should be closed")
+	}
+}
+
+func TestMaxConnectAndTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_ = serve([]net.Listener{listener}, MakeEchoHandler(), closeChan, &Config{
+			MaxConnect: 1,
+			Timeout:    500 * time.Millisecond,
+		})
+		close(done)
+	}()
+	addr := listener.Addr().String()
+	echo := func(conn net.Conn) error {
+		_, err := conn.Write([]byte("hello\n"))
+		if err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, _, err = bufio.NewReader(conn).ReadLine()
+		return err
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = echo(conn); err != nil {
+		t.Fatal(err)
+	}
+	refused, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	if err = echo(refused); err == nil {
+		t.Error("expect connection over max-connect to be closed")
+	}
+
+	// idle connection is closed, then a new connection is accepted
+	time.Sleep(time.Second)
+	if err = echo(conn); err == nil {
+		t.Error("expect idle connection to be closed")
+	}
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if err = echo(conn2); err != nil {
+		t.Error(err)
+	}
+
+	closeChan <- struct{}{}
+	<-done
+}
@@ -6,6 +6,8 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/hdt3213/godis/interface/tcp"
 	"github.com/hdt3213/godis/lib/logger"
@@ -13,71 +15,209 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 // Config stores tcp server properties
 type Config struct {
-	Address    string        `yaml:"address"`
-	MaxConnect uint32        `yaml:"max-connect"`
-	Timeout    time.Duration `yaml:"timeout"`
+	// Address is plain tcp address, empty means disabled
+	Address string `yaml:"address"`
+	// TLSAddress is tls address using TLSConfig, empty means disabled
+	TLSAddress string      `yaml:"tls-address"`
+	TLSConfig  *tls.Config `yaml:"-"`
+	// UnixSocket is path of unix socket, empty means disabled
+	UnixSocket string `yaml:"unix-socket"`
+	// UnixSocketPerm is permission of socket file, 0 means default
+	UnixSocketPerm os.FileMode `yaml:"unix-socket-perm"`
+	// MaxConnect is the max number of connections, new connections over it are closed, 0 means no limit.
+	// Handlers replying errors to refused clients, such as redis handler with maxclients, could limit it themselves
+	MaxConnect uint32 `yaml:"max-connect"`
+	// Timeout closes connections idle for longer than it, 0 means no timeout
+	Timeout time.Duration `yaml:"timeout"`
 }
 
-// ListenAndServeWithSignal binds port and handle requests, blocking until receive stop signal
+// ListenAndServeWithSignal binds port and handle requests, blocking until receive stop signal.
+// It returns error if the handler failed to close, e.g. the final persistence failed.
 func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
-	closeChan := make(chan struct{})
-	sigCh := make(chan os.Signal)
-	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	closeChan := make(chan struct{}, 1)
+	// SIGHUP is sent when the terminal is closed, it should not stop a server
+	signal.Ignore(syscall.SIGHUP)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
-		sig := <-sigCh
-		switch sig {
-		case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-			closeChan <- struct{}{}
-		}
+		<-sigCh
+		closeChan <- struct{}{}
 	}()
-	listener, err := net.Listen("tcp", cfg.Address)
+	listeners, err := listen(cfg)
 	if err != nil {
 		return err
 	}
-	//cfg.Address = listener.Addr().String()
-	logger.Info(fmt.Sprintf("bind: %s, start listening...", cfg.Address))
-	ListenAndServe(listener, handler, closeChan)
-	return nil
+	return serve(listeners, handler, closeChan, cfg)
+}
+
+// listen binds all addresses in cfg
+func listen(cfg *Config) ([]net.Listener, error) {
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}
+	if cfg.Address != "" {
+		listener, err := net.Listen("tcp", cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("bind: %s, start listening...", cfg.Address))
+		listeners = append(listeners, listener)
+	}
+	if cfg.TLSAddress != "" {
+		listener, err := tls.Listen("tcp", cfg.TLSAddress, cfg.TLSConfig)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("bind: %s, start listening tls...", cfg.TLSAddress))
+		listeners = append(listeners, listener)
+	}
+	if cfg.UnixSocket != "" {
+		listener, err := listenUnix(cfg.UnixSocket, cfg.UnixSocketPerm)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("bind: %s, start listening unix socket...", cfg.UnixSocket))
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no address to listen")
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on unix socket, the socket file is removed when listener closed
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	// remove socket file left by unclean shutdown
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if perm != 0 {
+		err = os.Chmod(path, perm)
+		if err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
 }
 
 // ListenAndServe binds port and handle requests, blocking until close
-func ListenAndServe(listener net.Listener, handler tcp.Handler, closeChan <-chan struct{}) {
+func ListenAndServe(listener net.Listener, handler tcp.Handler, closeChan <-chan struct{}) error {
+	return ServeListeners([]net.Listener{listener}, handler, closeChan)
+}
+
+// ServeListeners handles requests from all listeners by the same handler, blocking until close.
+// The server is also closed if handler implements tcp.ShutdownHandler and requests to stop.
+// All listeners are closed if any of them failed. It returns the error of closing handler.
+func ServeListeners(listeners []net.Listener, handler tcp.Handler, closeChan <-chan struct{}) error {
+	return serve(listeners, handler, closeChan, &Config{})
+}
+
+// serve is ServeListeners enforcing MaxConnect and Timeout of cfg
+func serve(listeners []net.Listener, handler tcp.Handler, closeChan <-chan struct{}, cfg *Config) error {
+	closeListeners := func() {
+		for _, listener := range listeners {
+			_ = listener.Close() // listener.Accept() will return err immediately
+		}
+	}
+	// handler is closed only once, later invokers wait for the first one
+	var closeOnce sync.Once
+	var closeErr error
+	closeHandler := func() {
+		closeOnce.Do(func() {
+			closeErr = handler.Close() // close connections
+		})
+	}
+	var shutdownRequested <-chan struct{}
+	if h, ok := handler.(tcp.ShutdownHandler); ok {
+		shutdownRequested = h.ShutdownRequested()
+	}
 	// listen signal
 	go func() {
-		<-closeChan
+		select {
+		case <-closeChan:
+		case <-shutdownRequested:
+		}
 		logger.Info("shutting down...")
-		_ = listener.Close() // listener.Accept() will return err immediately
-		_ = handler.Close()  // close connections
+		closeListeners()
+		closeHandler()
 	}()
 
-	// listen port
-	defer func() {
-		// close during unexpected error
-		_ = listener.Close()
-		_ = handler.Close()
-	}()
 	ctx := context.Background()
+	var connCount int32
 	var waitDone sync.WaitGroup
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			break
-		}
-		// handle
-		logger.Info("accept link")
-		waitDone.Add(1)
-		go func() {
-			defer func() {
-				waitDone.Done()
-			}()
-			handler.Handle(ctx, conn)
-		}()
+	var waitAccept sync.WaitGroup
+	for _, listener := range listeners {
+		waitAccept.Add(1)
+		go func(listener net.Listener) {
+			defer waitAccept.Done()
+			defer closeListeners()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					break
+				}
+				if cfg.MaxConnect > 0 && atomic.AddInt32(&connCount, 1) > int32(cfg.MaxConnect) {
+					atomic.AddInt32(&connCount, -1)
+					logger.Warn("max number of connections reached, refuse " + conn.RemoteAddr().String())
+					_ = conn.Close()
+					continue
+				}
+				if cfg.Timeout > 0 {
+					conn = &idleTimeoutConn{Conn: conn, timeout: cfg.Timeout}
+				}
+				// handle
+				logger.Info("accept link")
+				waitDone.Add(1)
+				go func() {
+					defer func() {
+						if cfg.MaxConnect > 0 {
+							atomic.AddInt32(&connCount, -1)
+						}
+						waitDone.Done()
+					}()
+					handler.Handle(ctx, conn)
+					// the connection is not counted after handler returned, e.g. on read timeout
+					_ = conn.Close()
+				}()
+			}
+		}(listener)
 	}
+	waitAccept.Wait()
+	// close during unexpected error
+	closeListeners()
+	closeHandler()
 	waitDone.Wait()
+	return closeErr
+}
+
+// idleTimeoutConn fails to read if nothing was received in timeout, then handler closes the connection
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
 }